@@ -5,14 +5,17 @@ import (
 	"container/list"
 	"fmt"
 	"nakevaleng/core/record"
+	"sync"
 )
 
 // LRU represents a Least Recently Used Cache implemented using a doubly-linked
 // list for fast insertions and deletions, and a map for fast searching.
+// It's safe for concurrent use. Since Get reorders the list, every operation takes the same lock.
 type LRU struct {
 	Capacity int
 	Order    list.List
 	Data     map[string]*list.Element
+	mu       sync.Mutex
 }
 
 // New returns a pointer to a new LRU object.
@@ -42,6 +45,9 @@ func ValidateParams(capacity int) error {
 // Get returns the record stored in the LRU based on the passed key, as well as whether
 // or not the record is present.
 func (lru *LRU) Get(key string) (rec record.Record, isPresent bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
 	el, exists := lru.Data[key]
 	if !exists {
 		return record.Record{}, false
@@ -55,6 +61,9 @@ func (lru *LRU) Get(key string) (rec record.Record, isPresent bool) {
 // Set inserts the passed record into the LRU. If the LRU is full, Set will remove the least
 // recently used record so it can insert the new one.
 func (lru *LRU) Set(rec record.Record) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
 	key := string(rec.Key)
 
 	if el, exists := lru.Data[key]; exists {
@@ -78,6 +87,9 @@ func (lru *LRU) Set(rec record.Record) {
 // or not the record was present. If the record with the passed key was found in the LRU,
 // it will be removed.
 func (lru *LRU) Remove(key string) (rec record.Record, wasPresent bool) {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
 	el, exists := lru.Data[key]
 	if !exists {
 		return record.Record{}, false
@@ -90,3 +102,20 @@ func (lru *LRU) Remove(key string) (rec record.Record, wasPresent bool) {
 
 	return rec, true
 }
+
+// RemoveRange removes all records whose keys fall in the range [min, max] from the LRU, and returns
+// how many there were.
+func (lru *LRU) RemoveRange(min, max string) int {
+	lru.mu.Lock()
+	defer lru.mu.Unlock()
+
+	removed := 0
+	for key, el := range lru.Data {
+		if key >= min && key <= max {
+			delete(lru.Data, key)
+			lru.Order.Remove(el)
+			removed++
+		}
+	}
+	return removed
+}
@@ -0,0 +1,78 @@
+package lsmtree
+
+import (
+	"bytes"
+	"container/heap"
+	"nakevaleng/core/record"
+)
+
+// iteratorHeap is a min-heap of records taken from a set of iterators, used by NewMergeIterator.
+// Records are ordered by key. If keys are the same, the record with the greater sequence number
+// comes first, and if those are the same too, the one from the iterator with the lower Handle does.
+type iteratorHeap []recordHandlePair
+
+func (h iteratorHeap) Len() int { return len(h) }
+
+func (h iteratorHeap) Less(i, j int) bool {
+	keyCmp := bytes.Compare(h[i].Rec.Key, h[j].Rec.Key)
+	if keyCmp != 0 {
+		return keyCmp < 0
+	}
+	if h[i].Rec.Seq != h[j].Rec.Seq {
+		return h[i].Rec.Seq > h[j].Rec.Seq
+	}
+	return h[i].Handle < h[j].Handle
+}
+
+func (h iteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *iteratorHeap) Push(x interface{}) { *h = append(*h, x.(recordHandlePair)) }
+
+func (h *iteratorHeap) Pop() interface{} {
+	old := *h
+	elem := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return elem
+}
+
+// NewMergeIterator performs a lazy k-way merge over the given iterators, each of which must return
+// records sorted by key. Only the newest version of each key is returned: the one with the greatest
+// sequence number. Iterators should be ordered from the newest source to the oldest one, which is
+// used to break ties between records with the same sequence number. Compaction merges tables
+// through it too, see merge.
+// The returned iterator is not circular: once it's exhausted, it keeps returning true.
+func NewMergeIterator(its []record.Iterator) record.Iterator {
+	h := &iteratorHeap{}
+	for hID, it := range its {
+		rec, last := it()
+		if !last {
+			*h = append(*h, recordHandlePair{Rec: rec, Handle: hID})
+		}
+	}
+	heap.Init(h)
+
+	return func() (record.Record, bool) {
+		if h.Len() == 0 {
+			return record.NewEmpty(), true
+		}
+
+		// Get element with the highest priority, and discard older versions of the same key.
+		// Each element removed from the heap requires an insertion of the next element from the
+		// corresponding iterator.
+
+		head := heap.Pop(h).(recordHandlePair)
+		advance := []int{head.Handle}
+		for h.Len() > 0 && bytes.Equal((*h)[0].Rec.Key, head.Rec.Key) {
+			advance = append(advance, heap.Pop(h).(recordHandlePair).Handle)
+		}
+
+		for _, hID := range advance {
+			rec, last := its[hID]()
+			if !last {
+				heap.Push(h, recordHandlePair{Rec: rec, Handle: hID})
+			}
+		}
+
+		return head.Rec, false
+	}
+}
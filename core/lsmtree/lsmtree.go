@@ -1,17 +1,16 @@
 // Package lsmtree implements a Log-structured merge-tree (LSM tree) using
-// size-tiered compaction.
+// size-tiered or leveled compaction.
 package lsmtree
 
 import (
-	"bufio"
-	"bytes"
 	"fmt"
+	"io"
+	"nakevaleng/core/manifest"
 	"nakevaleng/core/record"
 	"nakevaleng/core/sstable"
-	"nakevaleng/ds/merkletree"
+	"nakevaleng/ds/bloomfilter"
 	"nakevaleng/util/filename"
-	"os"
-	"sort"
+	"sync"
 )
 
 // A recordHandlePair stores a record with minimal info regarding the file where the record is in.
@@ -23,25 +22,57 @@ type recordHandlePair struct {
 // needsCompaction checks if the given level in the LSM tree is ready for compaction. A compaction
 // should happen whenever the current amount of runs on a single level exceeds the maximum runs on
 // a level configured for the database.
-func needsCompaction(path, dbname string, level int, RUN_MAX int) bool {
-	return filename.GetLastRun(path, dbname, level) >= RUN_MAX-1
+func needsCompaction(m *manifest.Manifest, level int, RUN_MAX int) bool {
+	return len(m.Tables(level)) >= RUN_MAX
 }
 
 // Compact performs a compaction on a whole level in the LSM tree.
 // If the level is not ready or unable for compaction, nothing happens.
 // Levels which are unable for compaction are: 0, and any level beyond the maximum levels configured
 // for the database.
-// The result of a compaction is a new SSTable in the first available run on the next level.
-// Chaining is performed in case the next level requires a compaction after a new SSTable is created.
-// Only the Data table is created from the existing set, everything else is recreated.
-func Compact(path, dbname string, summaryPageSize int, level int, LVL_MAX, RUN_MAX int) error {
+// Which tables get merged, and where the result goes, is up to the strategy (see SizeTiered and
+// Leveled). The level is compacted for as long as the strategy finds work on it.
+// Chaining is performed in case the next level requires a compaction after new SSTables are created.
+// New tables are written in the v2 format, with their blocks compressed with codec, in the given
+// layout. The tables being merged may be in either format and either layout.
+// The tables are taken from the manifest, which is updated as tables are replaced.
+// Compact must not run alongside anything else that uses the manifest. To compact in the
+// background while the tables are in use, see Scheduler.
+func Compact(m *manifest.Manifest, summaryPageSize int, codec, layout string, level int, LVL_MAX, RUN_MAX int, strategy Strategy) error {
 	err := ValidateParams(summaryPageSize, level, LVL_MAX, RUN_MAX)
 	if err != nil {
 		return err
 	}
+	err = sstable.ValidateCodec(codec)
+	if err != nil {
+		return err
+	}
+	err = sstable.ValidateLayout(layout)
+	if err != nil {
+		return err
+	}
+	err = strategy.Validate()
+	if err != nil {
+		return err
+	}
 
-	compact(path, dbname, summaryPageSize, level, LVL_MAX, RUN_MAX)
-
+	c := compactor{m, summaryPageSize, codec, layout, LVL_MAX, RUN_MAX, strategy, &sync.Mutex{}, nil}
+	for ; level < LVL_MAX; level++ {
+		compacted := false
+		for {
+			done, err := c.compact(level)
+			if err != nil {
+				return err
+			}
+			if !done {
+				break
+			}
+			compacted = true
+		}
+		if !compacted {
+			return nil
+		}
+	}
 	return nil
 }
 
@@ -68,164 +99,321 @@ func ValidateParams(summaryPageSize int, level int, LVL_MAX, RUN_MAX int) error
 	return nil
 }
 
-func compact(path, dbname string, summaryPageSize int, level int, LVL_MAX, RUN_MAX int) {
-	if !needsCompaction(path, dbname, level, RUN_MAX) {
-		return
-	}
-	if level >= LVL_MAX {
-		return
+// compactor holds everything needed to compact the LSM tree whose tables are listed in m.
+type compactor struct {
+	m               *manifest.Manifest
+	summaryPageSize int
+	codec           string
+	layout          string
+	LVL_MAX         int
+	RUN_MAX         int
+	strategy        Strategy
+	install         sync.Locker         // Held while using m.
+	cache           *sstable.TableCache // Removed tables are evicted from it. May be nil.
+}
+
+// compact performs a compaction on the given level if the strategy finds one. Returns whether it did.
+// The new tables are merged into the staging directory without holding the install lock, reading
+// the old runs, which stay in place until the new tables are ready. Then, with the lock held, the
+// new tables are moved into the next free runs on the next level, and the old runs are swapped for
+// them in the manifest in a single edit, so anyone holding the lock sees either all of the old runs
+// or all of the new tables. The old runs' files are removed last. A crash at any point leaves the
+// manifest listing either the old runs or the new tables, with the rest removed on startup.
+// The old runs are evicted from the table cache before their files are removed, which closes the
+// cached handles (open handles would keep the removed files taking up space). The files of runs
+// pinned by manifest.Ref are left for whoever releases the last pin to remove.
+func (c compactor) compact(level int) (bool, error) {
+	if level >= c.LVL_MAX {
+		return false, nil
 	}
 	if level <= 0 {
-		return
+		return false, nil
 	}
 
-	fmt.Println("[DBG]\t[LSM] Compaction lvl", level)
+	// Tombstones are only needed to hide older versions of their keys. If no table older than the
+	// new ones can hold the key, the tombstone is dropped.
 
-	// Get all data tables for this level.
-
-	filenames := []string{}
-	for i := 0; i <= filename.GetLastRun(path, dbname, level); i++ {
-		filenames = append(filenames, filename.Table(path, dbname, level, i, filename.TypeData))
+	c.install.Lock()
+	j, ready := c.strategy.pick(c, level)
+	older := olderThan(c.m, level+1, j.lower)
+	seqs := globalSeqs(c.m, j)
+	c.install.Unlock()
+	if !ready {
+		return false, nil
 	}
 
-	// File handles.
+	path := c.m.Path()
+	dbname := c.m.DBName()
 
-	inFileHandles := []*os.File{}
-	for _, s := range filenames {
-		fhandle, err := os.Open(s)
+	fmt.Println("[DBG]\t[LSM] Compaction lvl", level, "runs", j.upper, "with lvl", level+1, "runs", j.lower)
 
-		if err != nil {
-			panic(err)
-		}
+	// Readers for all tables taking part, from the newest to the oldest, which is how merge breaks
+	// ties between records with the same sequence number (those written before sequence numbers
+	// were added all have 0).
 
-		inFileHandles = append(inFileHandles, fhandle)
+	readers := []*sstable.Reader{}
+	inputs := []*sstable.DataReader{}
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+	open := func(level int, runs []int) error {
+		for i := len(runs) - 1; i >= 0; i-- {
+			run := runs[i]
+			r, err := sstable.OpenReader(path, dbname, level, run)
+			if err != nil {
+				return err
+			}
+			r.SetGlobalSeq(seqs[manifest.TableID{Level: level, Run: run}])
+			readers = append(readers, r)
+			inputs = append(inputs, r.Iterate())
+		}
+		return nil
+	}
+	err := open(level, j.upper)
+	if err == nil {
+		err = open(level+1, j.lower)
+	}
+	if err != nil {
+		return false, err
 	}
 
-	// Create new SSTable.
+	// Create new SSTables in the staging directory.
 
+	staging := filename.Staging(path)
 	outLevel := level + 1
-	outRun := filename.GetLastRun(path, dbname, outLevel) + 1
-	outDataFname := filename.Table(path, dbname, outLevel, outRun, filename.TypeData)
-	merkletreeLeaves, keyCtx := merge(inFileHandles, outDataFname)
-	sstable.MakeTableSecondaries(path, dbname, summaryPageSize, outLevel, outRun, merkletreeLeaves, keyCtx)
-
-	// Close everything and remove tables from the old level.
+	olderFilters, err := readFilters(path, dbname, older)
+	if err != nil {
+		return false, err
+	}
 
-	for _, f := range inFileHandles {
-		f.Close()
+	tb := tableBuilder{path: staging, dbname: dbname, summaryPageSize: c.summaryPageSize, codec: c.codec, layout: c.layout, level: outLevel, maxSize: j.tableSize}
+	dropped := 0
+	err = merge(inputs, func(rec record.Record) error {
+		if rec.IsDeleted() && !mayContain(older, olderFilters, rec.Key) {
+			dropped++
+			return nil
+		}
+		return tb.add(rec)
+	})
+	if err == nil {
+		err = tb.finish()
+	}
+	if err != nil {
+		tb.abort()
+		return false, err
 	}
-	for i := 0; i <= filename.GetLastRun(path, dbname, level); i++ {
-		os.Remove(filename.Table(path, dbname, level, i, filename.TypeData))
-		os.Remove(filename.Table(path, dbname, level, i, filename.TypeFilter))
-		os.Remove(filename.Table(path, dbname, level, i, filename.TypeIndex))
-		os.Remove(filename.Table(path, dbname, level, i, filename.TypeSummary))
-		os.Remove(filename.Table(path, dbname, level, i, filename.TypeMetadata))
+	if dropped > 0 {
+		fmt.Println("[DBG]\t[LSM] Dropped", dropped, "tombstones")
 	}
 
-	// Chaining (won't do anything if next level doesn't need compaction yet).
+	// Swap the old runs for the new tables.
 
-	compact(path, dbname, summaryPageSize, level+1, LVL_MAX, RUN_MAX)
-}
+	c.install.Lock()
+	defer c.install.Unlock()
 
-// merge performs a k-way merge for the tables on a given level.
-// the Data table is written on disk immediately.
-// All secondary files are left to the caller to create, using what's returned by this function.
-// infile keeps a pointer to file handles for each Data table on a given level, opened for reading.
-// outDataFname is the filename of the resulting Data table that gets created.
-// Function returns a list of leaves for the corresponding Merkle tree and a list of KeyContext-s
-// from which everything else (bloom filter, index table, summary table) can be built.
-func merge(infile []*os.File, outDataFname string) ([]merkletree.MerkleNode, []record.KeyContext) {
-	f, err := os.Create(outDataFname)
-	if err != nil {
-		panic(err)
+	edit := manifest.Edit{}
+	outRun := c.m.NextRun(outLevel)
+	for i := 0; i < tb.tables; i++ {
+		err = sstable.MoveTable(staging, path, dbname, outLevel, i, outLevel, outRun+i)
+		if err != nil {
+			return false, err
+		}
+		t, err := manifest.ReadTable(path, dbname, outLevel, outRun+i)
+		if err != nil {
+			return false, err
+		}
+		edit.Added = append(edit.Added, t)
+	}
+	for _, run := range j.upper {
+		edit.Removed = append(edit.Removed, manifest.TableID{Level: level, Run: run})
+	}
+	for _, run := range j.lower {
+		edit.Removed = append(edit.Removed, manifest.TableID{Level: outLevel, Run: run})
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	defer w.Flush()
-
-	mtleaves := []merkletree.MerkleNode{}
-	keyctx := []record.KeyContext{}
-
-	// Each input file gets a reader. Also, implicitly, each reader is assigned a number.
 
-	readers := []*bufio.Reader{}
-	for _, f := range infile {
-		rd := bufio.NewReader(f)
-		readers = append(readers, rd)
+	err = c.m.Apply(edit)
+	if err != nil {
+		return false, err
+	}
+	for _, id := range edit.Removed {
+		if c.cache != nil {
+			c.cache.Evict(id.Level, id.Run)
+		}
+	}
+	for _, id := range c.m.Unpinned(edit.Removed) {
+		err = sstable.RemoveTable(path, dbname, id.Level, id.Run)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	// Priority queue (implemented as a slice with sorting). TODO: Use a heap.
+	return true, nil
+}
 
-	pq := []recordHandlePair{}
+// olderThan returns the tables that hold older records than the output of a compaction into the
+// given level: the tables on that level which don't take part in the compaction (lower), and all
+// tables on the levels after it. The caller must hold the install lock.
+func olderThan(m *manifest.Manifest, level int, lower []int) []manifest.Table {
+	merged := map[int]bool{}
+	for _, run := range lower {
+		merged[run] = true
+	}
 
-	for hID, rd := range readers {
-		rec := record.Record{}
-		eof := rec.Deserialize(rd)
-		if !eof {
-			pq = append(pq, recordHandlePair{Rec: rec, Handle: hID})
+	tables := []manifest.Table{}
+	for l := level; l <= m.LastLevel(); l++ {
+		for _, t := range m.Tables(l) {
+			if l != level || !merged[t.Run] {
+				tables = append(tables, t)
+			}
 		}
 	}
+	return tables
+}
 
-	// Merge until the priority queue is exhausted.
-
-	for len(pq) > 0 {
-		// Sort the priority queue by key. If keys are the same, order by timestamp.
-
-		sort.Slice(pq, func(i, j int) bool {
-			keyCmp := bytes.Compare(pq[i].Rec.Key, pq[j].Rec.Key)
-			biggerTimeStamp := pq[i].Rec.Timestamp > pq[j].Rec.Timestamp
-			return keyCmp < 0 || (keyCmp == 0 && biggerTimeStamp)
-		})
+// globalSeqs returns the global sequence numbers of the ingested tables taking part in the
+// compaction. The caller must hold the install lock.
+func globalSeqs(m *manifest.Manifest, j job) map[manifest.TableID]uint64 {
+	seqs := map[manifest.TableID]uint64{}
+	add := func(level int, runs []int) {
+		taking := map[int]bool{}
+		for _, run := range runs {
+			taking[run] = true
+		}
+		for _, t := range m.Tables(level) {
+			if taking[t.Run] && t.GlobalSeq != 0 {
+				seqs[manifest.TableID{Level: level, Run: t.Run}] = t.GlobalSeq
+			}
+		}
+	}
+	add(j.level, j.upper)
+	add(j.level+1, j.lower)
+	return seqs
+}
 
-		// Keep track of which files have had an entry in the priority queue taken away from.
-		// Normally it would be just the one whose element has the highest priority, but we also do
-		// conflict resolution. Each element removed from the pq requires an insertion of the next
-		// element from the corresponding file.
+// readFilters reads the Bloom filters of the given tables. Only compactions remove tables past
+// level 1, so this can be done without holding the install lock.
+func readFilters(path, dbname string, tables []manifest.Table) ([]*bloomfilter.BloomFilter, error) {
+	filters := []*bloomfilter.BloomFilter{}
+	for _, t := range tables {
+		bf, err := sstable.ReadFilter(path, dbname, t.Level, t.Run)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, bf)
+	}
+	return filters, nil
+}
 
-		rmvd := []bool{}
-		for range readers {
-			rmvd = append(rmvd, false)
+// mayContain returns false if none of the tables holds the key. Like a Bloom filter, it may return
+// true even if none does.
+func mayContain(tables []manifest.Table, filters []*bloomfilter.BloomFilter, key []byte) bool {
+	for i, t := range tables {
+		if t.Contains(key) && filters[i].Query(key) {
+			return true
 		}
+	}
+	return false
+}
 
-		// Get element with the highest priority.
+// tableBuilder writes records into new SSTables, starting a new one each time the current one's
+// Data table reaches maxSize bytes (or never, if maxSize is 0). Tables are written into runs 0,
+// 1, 2... on the given level.
+type tableBuilder struct {
+	path            string
+	dbname          string
+	summaryPageSize int
+	codec           string
+	layout          string
+	level           int
+	maxSize         uint64
+	tables          int // Number of finished tables.
+
+	w *sstable.Writer
+}
 
-		head := pq[0]
-		pq = pq[0:]
-		rmvd[head.Handle] = true
+// add writes the record into the current table, starting a new one if needed.
+func (tb *tableBuilder) add(rec record.Record) error {
+	if tb.w == nil {
+		w, err := sstable.NewWriter(tb.path, tb.dbname, tb.summaryPageSize, tb.level, tb.tables, tb.codec, tb.layout)
+		if err != nil {
+			return err
+		}
+		tb.w = w
+	}
 
-		// Conflict resolution - remove elements with same key and smaller timestamp.
+	err := tb.w.Add(rec)
+	if err != nil {
+		return err
+	}
 
-		pqTemp := []recordHandlePair{}
-		for _, elem := range pq {
-			if bytes.Compare(elem.Rec.Key, head.Rec.Key) != 0 {
-				pqTemp = append(pqTemp, elem)
-			} else {
-				rmvd[elem.Handle] = true
-			}
-		}
-		pq = pqTemp
+	if tb.maxSize > 0 && tb.w.Size() >= tb.maxSize {
+		return tb.finish()
+	}
+	return nil
+}
 
-		// Write element to new SSTable.
+// finish completes the current table (if there is one).
+func (tb *tableBuilder) finish() error {
+	if tb.w == nil {
+		return nil
+	}
 
-		head.Rec.Serialize(w)
-		mtleaves = append(mtleaves, merkletree.NewLeaf(head.Rec.Value))
-		keyctx = append(keyctx, record.KeyContext{
-			Key:     head.Rec.Key,
-			RecSize: head.Rec.TotalSize(),
-		})
+	err := tb.w.Finish()
+	tb.w = nil
+	if err != nil {
+		return err
+	}
+	tb.tables++
+	return nil
+}
 
-		// Fetch next element for all files that require it (if the reader isn't at EOF).
+// abort closes the current table (if there is one) without finishing it. Its files are left in
+// the staging directory, which is cleaned up on startup.
+func (tb *tableBuilder) abort() {
+	if tb.w != nil {
+		tb.w.Abort()
+		tb.w = nil
+	}
+}
 
-		for hID, rd := range readers {
-			if rmvd[hID] {
-				rec := record.Record{}
-				eof := rec.Deserialize(rd)
-				if !eof {
-					pq = append(pq, recordHandlePair{Rec: rec, Handle: hID})
+// merge performs a k-way merge for the given tables, which may come from any number of levels.
+// readers holds a reader for each Data table. Records are passed to emit in order of their keys,
+// and only the newest version of each key is passed. Readers should be ordered from the newest
+// table to the oldest one, which is used to break ties between records with the same sequence
+// number. Writing them anywhere is left to emit, which is how the strategies share this function.
+func merge(readers []*sstable.DataReader, emit func(rec record.Record) error) error {
+	var readErr error
+
+	// A reader that fails stops returning records, so the merge is stopped as soon as that
+	// happens, before it can pass on an outdated version of a key.
+
+	its := make([]record.Iterator, len(readers))
+	for i, rd := range readers {
+		rd := rd
+		its[i] = func() (record.Record, bool) {
+			rec, err := rd.Next()
+			if err != nil {
+				if err != io.EOF && readErr == nil {
+					readErr = err
 				}
+				return record.NewEmpty(), true
 			}
+			return rec, false
+		}
+	}
+
+	merged := NewMergeIterator(its)
+	for rec, last := merged(); !last; rec, last = merged() {
+		if readErr != nil {
+			return readErr
+		}
+		err := emit(rec)
+		if err != nil {
+			return err
 		}
 	}
 
-	return mtleaves, keyctx
+	return readErr
 }
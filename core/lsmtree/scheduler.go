@@ -0,0 +1,177 @@
+package lsmtree
+
+import (
+	"fmt"
+	"nakevaleng/core/manifest"
+	"nakevaleng/core/sstable"
+	"sync"
+)
+
+// Scheduler compacts the LSM tree in the background, in its own goroutine. Whenever it's notified
+// that a table was added, it goes through all levels from the top and compacts each one for as
+// long as the strategy finds work on it, until there's nothing left to do.
+// Tables are merged without holding the install lock, so readers holding it can keep using the old
+// runs for the whole duration of the merge. See compactor.compact for how the new table is
+// installed.
+// If a compaction fails, the scheduler stops and the error is returned by WaitIdle and Close.
+type Scheduler struct {
+	c       compactor
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending bool  // A table was added since the last pass over the levels.
+	running bool  // A pass over the levels is in progress.
+	paused  bool  // No new compactions may start.
+	closed  bool  // The scheduler is stopping.
+	err     error // The error that stopped the scheduler, if any.
+	done    chan struct{}
+}
+
+// NewScheduler starts a compaction scheduler for the tables listed in the manifest. Anyone who uses
+// the manifest, or reads the tables it lists, while the scheduler is running must hold install
+// while doing so.
+// Tables removed by a compaction are evicted from cache, if it's not nil.
+// The scheduler does a pass over all levels right away, in case a compaction was left undone.
+func NewScheduler(m *manifest.Manifest, summaryPageSize int, codec, layout string, LVL_MAX, RUN_MAX int, strategy Strategy, install sync.Locker, cache *sstable.TableCache) (*Scheduler, error) {
+	err := ValidateParams(summaryPageSize, 1, LVL_MAX, RUN_MAX)
+	if err != nil {
+		return nil, err
+	}
+	err = sstable.ValidateCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	err = sstable.ValidateLayout(layout)
+	if err != nil {
+		return nil, err
+	}
+	err = strategy.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Scheduler{
+		c:       compactor{m, summaryPageSize, codec, layout, LVL_MAX, RUN_MAX, strategy, install, cache},
+		pending: true,
+		done:    make(chan struct{}),
+	}
+	s.cond = sync.NewCond(&s.mu)
+
+	go s.loop()
+	return s, nil
+}
+
+// Notify tells the scheduler that a table was added, so some levels may need a compaction. It
+// never blocks, so it's safe to call while holding the install lock.
+func (s *Scheduler) Notify() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.pending = true
+	s.cond.Broadcast()
+}
+
+// Pause stops the scheduler from starting new compactions, and waits for the one in progress (if
+// any) to be installed. Notifications received while paused are handled after Resume.
+// Must not be called while holding the install lock.
+func (s *Scheduler) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = true
+	for s.running {
+		s.cond.Wait()
+	}
+}
+
+// Resume lets the scheduler start compactions again after Pause.
+func (s *Scheduler) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.paused = false
+	s.cond.Broadcast()
+}
+
+// WaitIdle blocks until the scheduler has nothing left to do, and returns the error that stopped it,
+// if any. If the scheduler is paused, it only waits for the compaction in progress.
+// Must not be called while holding the install lock.
+func (s *Scheduler) WaitIdle() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for s.running || (s.pending && !s.paused && !s.closed && s.err == nil) {
+		s.cond.Wait()
+	}
+	return s.err
+}
+
+// Close stops the scheduler once the compaction in progress (if any) is installed. Compactions
+// that haven't started yet are left for the next scheduler. Returns the error that stopped the
+// scheduler, if any. Must not be called while holding the install lock.
+func (s *Scheduler) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+
+	<-s.done
+	return s.err
+}
+
+// loop is the scheduler's goroutine.
+func (s *Scheduler) loop() {
+	defer close(s.done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		for !s.closed && (!s.pending || s.paused) {
+			s.cond.Wait()
+		}
+		if s.closed {
+			return
+		}
+
+		s.pending = false
+		s.running = true
+		s.mu.Unlock()
+		err := s.pass()
+		s.mu.Lock()
+		s.running = false
+		s.cond.Broadcast()
+
+		if err != nil {
+			fmt.Println("[DBG]\t[LSM] Background compaction failed:", err)
+			s.err = err
+			return
+		}
+	}
+}
+
+// pass compacts every level that needs it, from the top down, stopping early if the scheduler is
+// paused or closed between two compactions.
+func (s *Scheduler) pass() error {
+	for level := 1; level < s.c.LVL_MAX; level++ {
+		for {
+			s.mu.Lock()
+			stop := s.paused || s.closed
+			if stop {
+				s.pending = true
+			}
+			s.mu.Unlock()
+			if stop {
+				return nil
+			}
+
+			done, err := s.c.compact(level)
+			if err != nil {
+				return err
+			}
+			if !done {
+				break
+			}
+		}
+	}
+	return nil
+}
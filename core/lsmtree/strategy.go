@@ -0,0 +1,139 @@
+package lsmtree
+
+import (
+	"fmt"
+	"nakevaleng/core/manifest"
+)
+
+// Strategy decides which tables take part in a compaction, and how the result is laid out on the
+// next level. Implemented by SizeTiered and Leveled.
+type Strategy interface {
+	// Validate returns an error if the strategy's parameters are not valid.
+	Validate() error
+
+	// pick returns the compaction to perform on the given level, and false if the level doesn't
+	// need one. The caller must hold the install lock.
+	pick(c compactor, level int) (job, bool)
+}
+
+// A job describes a single compaction: the runs merged together, and how big the new tables may get.
+type job struct {
+	level     int    // Level the compaction is performed on.
+	upper     []int  // Runs taken from level.
+	lower     []int  // Runs taken from level+1.
+	tableSize uint64 // New tables are cut once their Data table reaches this size. 0 means never.
+}
+
+// SizeTiered merges all runs of a level into a single new run on the next level, once the number
+// of runs on the level reaches RUN_MAX. Runs on all levels may overlap.
+type SizeTiered struct{}
+
+// Validate always returns nil, since SizeTiered has no parameters.
+func (SizeTiered) Validate() error {
+	return nil
+}
+
+func (SizeTiered) pick(c compactor, level int) (job, bool) {
+	if !needsCompaction(c.m, level, c.RUN_MAX) {
+		return job{}, false
+	}
+
+	upper := []int{}
+	for _, t := range c.m.Tables(level) {
+		upper = append(upper, t.Run)
+	}
+	return job{level: level, upper: upper}, true
+}
+
+// Leveled keeps the tables on every level but the first one sorted into non-overlapping key ranges,
+// so a read looks at no more than one table per level (after level 1).
+// Level 1 receives flushed tables, which may overlap, and is compacted once the number of runs on
+// it reaches RUN_MAX. Level 2 may hold LevelSize bytes of Data tables, and each level after that
+// Multiplier times as many as the one before. The last level has no limit.
+// A compaction takes a single table from the level (the oldest one on level 1, elsewhere the one
+// that overlaps the fewest bytes on the next level, relative to its own size, with tombstones
+// counting double), merges it with all tables on the next level whose key ranges overlap it and
+// writes the result to the next level as new tables of about TableSize bytes each.
+type Leveled struct {
+	LevelSize  uint64 // Target size of level 2, in bytes.
+	Multiplier int    // How many times bigger each level's target is than the previous one's.
+	TableSize  uint64 // Size at which new tables are cut, in bytes.
+}
+
+// Validate returns an error if any of the parameters is not a positive number.
+func (l Leveled) Validate() error {
+	if l.LevelSize == 0 {
+		return fmt.Errorf("level size must be a positive number, but %d was given", l.LevelSize)
+	}
+	if l.Multiplier <= 0 {
+		return fmt.Errorf("multiplier must be a positive number, but %d was given", l.Multiplier)
+	}
+	if l.TableSize == 0 {
+		return fmt.Errorf("table size must be a positive number, but %d was given", l.TableSize)
+	}
+	return nil
+}
+
+// targetSize returns the number of bytes the Data tables on a level may hold. Level must be >= 2.
+func (l Leveled) targetSize(level int) uint64 {
+	size := l.LevelSize
+	for i := 2; i < level; i++ {
+		size *= uint64(l.Multiplier)
+	}
+	return size
+}
+
+func (l Leveled) pick(c compactor, level int) (job, bool) {
+	upper := c.m.Tables(level)
+	lower := c.m.Tables(level + 1)
+
+	var picked manifest.Table
+	if level == 1 {
+		if !needsCompaction(c.m, level, c.RUN_MAX) {
+			return job{}, false
+		}
+		picked = upper[0]
+	} else {
+		total := uint64(0)
+		for _, t := range upper {
+			total += t.Size
+		}
+		if total <= l.targetSize(level) {
+			return job{}, false
+		}
+
+		bestRatio := 0.0
+		for i, t := range upper {
+			overlapping := uint64(0)
+			for _, u := range lower {
+				if t.Overlaps(u) {
+					overlapping += u.Size
+				}
+			}
+			ratio := float64(overlapping) / (compensatedSize(t) + 1)
+			if i == 0 || ratio < bestRatio {
+				picked = t
+				bestRatio = ratio
+			}
+		}
+	}
+
+	j := job{level: level, upper: []int{picked.Run}, tableSize: l.TableSize}
+	for _, u := range lower {
+		if picked.Overlaps(u) {
+			j.lower = append(j.lower, u.Run)
+		}
+	}
+	return j, true
+}
+
+// compensatedSize returns the size of the table's Data table, with the share taken by tombstones
+// counted twice. Compacting a tombstone frees up both its own space and that of the records it
+// hides further down, so tables with many of them are worth compacting sooner.
+func compensatedSize(t manifest.Table) float64 {
+	size := float64(t.Size)
+	if t.Entries == 0 {
+		return size
+	}
+	return size + size*float64(t.Tombstones)/float64(t.Entries)
+}
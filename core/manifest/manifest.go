@@ -0,0 +1,647 @@
+// Package manifest implements an append-only log of changes to the set of SSTables that make up
+// the LSM tree. It's the single source of truth for which tables are live.
+package manifest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"nakevaleng/core/record"
+	"nakevaleng/core/sstable"
+	"nakevaleng/util/filename"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Format of the MANIFEST file.
+const (
+	MAGIC   = "NKVMANIF" // First bytes of every MANIFEST file.
+	VERSION = 3          // Version of the format written by this package (see encodeEdit).
+
+	headerSize     = len(MAGIC) + 4 // Magic, version.
+	editHeaderSize = 4 + 4          // CRC of the payload, length of the payload.
+	maxEdits       = 1000           // Once the log holds this many edits, it's rewritten as one.
+)
+
+// Table describes a live SSTable.
+type Table struct {
+	Level  int
+	Run    int
+	MinKey []byte // First key in the table.
+	MaxKey []byte // Last key in the table.
+	Size   uint64 // Size of the Data table, in bytes.
+	MaxSeq uint64 // Greatest sequence number of all records in the table.
+
+	// Number of records in the table, and how many of them are tombstones. Both are 0 for tables
+	// listed before they were kept.
+	Entries    uint64
+	Tombstones uint64
+
+	// If not 0, the sequence number of all records in the table, whatever they were written with.
+	// Set for tables that were ingested as they are, see sstable.Reader.SetGlobalSeq.
+	GlobalSeq uint64
+}
+
+// Contains returns true if the key falls within the table's key range. The table may still not hold it.
+func (t Table) Contains(key []byte) bool {
+	return bytes.Compare(key, t.MinKey) >= 0 && bytes.Compare(key, t.MaxKey) <= 0
+}
+
+// Overlaps returns true if the key ranges of the two tables have at least one key in common.
+func (t Table) Overlaps(u Table) bool {
+	return bytes.Compare(t.MinKey, u.MaxKey) <= 0 && bytes.Compare(u.MinKey, t.MaxKey) <= 0
+}
+
+// Intersects returns true if the table's key range has at least one key in common with the range
+// [start, end). An empty end means there is no upper bound.
+func (t Table) Intersects(start, end []byte) bool {
+	return bytes.Compare(t.MaxKey, start) >= 0 && (len(end) == 0 || bytes.Compare(t.MinKey, end) < 0)
+}
+
+// TableID identifies a table within the LSM tree.
+type TableID struct {
+	Level int
+	Run   int
+}
+
+// Edit is a change to the set of live tables. All of it is applied, or none of it.
+type Edit struct {
+	Added   []Table
+	Removed []TableID
+}
+
+// Manifest keeps the set of live tables, both in memory and on disk.
+// It's not safe for concurrent use: changes must be serialized with everything else that reads it.
+type Manifest struct {
+	path    string // Directory holding the tables and the MANIFEST.
+	dbname  string
+	f       *os.File    // MANIFEST, opened for appending.
+	levels  [][]Table   // Live tables on each level (index 0 is level 1), sorted by run.
+	nextRun map[int]int // First run on each level that was never used.
+	edits   int         // Number of edits in the MANIFEST.
+
+	pins    map[TableID]int  // Number of Refs held on each table.
+	retired map[TableID]bool // Pinned tables that are no longer live, whose files are kept for now.
+}
+
+// Open loads the MANIFEST of the database at path. If there is none, it's created from the tables
+// found in the directory, which is how databases created before the MANIFEST are taken over.
+// An edit torn by a crash at the end of the file is dropped. Other damage returns an error that
+// wraps record.ErrCorruption.
+func Open(path, dbname string) (*Manifest, error) {
+	m := &Manifest{
+		path:    path,
+		dbname:  dbname,
+		levels:  [][]Table{},
+		nextRun: map[int]int{},
+		pins:    map[TableID]int{},
+		retired: map[TableID]bool{},
+	}
+
+	err := os.MkdirAll(filename.Staging(path), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	fname := filename.Manifest(path, dbname)
+	_, err = os.Stat(fname)
+	if errors.Is(err, os.ErrNotExist) {
+		err = m.bootstrap()
+		if err != nil {
+			return nil, err
+		}
+		return m, m.rewrite()
+	} else if err != nil {
+		return nil, err
+	}
+
+	version, err := m.load(fname)
+	if err != nil {
+		return nil, err
+	}
+	if version < VERSION {
+		fmt.Println("[DBG]\t[Manifest] Upgrading from version", version, "to", VERSION)
+		return m, m.rewrite() // New edits can't be appended in an old format.
+	}
+	m.f, err = os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ReadTable describes the table at the given path, level and run, as found in its files. A global
+// sequence number isn't kept in the files, so it's left at 0.
+// The Properties of a table written before they were kept in it are found by reading it whole.
+func ReadTable(path, dbname string, level, run int) (Table, error) {
+	size, err := sstable.DataSize(path, dbname, level, run)
+	if err != nil {
+		return Table{}, err
+	}
+	props, err := sstable.ReadProperties(path, dbname, level, run)
+	if err != nil {
+		return Table{}, err
+	}
+
+	return Table{
+		Level:      level,
+		Run:        run,
+		MinKey:     props.MinKey,
+		MaxKey:     props.MaxKey,
+		Size:       uint64(size),
+		MaxSeq:     props.MaxSeq,
+		Entries:    props.Count,
+		Tombstones: props.Tombstones,
+	}, nil
+}
+
+// Path returns the directory holding the tables.
+func (m *Manifest) Path() string {
+	return m.path
+}
+
+// DBName returns the name of the database the tables belong to.
+func (m *Manifest) DBName() string {
+	return m.dbname
+}
+
+// LastLevel returns the greatest level holding any tables, or 0 if there are none.
+func (m *Manifest) LastLevel() int {
+	return len(m.levels)
+}
+
+// Tables returns a copy of the live tables on the given level, from the oldest run to the newest.
+func (m *Manifest) Tables(level int) []Table {
+	if level <= 0 || level > len(m.levels) {
+		return []Table{}
+	}
+	return append([]Table{}, m.levels[level-1]...)
+}
+
+// Snapshot returns a copy of all live tables, from the first level to the last.
+func (m *Manifest) Snapshot() []Table {
+	tables := []Table{}
+	for _, level := range m.levels {
+		tables = append(tables, level...)
+	}
+	return tables
+}
+
+// Ref pins the files of the given tables, so that they stay in place even if the tables are removed
+// from the manifest in the meantime, until the matching Unref. Used to read tables without
+// holding the lock that guards the manifest.
+func (m *Manifest) Ref(ids []TableID) {
+	for _, id := range ids {
+		m.pins[id]++
+	}
+}
+
+// Unref releases the pins taken on the given tables by Ref. Returns the tables that were removed
+// from the manifest while pinned and are no longer pinned, whose files the caller should remove.
+func (m *Manifest) Unref(ids []TableID) []TableID {
+	unpinned := []TableID{}
+	for _, id := range ids {
+		m.pins[id]--
+		if m.pins[id] > 0 {
+			continue
+		}
+		delete(m.pins, id)
+		if m.retired[id] {
+			delete(m.retired, id)
+			unpinned = append(unpinned, id)
+		}
+	}
+	return unpinned
+}
+
+// Unpinned returns those of the given tables, just removed from the manifest, whose files can be
+// removed right away. The files of pinned tables are left for whoever releases the last pin, see
+// Unref.
+func (m *Manifest) Unpinned(ids []TableID) []TableID {
+	unpinned := []TableID{}
+	for _, id := range ids {
+		if m.pins[id] > 0 {
+			m.retired[id] = true
+		} else {
+			unpinned = append(unpinned, id)
+		}
+	}
+	return unpinned
+}
+
+// NextRun returns the run a new table on the given level should be written to. It's greater than
+// all runs ever used on the level, so it's also newer than all of them.
+func (m *Manifest) NextRun(level int) int {
+	return m.nextRun[level]
+}
+
+// RemoveOrphans removes all table files of the database that don't belong to a live table. Those are
+// left behind by a crash between moving a new table into place and adding it to the manifest, or
+// between removing a table from the manifest and removing its files. In both cases the records
+// are still elsewhere: in the WAL, or in the tables that replaced them. Returns the number of
+// files removed.
+func (m *Manifest) RemoveOrphans() (int, error) {
+	live := map[TableID]bool{}
+	for _, tables := range m.levels {
+		for _, t := range tables {
+			live[TableID{t.Level, t.Run}] = true
+		}
+	}
+
+	paths, err := filename.GetTablePaths(m.path, m.dbname)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, path := range paths {
+		_, level, run, _ := filename.Query(filepath.Base(path))
+		if live[TableID{level, run}] {
+			continue
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			return removed, err
+		}
+		removed++
+	}
+
+	if removed > 0 {
+		return removed, filename.SyncDir(m.path)
+	}
+	return 0, nil
+}
+
+// Apply writes the edit to the MANIFEST, syncs it and applies it to the set of live tables.
+// The added tables' files should already be in place, and the removed tables' files should be
+// removed only after Apply returns, so that the MANIFEST never lists a table that isn't there.
+func (m *Manifest) Apply(edit Edit) error {
+	err := m.check(edit)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.f.Write(encodeEdit(edit))
+	if err != nil {
+		return err
+	}
+	err = m.f.Sync()
+	if err != nil {
+		return err
+	}
+
+	m.apply(edit)
+	m.edits++
+	if m.edits >= maxEdits {
+		return m.rewrite()
+	}
+	return nil
+}
+
+// Close closes the MANIFEST. Closing it again does nothing.
+func (m *Manifest) Close() error {
+	if m.f == nil {
+		return nil
+	}
+	err := m.f.Close()
+	m.f = nil
+	return err
+}
+
+// check returns an error if the edit removes a table that isn't live, or adds one that is.
+func (m *Manifest) check(edit Edit) error {
+	live := map[TableID]bool{}
+	for _, tables := range m.levels {
+		for _, t := range tables {
+			live[TableID{t.Level, t.Run}] = true
+		}
+	}
+
+	for _, id := range edit.Removed {
+		if !live[id] {
+			return fmt.Errorf("manifest: can't remove table %d-%d, it isn't live", id.Level, id.Run)
+		}
+		delete(live, id)
+	}
+	for _, t := range edit.Added {
+		if t.Level <= 0 || t.Run < 0 {
+			return fmt.Errorf("manifest: can't add table %d-%d, level must be >= 1 and run >= 0", t.Level, t.Run)
+		}
+		if live[TableID{t.Level, t.Run}] {
+			return fmt.Errorf("manifest: can't add table %d-%d, it's already live", t.Level, t.Run)
+		}
+		live[TableID{t.Level, t.Run}] = true
+	}
+	return nil
+}
+
+// apply applies the edit to the set of live tables in memory.
+func (m *Manifest) apply(edit Edit) {
+	removed := map[TableID]bool{}
+	for _, id := range edit.Removed {
+		removed[id] = true
+	}
+	for i, tables := range m.levels {
+		kept := []Table{}
+		for _, t := range tables {
+			if !removed[TableID{t.Level, t.Run}] {
+				kept = append(kept, t)
+			}
+		}
+		m.levels[i] = kept
+	}
+
+	for _, t := range edit.Added {
+		for len(m.levels) < t.Level {
+			m.levels = append(m.levels, []Table{})
+		}
+		m.levels[t.Level-1] = append(m.levels[t.Level-1], t)
+		if t.Run >= m.nextRun[t.Level] {
+			m.nextRun[t.Level] = t.Run + 1
+		}
+	}
+
+	for i := range m.levels {
+		tables := m.levels[i]
+		sort.Slice(tables, func(a, b int) bool { return tables[a].Run < tables[b].Run })
+	}
+	for len(m.levels) > 0 && len(m.levels[len(m.levels)-1]) == 0 {
+		m.levels = m.levels[:len(m.levels)-1]
+	}
+}
+
+// bootstrap fills the set of live tables from the tables found in the directory. Runs may have gaps
+// between them, as left behind by a lost MANIFEST.
+func (m *Manifest) bootstrap() error {
+	lastLevel, err := filename.GetLastLevel(m.path, m.dbname)
+	if err != nil {
+		return err
+	}
+
+	edit := Edit{}
+	for level := 1; level <= lastLevel; level++ {
+		lastRun, err := filename.GetLastRun(m.path, m.dbname, level)
+		if err != nil {
+			return err
+		}
+		for run := 0; run <= lastRun; run++ {
+			t, err := ReadTable(m.path, m.dbname, level, run)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			edit.Added = append(edit.Added, t)
+		}
+	}
+
+	if len(edit.Added) > 0 {
+		fmt.Println("[DBG]\t[Manifest] Found", len(edit.Added), "tables without a manifest")
+	}
+	m.apply(edit)
+	return nil
+}
+
+// rewrite replaces the MANIFEST with one holding a single edit, which adds all live tables. The
+// new MANIFEST is written in the staging directory and renamed over the old one once it's synced.
+func (m *Manifest) rewrite() error {
+	tmpFname := filename.Manifest(filename.Staging(m.path), m.dbname)
+	err := writeManifest(tmpFname, m.Snapshot())
+	if err != nil {
+		return err
+	}
+
+	fname := filename.Manifest(m.path, m.dbname)
+	err = os.Rename(tmpFname, fname)
+	if err != nil {
+		return err
+	}
+	err = filename.SyncDir(m.path)
+	if err != nil {
+		return err
+	}
+
+	if m.f != nil {
+		m.f.Close()
+	}
+	m.f, err = os.OpenFile(fname, os.O_WRONLY|os.O_APPEND, 0644)
+	m.edits = 1
+	return err
+}
+
+// WriteSnapshot writes a MANIFEST listing the given tables, as taken by Snapshot, for the database
+// at path. Used for backups, whose tables are copied after the live ones have moved on.
+func WriteSnapshot(path, dbname string, tables []Table) error {
+	err := writeManifest(filename.Manifest(path, dbname), tables)
+	if err != nil {
+		return err
+	}
+	return filename.SyncDir(path)
+}
+
+// writeManifest writes a MANIFEST holding a single edit, which adds the given tables, and syncs it.
+func writeManifest(fname string, tables []Table) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(encodeHeader())
+	if err == nil {
+		_, err = f.Write(encodeEdit(Edit{Added: tables}))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// load reads the MANIFEST and applies all of its edits. A torn edit at the end is cut off.
+// Returns the version of the MANIFEST's format.
+func (m *Manifest) load(fname string) (uint32, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return 0, err
+	}
+
+	if len(data) < headerSize || string(data[:len(MAGIC)]) != MAGIC {
+		return 0, fmt.Errorf("%w: %s is not a manifest", record.ErrCorruption, fname)
+	}
+	version := binary.LittleEndian.Uint32(data[len(MAGIC):headerSize])
+	if version > VERSION {
+		return 0, fmt.Errorf("manifest: %s has version %d, only versions up to %d are supported", fname, version, VERSION)
+	}
+
+	offset := headerSize
+	for offset < len(data) {
+		if len(data)-offset < editHeaderSize {
+			break
+		}
+		crc := binary.LittleEndian.Uint32(data[offset:])
+		length := int(binary.LittleEndian.Uint32(data[offset+4:]))
+		end := offset + editHeaderSize + length
+		if end > len(data) {
+			break
+		}
+
+		payload := data[offset+editHeaderSize : end]
+		if crc32.ChecksumIEEE(payload) != crc {
+			if end == len(data) {
+				break // The last edit was only partly written.
+			}
+			return 0, fmt.Errorf("%w: bad checksum in %s at offset %d", record.ErrCorruption, fname, offset)
+		}
+
+		edit, err := decodeEdit(payload, version)
+		if err == nil {
+			err = m.check(edit)
+		}
+		if err != nil {
+			return 0, fmt.Errorf("%w: bad edit in %s at offset %d: %s", record.ErrCorruption, fname, offset, err)
+		}
+		m.apply(edit)
+		m.edits++
+		offset = end
+	}
+
+	if offset < len(data) {
+		fmt.Println("[DBG]\t[Manifest] Dropping", len(data)-offset, "bytes of a torn edit")
+		return version, os.Truncate(fname, int64(offset))
+	}
+	return version, nil
+}
+
+// encodeHeader returns the header of a MANIFEST file.
+func encodeHeader() []byte {
+	header := make([]byte, headerSize)
+	copy(header, MAGIC)
+	binary.LittleEndian.PutUint32(header[len(MAGIC):], VERSION)
+	return header
+}
+
+// encodeEdit serializes the edit, along with its length and checksum.
+// Payload layout: number of added tables, then each table (level, run, size, max seq, global seq,
+// entries, tombstones, min key length, min key, max key length, max key), then the number of
+// removed tables, then each table (level, run). All numbers are little endian, 4 bytes long,
+// except for size, max seq, global seq, entries and tombstones (8 bytes). Version 1 had no global
+// seq, and version 2 no entries and tombstones.
+func encodeEdit(edit Edit) []byte {
+	payload := bytes.Buffer{}
+	putUint32 := func(n int) {
+		binary.Write(&payload, binary.LittleEndian, uint32(n))
+	}
+
+	putUint32(len(edit.Added))
+	for _, t := range edit.Added {
+		putUint32(t.Level)
+		putUint32(t.Run)
+		binary.Write(&payload, binary.LittleEndian, t.Size)
+		binary.Write(&payload, binary.LittleEndian, t.MaxSeq)
+		binary.Write(&payload, binary.LittleEndian, t.GlobalSeq)
+		binary.Write(&payload, binary.LittleEndian, t.Entries)
+		binary.Write(&payload, binary.LittleEndian, t.Tombstones)
+		putUint32(len(t.MinKey))
+		payload.Write(t.MinKey)
+		putUint32(len(t.MaxKey))
+		payload.Write(t.MaxKey)
+	}
+	putUint32(len(edit.Removed))
+	for _, id := range edit.Removed {
+		putUint32(id.Level)
+		putUint32(id.Run)
+	}
+
+	out := make([]byte, editHeaderSize, editHeaderSize+payload.Len())
+	binary.LittleEndian.PutUint32(out, crc32.ChecksumIEEE(payload.Bytes()))
+	binary.LittleEndian.PutUint32(out[4:], uint32(payload.Len()))
+	return append(out, payload.Bytes()...)
+}
+
+// decodeEdit deserializes the payload of an edit, written in the given version of the format.
+func decodeEdit(payload []byte, version uint32) (Edit, error) {
+	edit := Edit{}
+	rd := bytes.NewReader(payload)
+	getUint32 := func() (int, error) {
+		var n uint32
+		err := binary.Read(rd, binary.LittleEndian, &n)
+		return int(n), err
+	}
+	getKey := func() ([]byte, error) {
+		n, err := getUint32()
+		if err != nil {
+			return nil, err
+		}
+		if n > len(payload) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		key := make([]byte, n)
+		_, err = io.ReadFull(rd, key)
+		return key, err
+	}
+
+	added, err := getUint32()
+	if err != nil {
+		return Edit{}, err
+	}
+	for i := 0; i < added; i++ {
+		t := Table{}
+		t.Level, err = getUint32()
+		if err == nil {
+			t.Run, err = getUint32()
+		}
+		if err == nil {
+			err = binary.Read(rd, binary.LittleEndian, &t.Size)
+		}
+		if err == nil {
+			err = binary.Read(rd, binary.LittleEndian, &t.MaxSeq)
+		}
+		if err == nil && version >= 2 {
+			err = binary.Read(rd, binary.LittleEndian, &t.GlobalSeq)
+		}
+		if err == nil && version >= 3 {
+			err = binary.Read(rd, binary.LittleEndian, &t.Entries)
+		}
+		if err == nil && version >= 3 {
+			err = binary.Read(rd, binary.LittleEndian, &t.Tombstones)
+		}
+		if err == nil {
+			t.MinKey, err = getKey()
+		}
+		if err == nil {
+			t.MaxKey, err = getKey()
+		}
+		if err != nil {
+			return Edit{}, err
+		}
+		edit.Added = append(edit.Added, t)
+	}
+
+	removed, err := getUint32()
+	if err != nil {
+		return Edit{}, err
+	}
+	for i := 0; i < removed; i++ {
+		id := TableID{}
+		id.Level, err = getUint32()
+		if err == nil {
+			id.Run, err = getUint32()
+		}
+		if err != nil {
+			return Edit{}, err
+		}
+		edit.Removed = append(edit.Removed, id)
+	}
+
+	if rd.Len() > 0 {
+		return Edit{}, errors.New("trailing bytes")
+	}
+	return edit, nil
+}
@@ -2,13 +2,12 @@
 package memtable
 
 import (
+	"bytes"
 	"fmt"
-	"nakevaleng/core/lsmtree"
 	"nakevaleng/core/record"
 	"nakevaleng/core/skiplist"
 	"nakevaleng/core/sstable"
 	"nakevaleng/engine/coreconf"
-	"nakevaleng/util/filename"
 )
 
 type Memtable struct {
@@ -68,7 +67,7 @@ func (mt *Memtable) Add(rec record.Record) bool {
 // ShouldFlush returns true if the memtable is ready to be flushed into a SSTable, as determined by
 // the currently set MemtableFlushStrategy.
 func (mt Memtable) ShouldFlush() bool {
-	return (mt.conf.ShouldFlushByCapacity() && mt.sl.Count == mt.conf.MemtableCapacity) ||
+	return (mt.conf.ShouldFlushByCapacity() && mt.sl.Count >= mt.conf.MemtableCapacity) ||
 		(mt.conf.ShouldFlushByThreshold() && mt.memusage >= mt.threshold)
 }
 
@@ -89,14 +88,12 @@ func (mt *Memtable) Find(key []byte) (record.Record, bool) {
 	}
 }
 
-// Flush the memtable to disk, forming an SSTable.
-func (mt *Memtable) Flush() {
+// Flush writes the contents of the memtable to disk, forming a level 1 SSTable with the given run
+// in path. The memtable itself is left as is. Once it's flushed, it's meant to be discarded, so the
+// caller is responsible for moving the SSTable into place and compacting the LSM tree.
+func (mt *Memtable) Flush(path string, run int) error {
 	fmt.Println("[DBG]\t[Memtable] Flushing")
-	newRun := filename.GetLastRun(mt.conf.Path, mt.conf.DBName, 1) + 1
-	sstable.MakeTable(mt.conf.Path, mt.conf.DBName, mt.conf.SummaryPageSize, 1, newRun, mt.NewIterator())
-	mt.sl.Clear()
-	mt.memusage = 0
-	lsmtree.Compact(mt.conf.Path, mt.conf.DBName, mt.conf.SummaryPageSize, 1, mt.conf.LsmLvlMax, mt.conf.LsmRunMax)
+	return sstable.MakeTable(path, mt.conf.DBName, mt.conf.SummaryPageSize, 1, run, mt.conf.SSTableCodec, mt.conf.SSTableLayout, mt.NewIterator())
 }
 
 // NewIterator returns an iterator to the sorted contents of a Memtable
@@ -114,3 +111,20 @@ func (mt *Memtable) NewIterator() record.Iterator {
 		}
 	}
 }
+
+// NewRangeIterator returns an iterator to the sorted contents of a Memtable whose keys fall in the
+// range [start, end). An empty end means there is no upper bound.
+// Unlike NewIterator, the returned iterator is not circular: once it's exhausted, it keeps
+// returning true.
+func (mt *Memtable) NewRangeIterator(start, end []byte) record.Iterator {
+	n := mt.sl.Seek(start)
+	return func() (record.Record, bool) {
+		if n == nil || (len(end) != 0 && bytes.Compare(n.Data.Key, end) >= 0) {
+			n = nil
+			return record.NewEmpty(), true
+		}
+		rec := n.Data
+		n = n.Next[0]
+		return rec, false
+	}
+}
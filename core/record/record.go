@@ -6,17 +6,39 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
+	"math"
 	"time"
 )
 
 const (
 	RECORD_STATUS_DEFAULT    = 0 << 0
 	RECORD_TOMBSTONE_REMOVED = 1 << 0
+	RECORD_BATCH_BEGIN       = 1 << 1 // Marks the start of a batch in the WAL. Never leaves the WAL.
+	RECORD_BATCH_COMMIT      = 1 << 2 // Marks the end of a batch in the WAL. Never leaves the WAL.
 )
 
+// Versions of the encoding of a Record.
+const (
+	RECORD_VERSION_V0 = 0 // Without the sequence number, from before it was added. Only read, never written.
+	RECORD_VERSION_V1 = 1 // With the sequence number following the timestamp.
+)
+
+// readBytesChunk is the greatest number of bytes ReadBytes allocates up front.
+const readBytesChunk = 64 << 10
+
+// RECORD_HEADER_SIZE is the number of bytes a serialized Record takes up before its key and value.
+const RECORD_HEADER_SIZE = 4 + 8 + 8 + 1 + 1 + 8 + 8
+
+// RECORD_HEADER_SIZE_V0 is RECORD_HEADER_SIZE for a Record encoded in RECORD_VERSION_V0.
+const RECORD_HEADER_SIZE_V0 = 4 + 8 + 1 + 1 + 8 + 8
+
+// ErrCorruption is returned (wrapped) whenever stored data fails a checksum or is malformed.
+var ErrCorruption = errors.New("data corruption")
+
 // Iterator iterates over records
 // the bool is true if the returned one is one after the last element
 // (passed all records once) this iterates circularly, so it is expected to pass through all at once
@@ -26,6 +48,7 @@ type Iterator func() (Record, bool)
 type Record struct {
 	Crc       uint32 // Checksum of key and value ONLY!!!
 	Timestamp int64  // Creation time as UNIX timestamp
+	Seq       uint64 // Sequence number, assigned by the engine on write. Newer records have greater ones.
 	Status    uint8  // Status bits, see the documentation for more info.
 	TypeInfo  uint8  // Type ID of 'Value'. Defaults to 0 (no type).
 	KeySize   uint64 // Size of Key (in bytes)
@@ -38,11 +61,21 @@ type Record struct {
 type KeyContext struct {
 	Key     []byte
 	RecSize uint64 // Size of the Record object this context was built from, using .TotalSize().
+	Seq     uint64 // Sequence number of the Record object this context was built from.
+}
+
+// HeaderSize returns the number of bytes a Record encoded in the given version takes up before its
+// key and value.
+func HeaderSize(version int) uint64 {
+	if version == RECORD_VERSION_V0 {
+		return RECORD_HEADER_SIZE_V0
+	}
+	return RECORD_HEADER_SIZE
 }
 
 // TotalSize calculates the total number of bytes required to store the given record structure.
 func (rec Record) TotalSize() uint64 {
-	return 4 + 8 + 1 + 1 + 8 + 8 + rec.KeySize + rec.ValueSize
+	return RECORD_HEADER_SIZE + rec.KeySize + rec.ValueSize
 }
 
 // New creates a Record object with the key and value specified as byte slices.
@@ -73,7 +106,7 @@ func NewFromString(key, val string) Record {
 }
 
 // Clone creates a new Record object with fields the copied from 'rec'.
-// The timestamp is NOT copied!
+// The timestamp and the sequence number are NOT copied!
 func Clone(rec Record) Record {
 	return Record{
 		Crc:       rec.Crc,
@@ -100,9 +133,10 @@ func (rec Record) IsDeleted() bool {
 // String returns a string representation of the record suitable for reading and debugging.
 // The Status and TypeInfo fields are printed in binary.
 func (rec Record) String() string {
-	return fmt.Sprintf("Record(%d %d %08b %08b %d %d %v %v)",
+	return fmt.Sprintf("Record(%d %d %d %08b %08b %d %d %v %v)",
 		rec.Crc,
 		rec.Timestamp,
+		rec.Seq,
 		rec.Status,
 		rec.TypeInfo,
 		rec.KeySize,
@@ -114,61 +148,87 @@ func (rec Record) String() string {
 
 // Deserialize reads data from buffered reader and overwrites this record.
 // The checksum is recalculated and compared with the one read from the file.
-// The function will panic if they don't match.
-// If the reader reaches an EOF, eof will be set to true.
-func (rec *Record) Deserialize(reader *bufio.Reader) (eof bool) {
-	eof = false
+// Returns io.EOF if the reader has no more records, and an error wrapping ErrCorruption if the
+// checksums don't match or the reader ends in the middle of a record. A record whose header is all
+// zeroes (what's left behind by a write that extended the file but never filled it) is also
+// reported as corrupt.
+func (rec *Record) Deserialize(reader *bufio.Reader) error {
+	return rec.DeserializeVersion(reader, RECORD_VERSION_V1)
+}
 
+// DeserializeVersion is like Deserialize, for a record encoded in the given version. A record
+// encoded in RECORD_VERSION_V0 has no sequence number, so it's left at 0.
+func (rec *Record) DeserializeVersion(reader *bufio.Reader, version int) error {
 	err := binary.Read(reader, binary.LittleEndian, &rec.Crc)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
-	}
-	err = binary.Read(reader, binary.LittleEndian, &rec.Timestamp)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
-	}
-	err = binary.Read(reader, binary.LittleEndian, &rec.Status)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: record cut short", ErrCorruption)
 	}
-	err = binary.Read(reader, binary.LittleEndian, &rec.TypeInfo)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	if err != nil {
+		return err
 	}
-	err = binary.Read(reader, binary.LittleEndian, &rec.KeySize)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+
+	fields := []interface{}{&rec.Timestamp, &rec.Seq, &rec.Status, &rec.TypeInfo, &rec.KeySize, &rec.ValueSize}
+	if version == RECORD_VERSION_V0 {
+		rec.Seq = 0
+		fields = []interface{}{&rec.Timestamp, &rec.Status, &rec.TypeInfo, &rec.KeySize, &rec.ValueSize}
 	}
-	err = binary.Read(reader, binary.LittleEndian, &rec.ValueSize)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	for _, field := range fields {
+		err = binary.Read(reader, binary.LittleEndian, field)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: record cut short", ErrCorruption)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	rec.Key = make([]byte, rec.KeySize)
-	rec.Value = make([]byte, rec.ValueSize)
+	if rec.Timestamp == 0 && rec.KeySize == 0 {
+		return fmt.Errorf("%w: empty record header", ErrCorruption)
+	}
 
-	err = binary.Read(reader, binary.LittleEndian, &rec.Key)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	rec.Key, err = ReadBytes(reader, rec.KeySize)
+	if err == nil {
+		rec.Value, err = ReadBytes(reader, rec.ValueSize)
 	}
-	err = binary.Read(reader, binary.LittleEndian, &rec.Value)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: record cut short", ErrCorruption)
 	}
-
 	if err != nil {
-		panic(err.Error())
+		return err
 	}
 
 	// Checksum
 	crc := crc32.ChecksumIEEE(append(rec.Key[:], rec.Value[:]...))
 
 	if crc != rec.Crc {
-		errMsg := fmt.Sprint("Bad Record checksum (got ", crc, ", expected ", rec.Crc, ")\n", rec.String())
-		panic(errMsg)
+		return fmt.Errorf("%w: bad record checksum (got %d, expected %d) for %s", ErrCorruption, crc, rec.Crc, rec.String())
+	}
+
+	return nil
+}
+
+// ReadBytes reads the next n bytes from the reader, where n was read from a file and may be corrupt.
+// The buffer only grows as the bytes are actually read, so a size that's way off can't make it
+// allocate more than what the reader holds. Returns io.ErrUnexpectedEOF if the reader ends first.
+func ReadBytes(reader io.Reader, n uint64) ([]byte, error) {
+	if n <= readBytesChunk {
+		buf := make([]byte, n)
+		_, err := io.ReadFull(reader, buf)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return buf, err
+	}
+	if n > math.MaxInt64 {
+		return nil, io.ErrUnexpectedEOF
 	}
 
-	return false
+	buf := bytes.Buffer{}
+	_, err := io.CopyN(&buf, reader, int64(n))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
 }
 
 // ToBytes creates a binary slice of all data for the Record object.
@@ -177,6 +237,7 @@ func (rec Record) ToBytes() []byte {
 	w := bytes.NewBuffer(buffer)
 	binary.Write(w, binary.LittleEndian, rec.Crc)
 	binary.Write(w, binary.LittleEndian, rec.Timestamp)
+	binary.Write(w, binary.LittleEndian, rec.Seq)
 	binary.Write(w, binary.LittleEndian, rec.Status)
 	binary.Write(w, binary.LittleEndian, rec.TypeInfo)
 	binary.Write(w, binary.LittleEndian, rec.KeySize)
@@ -188,9 +249,10 @@ func (rec Record) ToBytes() []byte {
 
 // Serialize appends the contents of the Record using a buffered writer, in binary mode.
 // The writer does not get flushed. It's up to the caller to invoke writer.Flush().
-func (rec Record) Serialize(writer *bufio.Writer) {
+func (rec Record) Serialize(writer *bufio.Writer) error {
 	err := binary.Write(writer, binary.LittleEndian, rec.Crc)
 	err = binary.Write(writer, binary.LittleEndian, rec.Timestamp)
+	err = binary.Write(writer, binary.LittleEndian, rec.Seq)
 	err = binary.Write(writer, binary.LittleEndian, rec.Status)
 	err = binary.Write(writer, binary.LittleEndian, rec.TypeInfo)
 	err = binary.Write(writer, binary.LittleEndian, rec.KeySize)
@@ -198,7 +260,5 @@ func (rec Record) Serialize(writer *bufio.Writer) {
 	err = binary.Write(writer, binary.LittleEndian, rec.Key)
 	err = binary.Write(writer, binary.LittleEndian, rec.Value)
 
-	if err != nil {
-		panic(err.Error())
-	}
+	return err
 }
@@ -149,3 +149,20 @@ func (skiplist Skiplist) Find(key []byte) *SkiplistNode {
 	}
 	return node
 }
+
+// Seek traverses the Skiplist, looking for the first node whose key is greater than or equal to
+// the given key.
+// Returns a pointer to the node, or nil if every key in the Skiplist is less than 'key'.
+func (skiplist Skiplist) Seek(key []byte) *SkiplistNode {
+	node := skiplist.Header
+
+	// Go from top to bottom level, and find the node with the greatest key less than 'key'.
+
+	for lvl := skiplist.Level - 1; lvl >= 0; lvl-- {
+		for node.Next[lvl] != nil && bytes.Compare(key, node.Next[lvl].Data.Key) == 1 {
+			node = node.Next[lvl]
+		}
+	}
+
+	return node.Next[0]
+}
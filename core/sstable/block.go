@@ -0,0 +1,130 @@
+package sstable
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"nakevaleng/core/record"
+)
+
+// Codecs a block of a v2 Data table can be compressed with.
+const (
+	CODEC_NONE  = "none"
+	CODEC_FLATE = "flate"
+	CODEC_ZLIB  = "zlib"
+)
+
+// BLOCK_SIZE is the number of bytes of records after which a block of a v2 Data table is cut. A
+// record is never split between blocks, so blocks are usually a bit bigger than this.
+const BLOCK_SIZE = 4096
+
+const blockHeaderSize = 4 + 4 // Length of the stored data, CRC of the stored data.
+
+// ValidateCodec returns an error if the codec isn't one of CODEC_NONE, CODEC_FLATE or CODEC_ZLIB.
+func ValidateCodec(codec string) error {
+	switch codec {
+	case CODEC_NONE, CODEC_FLATE, CODEC_ZLIB:
+		return nil
+	}
+	err := fmt.Errorf("codec must be \"%s\", \"%s\" or \"%s\", but \"%s\" was given",
+		CODEC_NONE, CODEC_FLATE, CODEC_ZLIB, codec)
+	return err
+}
+
+// encodeBlock compresses the records of a block with the given codec, and puts the block header in
+// front of them.
+func encodeBlock(codec string, raw []byte) ([]byte, error) {
+	out := bytes.NewBuffer(make([]byte, blockHeaderSize, blockHeaderSize+len(raw)))
+
+	var w io.WriteCloser
+	var err error
+	switch codec {
+	case CODEC_NONE:
+		out.Write(raw)
+	case CODEC_FLATE:
+		w, err = flate.NewWriter(out, flate.DefaultCompression)
+	case CODEC_ZLIB:
+		w = zlib.NewWriter(out)
+	default:
+		err = ValidateCodec(codec)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if w != nil {
+		_, err = w.Write(raw)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	block := out.Bytes()
+	binary.LittleEndian.PutUint32(block, uint32(len(block)-blockHeaderSize))
+	binary.LittleEndian.PutUint32(block[4:], crc32.ChecksumIEEE(block[blockHeaderSize:]))
+	return block, nil
+}
+
+// readBlock reads the block at the given offset of a Data table and decompresses its records.
+// Also returns the size of the block in the Data table, header included, so the caller can move on
+// to the next one.
+// Returns io.EOF if there are no blocks at the offset, and an error wrapping record.ErrCorruption
+// if the block is cut short, its checksum doesn't match or it can't be decompressed. The length in
+// the header is checked against the rest of the Data table before anything is allocated for it.
+func readBlock(r *io.SectionReader, offset int64, codec string) ([]byte, int64, error) {
+	header := make([]byte, blockHeaderSize)
+	n, err := r.ReadAt(header, offset)
+	if err == io.EOF && n == 0 {
+		return nil, 0, io.EOF
+	}
+	if err == io.EOF {
+		return nil, 0, fmt.Errorf("%w: data block header cut short at offset %d", record.ErrCorruption, offset)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	size := int64(binary.LittleEndian.Uint32(header))
+	if size > r.Size()-offset-blockHeaderSize {
+		return nil, 0, fmt.Errorf("%w: data block of %d bytes at offset %d runs past the data table", record.ErrCorruption, size, offset)
+	}
+	stored := make([]byte, size)
+	_, err = r.ReadAt(stored, offset+blockHeaderSize)
+	if err == io.EOF {
+		return nil, 0, fmt.Errorf("%w: data block cut short at offset %d", record.ErrCorruption, offset)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if crc32.ChecksumIEEE(stored) != binary.LittleEndian.Uint32(header[4:]) {
+		return nil, 0, fmt.Errorf("%w: bad data block checksum at offset %d", record.ErrCorruption, offset)
+	}
+
+	var dr io.ReadCloser
+	switch codec {
+	case CODEC_NONE:
+		return stored, blockHeaderSize + int64(len(stored)), nil
+	case CODEC_FLATE:
+		dr = flate.NewReader(bytes.NewReader(stored))
+	case CODEC_ZLIB:
+		dr, err = zlib.NewReader(bytes.NewReader(stored))
+	default:
+		err = ValidateCodec(codec)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: data block at offset %d: %s", record.ErrCorruption, offset, err)
+	}
+	defer dr.Close()
+
+	raw, err := io.ReadAll(dr)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: data block at offset %d: %s", record.ErrCorruption, offset, err)
+	}
+	return raw, blockHeaderSize + int64(len(stored)), nil
+}
@@ -0,0 +1,179 @@
+package sstable
+
+import (
+	"container/list"
+	"fmt"
+	"nakevaleng/core/record"
+	"sync"
+)
+
+// TableCache keeps a Reader for each recently used SSTable, which holds what point lookups need:
+// open handles to the Data and Index tables, the decoded filter and the parsed Summary table.
+// Without it, every lookup would open all of those files again and decode the filter from scratch.
+// At most capacity tables are kept, and the least recently used one is dropped to make room for a
+// new one. Tables must be dropped with Evict once they're removed, so their files get closed.
+// It's safe for concurrent use. Files are read with ReadAt, so many lookups can share a handle.
+type TableCache struct {
+	path     string
+	dbname   string
+	capacity int
+	order    list.List // Of *cachedTable, from the most to the least recently used.
+	tables   map[tableID]*list.Element
+	mu       sync.Mutex
+}
+
+// tableID identifies an SSTable in the directory of a TableCache.
+type tableID struct {
+	level int
+	run   int
+}
+
+// cachedTable is an SSTable kept by TableCache. Its files are closed once the table is dropped
+// from the cache and nobody is using it anymore.
+type cachedTable struct {
+	id     tableID
+	reader *Reader
+	refs   int // The cache holds one reference for as long as it keeps the table. Uses mu.
+}
+
+// NewTableCache returns a pointer to a new, empty TableCache for the tables in the given directory.
+func NewTableCache(path, dbname string, capacity int) (*TableCache, error) {
+	err := ValidateCacheParams(capacity)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TableCache{
+		path:     path,
+		dbname:   dbname,
+		capacity: capacity,
+		tables:   map[tableID]*list.Element{},
+	}, nil
+}
+
+// ValidateCacheParams is a helper function that returns an error representing the validity of
+// params passed to NewTableCache.
+func ValidateCacheParams(capacity int) error {
+	if capacity <= 0 {
+		err := fmt.Errorf("capacity must be a positive number, but %d was given", capacity)
+		return err
+	}
+	return nil
+}
+
+// Get looks for the record with the specified key in an SSTable (see Reader.Get). Returns false
+// if the table doesn't hold the key. If globalSeq isn't 0, the record is returned with it as its
+// sequence number (see Reader.SetGlobalSeq).
+// The table is loaded into the cache if it isn't there already.
+func (tc *TableCache) Get(level, run int, globalSeq uint64, key []byte) (record.Record, bool, error) {
+	t, err := tc.acquire(tableID{level, run})
+	if err != nil {
+		return record.Record{}, false, err
+	}
+	defer tc.release(t)
+
+	rec, found, err := t.reader.Get(key)
+	if found && globalSeq != 0 {
+		rec.Seq = globalSeq
+	}
+	return rec, found, err
+}
+
+// Evict drops an SSTable from the cache, if it's there. Its files are closed right away, unless a
+// lookup is still using them, in which case they're closed once it's done.
+func (tc *TableCache) Evict(level, run int) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	el, exists := tc.tables[tableID{level, run}]
+	if exists {
+		tc.drop(el)
+	}
+}
+
+// Len returns the number of SSTables in the cache.
+func (tc *TableCache) Len() int {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	return tc.order.Len()
+}
+
+// Close drops all SSTables from the cache.
+func (tc *TableCache) Close() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	for tc.order.Len() > 0 {
+		tc.drop(tc.order.Back())
+	}
+}
+
+// acquire returns the cached SSTable, loading it first if needed, and takes a reference to it
+// which must be given back with release.
+// Tables are loaded without holding the lock, so lookups on other tables don't wait for the disk.
+// If two lookups load the same table at once, the one that finishes second throws its copy away.
+func (tc *TableCache) acquire(id tableID) (*cachedTable, error) {
+	tc.mu.Lock()
+	el, exists := tc.tables[id]
+	if exists {
+		tc.order.MoveToFront(el)
+		t := el.Value.(*cachedTable)
+		t.refs++
+		tc.mu.Unlock()
+		return t, nil
+	}
+	tc.mu.Unlock()
+
+	reader, err := OpenReader(tc.path, tc.dbname, id.level, id.run)
+	if err != nil {
+		return nil, err
+	}
+	t := &cachedTable{id: id, reader: reader}
+
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	el, exists = tc.tables[id]
+	if exists {
+		t.close()
+		tc.order.MoveToFront(el)
+		t = el.Value.(*cachedTable)
+		t.refs++
+		return t, nil
+	}
+
+	t.refs = 2
+	tc.tables[id] = tc.order.PushFront(t)
+	for tc.order.Len() > tc.capacity {
+		tc.drop(tc.order.Back())
+	}
+	return t, nil
+}
+
+// release gives back a reference taken by acquire.
+func (tc *TableCache) release(t *cachedTable) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t.refs--
+	if t.refs == 0 {
+		t.close()
+	}
+}
+
+// drop removes an SSTable from the cache and gives back the cache's reference to it. The caller
+// must hold the lock.
+func (tc *TableCache) drop(el *list.Element) {
+	t := tc.order.Remove(el).(*cachedTable)
+	delete(tc.tables, t.id)
+
+	t.refs--
+	if t.refs == 0 {
+		t.close()
+	}
+}
+
+// close closes the files of the SSTable.
+func (t *cachedTable) close() {
+	t.reader.Close()
+}
@@ -2,28 +2,130 @@ package sstable
 
 import (
 	"bufio"
+	"bytes"
+	"fmt"
+	"io"
 	"nakevaleng/core/record"
 	"nakevaleng/util/filename"
-	"os"
 )
 
-// makeDataTable writes the contents from the skiplist into a data table file, record by record.
-//	path    `path to the directory where the table will be created`
+// DataReader reads the records of a Data table one by one, in order. Both formats are supported:
+// v0 and v1 tables are read record by record, while v2 tables are read a block at a time, with each block
+// checked against its CRC and decompressed before its records are handed out.
+type DataReader struct {
+	t      *tableFiles // Closed along with the DataReader. Nil if someone else owns the files.
+	data   *io.SectionReader
+	meta   Metadata
+	start  []byte        // Records with smaller keys are skipped.
+	r      *bufio.Reader // Over the whole table for v0 and v1, over the current block for v2.
+	next   int64         // Offset of the next record for v0 and v1, of the next block for v2.
+	offset int64         // Where the last record handed out begins for v0 and v1, or its block for v2.
+
+	globalSeq uint64 // If not 0, handed out as the sequence number of every record.
+}
+
+// OpenDataTable opens the Data table of an SSTable for reading from the first record.
+//	path    `path to the directory where the table is located`
 //	dbname  `name of the database`
-//	level   `lsm tree level this table belongs to`
-//	run     `ordinal number of the run on the given level for this table`
-//	list    `skiplist containing all data to read from when writing to the file`
-func makeDataTable(path string, dbname string, level int, run int, rit record.Iterator) {
-	fname := filename.Table(path, dbname, level, run, filename.TypeData)
-	f, err := os.Create(fname)
+//	level   `lsm tree level the table belongs to`
+//	run     `ordinal number of the run on the given level for the table`
+func OpenDataTable(path, dbname string, level, run int) (*DataReader, error) {
+	t, err := openTable(path, dbname, level, run, filename.TypeData, filename.TypeMetadata, filename.TypeSummary)
 	if err != nil {
-		panic(err)
+		return nil, err
+	}
+	meta, err := readMetadata(t)
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	return newDataReader(t, t.section(filename.TypeData), meta, 0), nil
+}
+
+// newDataReader returns a DataReader over a Data table in the given format, reading from the
+// given offset, which must be where a record (for v0 and v1) or a block (for v2) begins, as found
+// in an ITE. If t isn't nil, it's closed along with the DataReader.
+func newDataReader(t *tableFiles, data *io.SectionReader, meta Metadata, offset int64) *DataReader {
+	dr := &DataReader{t: t, data: data, meta: meta, next: offset}
+	if meta.Version <= VERSION_V1 {
+		dr.r = readerAt(data, offset)
 	}
-	defer f.Close()
-	w := bufio.NewWriter(f)
-	defer w.Flush()
+	return dr
+}
 
-	for rec, last := rit(); !last; rec, last = rit() {
-		rec.Serialize(w)
+// Next returns the next record in the Data table. Returns io.EOF once there are no more records,
+// and an error wrapping record.ErrCorruption if the table is damaged.
+func (dr *DataReader) Next() (record.Record, error) {
+	for {
+		if dr.r != nil {
+			rec := record.Record{}
+			err := rec.DeserializeVersion(dr.r, dr.meta.recordVersion())
+			if err == nil && dr.meta.Version <= VERSION_V1 {
+				dr.offset = dr.next
+				dr.next += int64(record.HeaderSize(dr.meta.recordVersion()) + rec.KeySize + rec.ValueSize)
+			}
+			if err == nil && bytes.Compare(rec.Key, dr.start) < 0 {
+				continue // The first block of a v2 table may begin before start.
+			}
+			if err == nil && dr.globalSeq != 0 {
+				rec.Seq = dr.globalSeq
+			}
+			if err != io.EOF || dr.meta.Version <= VERSION_V1 {
+				return rec, err
+			}
+		}
+
+		raw, size, err := readBlock(dr.data, dr.next, dr.meta.Codec)
+		if err != nil {
+			return record.Record{}, err
+		}
+		dr.r = bufio.NewReader(bytes.NewReader(raw))
+		dr.offset = dr.next
+		dr.next += size
 	}
 }
+
+// Close closes the Data table, unless it belongs to a Reader.
+func (dr *DataReader) Close() error {
+	if dr.t == nil {
+		return nil
+	}
+	return dr.t.close()
+}
+
+// findInBlock reads the block at the given offset of a v2 Data table, and looks for the record
+// with the specified key in it. Returns false if the block doesn't hold the key.
+func findInBlock(r *io.SectionReader, offset int64, codec string, key []byte) (record.Record, bool, error) {
+	raw, _, err := readBlock(r, offset, codec)
+	if err == io.EOF {
+		err = fmt.Errorf("%w: no data block at offset %d", record.ErrCorruption, offset)
+	}
+	if err != nil {
+		return record.Record{}, false, err
+	}
+
+	br := bufio.NewReader(bytes.NewReader(raw))
+	for {
+		rec := record.Record{}
+		err := rec.Deserialize(br)
+		if err == io.EOF {
+			return record.Record{}, false, nil
+		}
+		if err != nil {
+			return record.Record{}, false, err
+		}
+
+		cmp := bytes.Compare(rec.Key, key)
+		if cmp == 0 {
+			return rec, true, nil
+		} else if cmp > 0 {
+			return record.Record{}, false, nil
+		}
+	}
+}
+
+// readerAt returns a reader over the table from the given offset onwards. Unlike seeking, it
+// leaves the table's offset alone, so many readers can share the table.
+func readerAt(r *io.SectionReader, offset int64) *bufio.Reader {
+	return bufio.NewReader(io.NewSectionReader(r, offset, r.Size()-offset))
+}
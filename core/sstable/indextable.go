@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
-	"os"
+	"nakevaleng/core/record"
+	"sort"
 )
 
 // indexTableEntry (ITE) is the building block of an Index Table.
@@ -22,71 +24,117 @@ func (ite indexTableEntry) CalcSize() int64 {
 
 // Write appends the contents of the ITE into a binary file. The order of the attributes is:
 //	KeySize, Offset, Key
-func (ite indexTableEntry) Write(writer *bufio.Writer) {
+func (ite indexTableEntry) Write(writer *bufio.Writer) error {
 	binary.Write(writer, binary.LittleEndian, ite.KeySize)
 	binary.Write(writer, binary.LittleEndian, ite.Offset)
-	binary.Write(writer, binary.LittleEndian, ite.Key)
+	return binary.Write(writer, binary.LittleEndian, ite.Key)
 }
 
 // Read reads data from a binary file into an ITE. Old data in the ITE is overwritten. The order of
 // the attributes to be read is:
 //	KeySize, Offset, Key
 // KeySize determines how many bytes to read for the Key field.
-// Returns true if an unexpected EOF error is caught (io.EOF or io.ErrUnexpectedEOF).
-func (ite *indexTableEntry) Read(reader *bufio.Reader) (eof bool) {
+// Returns io.EOF if there are no more ITEs, and an error wrapping record.ErrCorruption if the
+// reader ends in the middle of an ITE.
+func (ite *indexTableEntry) Read(reader *bufio.Reader) error {
 	err := binary.Read(reader, binary.LittleEndian, &ite.KeySize)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	if err != nil {
+		return truncated(err, "index table entry")
 	}
 
 	err = binary.Read(reader, binary.LittleEndian, &ite.Offset)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	if err != nil {
+		return truncated(err, "index table entry")
 	}
 
-	ite.Key = make([]byte, ite.KeySize)
-	err = binary.Read(reader, binary.LittleEndian, &ite.Key)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	ite.Key, err = record.ReadBytes(reader, ite.KeySize)
+	if err != nil {
+		return truncated(err, "index table entry")
 	}
 
-	if err != nil {
-		panic(err.Error())
+	return nil
+}
+
+// truncated converts an error returned while reading the fields of an entry. An io.EOF before the
+// first field is read is left as is, since it means there are no more entries. Otherwise, running
+// out of data means that the entry was cut short.
+func truncated(err error, what string) error {
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: %s cut short", record.ErrCorruption, what)
 	}
+	return err
+}
 
-	return false
+// indexPage is a page of an Index Table loaded into memory, along with an array holding the offset
+// of each ITE in it. ITEs vary in size, so the offset array is what makes a binary search possible.
+// The ITEs are sorted by key, like in the Index Table.
+type indexPage struct {
+	buf     []byte
+	offsets []int
 }
 
-// FindIndexTableEntry searches an Index Table, looking for an ITE with the specified key. The user
-// may specify an offset in bytes from which to begin the search. This value can be retrieved from
-// a Summary Table Entry. For faster lookups.
-// If no ITE with the desired key is found, the return value's Offset field equals -1.
-func FindIndexTableEntry(indexTableFname string, key []byte, startOffset int64) indexTableEntry {
-	f, err := os.Open(indexTableFname)
+// readIndexPage reads the bytes in the range [start, end) of an Index Table as a page, and builds
+// its offset array. Only the KeySize field of each ITE is read to do so, the rest is skipped.
+// Returns an error wrapping record.ErrCorruption if the table ends before the page does, or if the
+// last ITE doesn't fit in the page. The range comes from the Summary table, so it's checked against
+// the size of the Index table before anything is read.
+func readIndexPage(r *io.SectionReader, start, end int64) (indexPage, error) {
+	if start < 0 || end < start || end > r.Size() {
+		return indexPage{}, fmt.Errorf("%w: index page [%d, %d) is out of the index table", record.ErrCorruption, start, end)
+	}
+	page := indexPage{buf: make([]byte, end-start)}
+	_, err := r.ReadAt(page.buf, start)
+	if err == io.EOF {
+		return indexPage{}, fmt.Errorf("%w: index table cut short", record.ErrCorruption)
+	}
 	if err != nil {
-		panic(err)
+		return indexPage{}, err
 	}
-	defer f.Close()
-	r := bufio.NewReader(f)
-
-	f.Seek(startOffset, 0)
-	ite := indexTableEntry{}
 
-	for {
-		if ite.Read(r) {
-			ite.Offset = -1
-			break
+	for off := 0; off < len(page.buf); {
+		if len(page.buf)-off < 16 {
+			return indexPage{}, fmt.Errorf("%w: index table entry cut short", record.ErrCorruption)
 		}
+		keySize := binary.LittleEndian.Uint64(page.buf[off:])
+		if keySize > uint64(len(page.buf)-off-16) {
+			return indexPage{}, fmt.Errorf("%w: index table entry cut short", record.ErrCorruption)
+		}
+		page.offsets = append(page.offsets, off)
+		off += 16 + int(keySize)
+	}
 
-		cmp := bytes.Compare(key, ite.Key)
+	return page, nil
+}
 
-		if cmp == 0 {
-			break
-		} else if cmp < 0 {
-			ite.Offset = -1
-			break
-		}
+// entry returns the i-th ITE in the page. Its key points into the page.
+func (page indexPage) entry(i int) indexTableEntry {
+	b := page.buf[page.offsets[i]:]
+	ite := indexTableEntry{
+		KeySize: binary.LittleEndian.Uint64(b),
+		Offset:  int64(binary.LittleEndian.Uint64(b[8:])),
+	}
+	ite.Key = b[16 : 16+ite.KeySize]
+	return ite
+}
+
+// seek returns the first ITE in the page whose key is greater than or equal to the specified key,
+// using a binary search. If there is no such ITE, the return value's Offset field equals -1.
+func (page indexPage) seek(key []byte) indexTableEntry {
+	i := sort.Search(len(page.offsets), func(i int) bool {
+		return bytes.Compare(page.entry(i).Key, key) >= 0
+	})
+	if i == len(page.offsets) {
+		return indexTableEntry{Offset: -1}
 	}
+	return page.entry(i)
+}
 
+// find returns the ITE in the page with the specified key. If there is no such ITE, the return
+// value's Offset field equals -1.
+func (page indexPage) find(key []byte) indexTableEntry {
+	ite := page.seek(key)
+	if ite.Offset != -1 && !bytes.Equal(ite.Key, key) {
+		return indexTableEntry{Offset: -1}
+	}
 	return ite
 }
@@ -0,0 +1,127 @@
+package sstable
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"nakevaleng/core/record"
+	"nakevaleng/util/filename"
+)
+
+// NewRangeIterator returns an iterator over the records of a Data table whose keys fall in the
+// range [start, end). An empty end means there is no upper bound.
+// The key range kept in the Summary table's header is used to skip the table entirely if it can't
+// hold any keys in the range. Otherwise, the Summary and Index tables are used to seek straight to
+// the first record in the range (or, in a v2 table, to the block holding it), instead of reading
+// the Data table from the start. (Filters only answer queries for exact keys, so they're of no use
+// here.)
+// The Data table is kept open until the iterator is exhausted, after which it keeps returning true.
+// If reading a record fails, the iterator is exhausted early and the error is stored in iterErr.
+//	path    `path to the directory where the table is located`
+//	dbname  `name of the database`
+//	level   `lsm tree level the table belongs to`
+//	run     `ordinal number of the run on the given level for the table`
+//	globalSeq `if not 0, the sequence number of all records in the table (see Reader.SetGlobalSeq)`
+func NewRangeIterator(path, dbname string, level, run int, globalSeq uint64, start, end []byte, iterErr *error) (record.Iterator, error) {
+	exhausted := func() (record.Record, bool) {
+		return record.NewEmpty(), true
+	}
+
+	t, err := openTable(path, dbname, level, run,
+		filename.TypeData, filename.TypeIndex, filename.TypeSummary, filename.TypeMetadata)
+	if err != nil {
+		return nil, err
+	}
+	dr, err := seekRange(t, start, end)
+	if err != nil {
+		t.close()
+		return nil, err
+	}
+	if dr == nil {
+		t.close()
+		return exhausted, nil
+	}
+	dr.globalSeq = globalSeq
+	done := false
+
+	return func() (record.Record, bool) {
+		for !done {
+			rec, err := dr.Next()
+			if err != nil {
+				if err != io.EOF {
+					*iterErr = err
+				}
+				break
+			}
+			if len(end) != 0 && bytes.Compare(rec.Key, end) >= 0 {
+				break
+			}
+			return rec, false
+		}
+
+		if !done {
+			done = true
+			dr.Close()
+		}
+		return record.NewEmpty(), true
+	}, nil
+}
+
+// seekRange returns a DataReader over the Data table of an open SSTable, positioned at the first
+// record in the range [start, end). Returns nil if the table holds no keys in the range.
+func seekRange(t *tableFiles, start, end []byte) (*DataReader, error) {
+	meta, err := readMetadata(t)
+	if err != nil {
+		return nil, err
+	}
+	s, err := readSummary(t.section(filename.TypeSummary), meta.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	// Range check.
+
+	if bytes.Compare(start, s.header.MaxKey) > 0 {
+		return nil, nil
+	}
+	if len(end) != 0 && bytes.Compare(end, s.header.MinKey) <= 0 {
+		return nil, nil
+	}
+
+	// Find the first record in the range.
+
+	offset, err := seekOffset(s, t.section(filename.TypeIndex), start)
+	if err != nil {
+		return nil, err
+	}
+	dr := newDataReader(t, t.section(filename.TypeData), meta, offset)
+	dr.start = start
+	return dr, nil
+}
+
+// seekOffset returns the offset in the Data table to read from to find the first record whose key
+// is greater than or equal to the specified key. In a v2 table, that's the offset of the block
+// holding the record, so a few records before it may have to be skipped.
+// If the table holds no such record, an offset past the end of the Data table is returned.
+func seekOffset(s summary, index *io.SectionReader, key []byte) (int64, error) {
+	if bytes.Compare(key, s.header.MinKey) <= 0 {
+		return 0, nil
+	}
+	if bytes.Compare(key, s.header.MaxKey) > 0 {
+		return math.MaxInt64, nil
+	}
+
+	pageStart, pageEnd, err := s.findPage(key)
+	if err != nil {
+		return 0, err
+	}
+	page, err := readIndexPage(index, pageStart, pageEnd)
+	if err != nil {
+		return 0, err
+	}
+	ite := page.seek(key)
+	if ite.Offset == -1 {
+		return math.MaxInt64, nil
+	}
+	return ite.Offset, nil
+}
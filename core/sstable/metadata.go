@@ -0,0 +1,212 @@
+package sstable
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"nakevaleng/core/record"
+	"nakevaleng/ds/merkletree"
+	"nakevaleng/util/filename"
+)
+
+// Versions of the Data table format.
+const (
+	VERSION_V0 = 0 // Like v1, from before sequence numbers were kept in records. Only read, never written.
+	VERSION_V1 = 1 // Records back to back, with an ITE for each record. Only read, never written.
+	VERSION_V2 = 2 // Records grouped into blocks, with an ITE for each block.
+	VERSION_V3 = 3 // Like v2, with the table's Properties kept in the Metadata table.
+)
+
+// METADATA_MAGIC is written at the start of the Metadata table of every v2 and v3 SSTable, ahead of
+// the Merkle tree. A v1 Metadata table starts with a Merkle node, whose first byte is never 'N'.
+const METADATA_MAGIC = "NKVTABLE"
+
+// Metadata describes the format of an SSTable. It's kept in the Metadata table, in front of the
+// Merkle tree.
+type Metadata struct {
+	Version int    // VERSION_V0, VERSION_V1, VERSION_V2 or VERSION_V3.
+	Codec   string // Codec the blocks of the Data table are compressed with. CODEC_NONE for v0 and v1.
+
+	// Properties kept in a v3 table, without the key range and greatest sequence number. Nil for
+	// older tables.
+	Properties *Properties
+}
+
+// ReadMetadata reads the Metadata of an SSTable. Tables written before the Metadata was added are
+// reported as v0 or v1, see legacyVersion.
+//	path    `path to the directory where the table is located`
+//	dbname  `name of the database`
+//	level   `lsm tree level the table belongs to`
+//	run     `ordinal number of the run on the given level for the table`
+func ReadMetadata(path, dbname string, level, run int) (Metadata, error) {
+	t, err := openTable(path, dbname, level, run, filename.TypeMetadata, filename.TypeSummary)
+	if err != nil {
+		return Metadata{}, err
+	}
+	defer t.close()
+	return readMetadata(t)
+}
+
+// readMetadata reads the Metadata from the Metadata table of an open SSTable. The Summary table must
+// be open too, in case the table has no Metadata.
+func readMetadata(t *tableFiles) (Metadata, error) {
+	fname := t.name(filename.TypeMetadata)
+	r := bufio.NewReader(t.section(filename.TypeMetadata))
+
+	magic, err := r.Peek(len(METADATA_MAGIC))
+	if (err == nil || err == io.EOF) && string(magic) != METADATA_MAGIC {
+		version, err := legacyVersion(t)
+		if err != nil {
+			return Metadata{}, err
+		}
+		return Metadata{Version: version, Codec: CODEC_NONE}, nil
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+	r.Discard(len(METADATA_MAGIC))
+
+	meta, err := readMetadataFields(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return Metadata{}, fmt.Errorf("%w: metadata cut short in %s", record.ErrCorruption, fname)
+	}
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	if meta.Version > VERSION_V3 {
+		return Metadata{}, fmt.Errorf("sstable: %s has version %d, only versions up to %d are supported", fname, meta.Version, VERSION_V3)
+	}
+	if meta.Version < VERSION_V2 || ValidateCodec(meta.Codec) != nil {
+		return Metadata{}, fmt.Errorf("%w: bad metadata in %s (version %d, codec \"%s\")", record.ErrCorruption, fname, meta.Version, meta.Codec)
+	}
+	return meta, nil
+}
+
+// legacyVersion tells whether a table written before the Metadata was added is a v0 or a v1 table.
+// Only the Summary table header of a v1 table keeps the greatest sequence number (8 bytes), so the
+// two are told apart by comparing the size of the Summary table with what its header says it holds.
+func legacyVersion(t *tableFiles) (int, error) {
+	summary := t.section(filename.TypeSummary)
+	size := uint64(summary.Size())
+
+	// MinKeySize, MaxKeySize and Payload come first in both versions.
+
+	header := make([]byte, 8+8+8)
+	_, err := summary.ReadAt(header, 0)
+	if err == io.EOF {
+		return 0, fmt.Errorf("%w: summary table header cut short in %s", record.ErrCorruption, t.name(filename.TypeSummary))
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	want := uint64(len(header))
+	for i := 0; i < len(header); i += 8 {
+		n := binary.LittleEndian.Uint64(header[i:])
+		if n > size {
+			want = size + 1 // Matches neither.
+			break
+		}
+		want += n
+	}
+
+	switch size {
+	case want:
+		return VERSION_V0, nil
+	case want + 8:
+		return VERSION_V1, nil
+	}
+	return 0, fmt.Errorf("%w: size of %s doesn't match its header", record.ErrCorruption, t.name(filename.TypeSummary))
+}
+
+// recordVersion returns the version of the encoding of the records in the Data table, see
+// record.DeserializeVersion.
+func (meta Metadata) recordVersion() int {
+	if meta.Version == VERSION_V0 {
+		return record.RECORD_VERSION_V0
+	}
+	return record.RECORD_VERSION_V1
+}
+
+// readMerkleRoot returns the hash in the root of the Merkle tree kept in the Metadata table of an
+// open SSTable, which has the given Metadata. In a v0 or v1 table, the tree is all there is.
+func readMerkleRoot(t *tableFiles, meta Metadata) ([]byte, error) {
+	fname := t.name(filename.TypeMetadata)
+	r := readerAt(t.section(filename.TypeMetadata), 0) // The Metadata may have been read through it already.
+
+	if meta.Version >= VERSION_V2 {
+		r.Discard(len(METADATA_MAGIC))
+		_, err := readMetadataFields(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	root := merkletree.MerkleNode{}
+	err := root.Deserialize(r)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: no Merkle tree in %s", record.ErrCorruption, fname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return root.Data, nil
+}
+
+// readMetadataFields reads the fields of the Metadata following the magic. The order of the
+// attributes is:
+//	Version (4 bytes), CodecSize (4 bytes), Codec, Properties (v3 only, see encodeProperties)
+func readMetadataFields(r *bufio.Reader) (Metadata, error) {
+	var version, codecSize uint32
+	err := binary.Read(r, binary.LittleEndian, &version)
+	if err != nil {
+		return Metadata{}, err
+	}
+	err = binary.Read(r, binary.LittleEndian, &codecSize)
+	if err != nil {
+		return Metadata{}, err
+	}
+	if codecSize > 64 {
+		return Metadata{}, fmt.Errorf("%w: codec name of %d bytes", record.ErrCorruption, codecSize)
+	}
+	codec := make([]byte, codecSize)
+	_, err = io.ReadFull(r, codec)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	meta := Metadata{Version: int(version), Codec: string(codec)}
+	if meta.Version == VERSION_V3 {
+		props, err := readProperties(r)
+		if err != nil {
+			return Metadata{}, err
+		}
+		meta.Properties = &props
+	}
+	return meta, nil
+}
+
+// encodeMetadata returns the contents of the Metadata table: the magic, the Metadata (with its
+// Properties, for v3) and the Merkle tree.
+func encodeMetadata(meta Metadata, tree *merkletree.MerkleTree) ([]byte, error) {
+	buf := bytes.Buffer{}
+	w := bufio.NewWriter(&buf)
+
+	w.WriteString(METADATA_MAGIC)
+	binary.Write(w, binary.LittleEndian, uint32(meta.Version))
+	binary.Write(w, binary.LittleEndian, uint32(len(meta.Codec)))
+	w.WriteString(meta.Codec)
+	if meta.Version == VERSION_V3 {
+		w.Write(encodeProperties(*meta.Properties))
+	}
+
+	err := tree.Write(w)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Flush()
+	return buf.Bytes(), err
+}
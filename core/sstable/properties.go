@@ -0,0 +1,150 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"nakevaleng/core/record"
+	"nakevaleng/ds/hll"
+)
+
+// PROPERTIES_HLL_PRECISION is the precision of the HyperLogLog used to estimate the number of
+// distinct keys in a table.
+const PROPERTIES_HLL_PRECISION = 12
+
+// propertiesSize is the size of the properties kept in a v3 Metadata table, in bytes:
+//	Count, Tombstones, RawKeyBytes, RawValueBytes (8 bytes each),
+//	MinTimestamp, MaxTimestamp, CreatedAt (8 bytes each), OriginLevel (4 bytes), DistinctKeys (8 bytes)
+// Properties added later go after these, so readers skip what they don't know about.
+const propertiesSize = 4*8 + 3*8 + 4 + 8
+
+// Properties describe the contents of an SSTable. Those from Tombstones on are kept in the Metadata
+// table of a v3 table, while for older tables they have to be found by reading the whole table.
+type Properties struct {
+	MinKey []byte // First key in the table
+	MaxKey []byte // Last key in the table
+	MaxSeq uint64 // Greatest sequence number of all records in the table
+	Count  uint64 // Number of records in the table, tombstones included
+
+	Tombstones    uint64 // Number of records that are tombstones
+	RawKeyBytes   uint64 // Size of all keys, before compression
+	RawValueBytes uint64 // Size of all values, before compression
+	MinTimestamp  int64  // Smallest timestamp of all records
+	MaxTimestamp  int64  // Greatest timestamp of all records
+	CreatedAt     int64  // When the table was written, as a UNIX timestamp. 0 if unknown.
+	OriginLevel   int    // Level the table was written for. 0 if unknown.
+	DistinctKeys  uint64 // Estimate of the number of distinct keys, from a HyperLogLog
+}
+
+// ReadProperties returns the Properties of an SSTable (see Reader.Properties).
+//	path    `path to the directory where the table is located`
+//	dbname  `name of the database`
+//	level   `lsm tree level the table belongs to`
+//	run     `ordinal number of the run on the given level for the table`
+func ReadProperties(path, dbname string, level, run int) (Properties, error) {
+	r, err := OpenReader(path, dbname, level, run)
+	if err != nil {
+		return Properties{}, err
+	}
+	defer r.Close()
+	return r.Properties()
+}
+
+// propertiesBuilder gathers the Properties of a table from its records, in order.
+type propertiesBuilder struct {
+	props Properties
+	keys  *hll.HLL
+}
+
+// newPropertiesBuilder returns a propertiesBuilder that has seen no records.
+func newPropertiesBuilder() *propertiesBuilder {
+	keys, _ := hll.New(PROPERTIES_HLL_PRECISION)
+	return &propertiesBuilder{keys: keys}
+}
+
+// add counts the record towards the Properties.
+func (b *propertiesBuilder) add(rec record.Record) {
+	p := &b.props
+	if p.Count == 0 {
+		p.MinKey = rec.Key
+		p.MinTimestamp = rec.Timestamp
+		p.MaxTimestamp = rec.Timestamp
+	}
+	p.MaxKey = rec.Key
+	if rec.Seq > p.MaxSeq {
+		p.MaxSeq = rec.Seq
+	}
+	if rec.Timestamp < p.MinTimestamp {
+		p.MinTimestamp = rec.Timestamp
+	}
+	if rec.Timestamp > p.MaxTimestamp {
+		p.MaxTimestamp = rec.Timestamp
+	}
+
+	p.Count++
+	if rec.IsDeleted() {
+		p.Tombstones++
+	}
+	p.RawKeyBytes += uint64(len(rec.Key))
+	p.RawValueBytes += uint64(len(rec.Value))
+	b.keys.Add(rec.Key)
+}
+
+// properties returns the Properties of the records seen so far.
+func (b *propertiesBuilder) properties() Properties {
+	p := b.props
+	p.DistinctKeys = uint64(b.keys.Estimate() + 0.5)
+	return p
+}
+
+// encodeProperties returns the properties kept in a v3 Metadata table, preceded by their size.
+// The key range and greatest sequence number are kept in the Summary table instead.
+func encodeProperties(p Properties) []byte {
+	buf := bytes.Buffer{}
+	binary.Write(&buf, binary.LittleEndian, uint32(propertiesSize))
+	for _, field := range []interface{}{p.Count, p.Tombstones, p.RawKeyBytes, p.RawValueBytes,
+		p.MinTimestamp, p.MaxTimestamp, p.CreatedAt, uint32(p.OriginLevel), p.DistinctKeys} {
+		binary.Write(&buf, binary.LittleEndian, field)
+	}
+	return buf.Bytes()
+}
+
+// readProperties reads the properties kept in a v3 Metadata table, as written by encodeProperties.
+func readProperties(r io.Reader) (Properties, error) {
+	var size uint32
+	err := binary.Read(r, binary.LittleEndian, &size)
+	if err != nil {
+		return Properties{}, err
+	}
+	if size < propertiesSize || size > 1<<16 {
+		return Properties{}, fmt.Errorf("%w: properties of %d bytes", record.ErrCorruption, size)
+	}
+	buf := make([]byte, size)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return Properties{}, err
+	}
+
+	// buf holds at least the known fields, so reading them can't fail.
+
+	p := Properties{}
+	rd := bytes.NewReader(buf)
+	var originLevel uint32
+	for _, field := range []interface{}{&p.Count, &p.Tombstones, &p.RawKeyBytes, &p.RawValueBytes,
+		&p.MinTimestamp, &p.MaxTimestamp, &p.CreatedAt, &originLevel, &p.DistinctKeys} {
+		binary.Read(rd, binary.LittleEndian, field)
+	}
+	p.OriginLevel = int(originLevel)
+	return p, nil
+}
+
+// sameContents returns true if the two Properties agree on everything that follows from the
+// records alone.
+func sameContents(p, q Properties) bool {
+	return bytes.Equal(p.MinKey, q.MinKey) && bytes.Equal(p.MaxKey, q.MaxKey) &&
+		p.Count == q.Count && p.Tombstones == q.Tombstones &&
+		p.RawKeyBytes == q.RawKeyBytes && p.RawValueBytes == q.RawValueBytes &&
+		p.MinTimestamp == q.MinTimestamp && p.MaxTimestamp == q.MaxTimestamp &&
+		p.DistinctKeys == q.DistinctKeys
+}
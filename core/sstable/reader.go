@@ -0,0 +1,328 @@
+package sstable
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"nakevaleng/core/record"
+	"nakevaleng/ds/bloomfilter"
+	"nakevaleng/ds/merkletree"
+	"nakevaleng/util/filename"
+)
+
+// Reader reads an SSTable of either format and layout. The Metadata, filter and Summary table are
+// loaded into memory when it's opened, while the Data and Index tables are kept open and read as
+// needed.
+// It's safe for concurrent use. Files are read with ReadAt, so many lookups can share a handle.
+type Reader struct {
+	files   *tableFiles // Holding the Data and Index tables.
+	data    *io.SectionReader
+	index   *io.SectionReader
+	filter  *bloomfilter.BloomFilter
+	summary summary
+	meta    Metadata
+	root    []byte // Hash in the root of the Merkle tree.
+
+	globalSeq uint64 // See SetGlobalSeq.
+}
+
+// OpenReader reads the Metadata, filter and Summary table of an SSTable, then opens its Data and
+// Index tables.
+//	path    `path to the directory where the table is located`
+//	dbname  `name of the database`
+//	level   `lsm tree level the table belongs to`
+//	run     `ordinal number of the run on the given level for the table`
+func OpenReader(path, dbname string, level, run int) (*Reader, error) {
+	r := &Reader{}
+
+	secondary, err := openTable(path, dbname, level, run,
+		filename.TypeFilter, filename.TypeSummary, filename.TypeMetadata)
+	if err != nil {
+		return nil, err
+	}
+	defer secondary.close()
+
+	r.meta, err = readMetadata(secondary)
+	if err != nil {
+		return nil, err
+	}
+	r.filter, err = readFilter(secondary)
+	if err != nil {
+		return nil, err
+	}
+	r.summary, err = readSummary(secondary.section(filename.TypeSummary), r.meta.Version)
+	if err != nil {
+		return nil, err
+	}
+	r.root, err = readMerkleRoot(secondary, r.meta)
+	if err != nil {
+		return nil, err
+	}
+
+	r.files, err = openTable(path, dbname, level, run, filename.TypeData, filename.TypeIndex)
+	if err != nil {
+		return nil, err
+	}
+	r.data = r.files.section(filename.TypeData)
+	r.index = r.files.section(filename.TypeIndex)
+
+	return r, nil
+}
+
+// Metadata returns the format of the table.
+func (r *Reader) Metadata() Metadata {
+	return r.meta
+}
+
+// SetGlobalSeq makes the Reader hand out every record of the table with the given sequence number,
+// instead of the one it was written with. It's used for tables built outside of the engine and
+// ingested as they are, whose sequence numbers mean nothing to it. Zero turns it off.
+// It must be called before the Reader is shared.
+func (r *Reader) SetGlobalSeq(seq uint64) {
+	r.globalSeq = seq
+}
+
+// Get looks for the record with the specified key in the table, going through its filter, Summary
+// table and Index table before reading the record from the Data table. Returns false if the table
+// doesn't hold the key.
+// In a v2 or v3 table, the ITE leads to the only block that may hold the key, which is searched in turn.
+func (r *Reader) Get(key []byte) (record.Record, bool, error) {
+	offset, err := r.locate(key)
+	if err != nil || offset == -1 {
+		return record.Record{}, false, err
+	}
+	return r.readAt(offset, key)
+}
+
+// GetLinear is like Get, but searches the Summary table and the page of the Index table linearly,
+// comparing one entry after another, like lookups did before both were binary searched. It's kept
+// as a reference for benchmarks (see wrappertest.LookupBenchmark), and shouldn't be used otherwise.
+func (r *Reader) GetLinear(key []byte) (record.Record, bool, error) {
+	if !r.filter.Query(key) || len(r.summary.entries) == 0 || !r.summary.header.contains(key) {
+		return record.Record{}, false, nil
+	}
+
+	// Summary
+
+	i := 0
+	for i < len(r.summary.entries) && bytes.Compare(key, r.summary.entries[i].Key) > 0 {
+		i++
+	}
+	if i == len(r.summary.entries) {
+		return record.Record{}, false, fmt.Errorf("%w: summary table ends before its max key", record.ErrCorruption)
+	}
+	start := int64(0)
+	if i > 0 {
+		start = r.summary.entries[i-1].Offset
+	}
+
+	// Index
+
+	reader := readerAt(r.index, start)
+	for {
+		ite := indexTableEntry{}
+		err := ite.Read(reader)
+		if err == io.EOF {
+			return record.Record{}, false, nil
+		}
+		if err != nil {
+			return record.Record{}, false, err
+		}
+
+		cmp := bytes.Compare(ite.Key, key)
+		if cmp == 0 || (cmp > 0 && r.meta.Version >= VERSION_V2) {
+			return r.readAt(ite.Offset, key)
+		}
+		if cmp > 0 {
+			return record.Record{}, false, nil
+		}
+	}
+}
+
+// locate goes through the filter, Summary table and Index table to find the offset in the Data
+// table of the record with the specified key, or of the block that may hold it in a v2 or v3
+// table. Returns -1 if the table doesn't hold the key.
+func (r *Reader) locate(key []byte) (int64, error) {
+	// Filter
+
+	if !r.filter.Query(key) {
+		return -1, nil
+	}
+
+	// Summary
+
+	start, end, err := r.summary.findPage(key)
+	if err != nil || start == -1 {
+		return -1, err
+	}
+
+	// Index
+
+	page, err := readIndexPage(r.index, start, end)
+	if err != nil {
+		return -1, err
+	}
+	ite := page.find(key)
+	if r.meta.Version >= VERSION_V2 {
+		ite = page.seek(key)
+	}
+	return ite.Offset, nil
+}
+
+// readAt reads the record with the specified key from the given offset of the Data table, as found
+// by locate.
+func (r *Reader) readAt(offset int64, key []byte) (record.Record, bool, error) {
+	var err error
+
+	// Data
+
+	rec := record.Record{}
+	found := true
+	if r.meta.Version >= VERSION_V2 {
+		rec, found, err = findInBlock(r.data, offset, r.meta.Codec, key)
+	} else {
+		err = rec.DeserializeVersion(readerAt(r.data, offset), r.meta.recordVersion())
+		if err == io.EOF {
+			err = fmt.Errorf("%w: no record at offset %d in %s", record.ErrCorruption, offset, r.files.name(filename.TypeData))
+		}
+	}
+	if err != nil || !found {
+		return record.Record{}, false, err
+	}
+
+	if r.globalSeq != 0 {
+		rec.Seq = r.globalSeq
+	}
+	return rec, true, nil
+}
+
+// Seek returns a DataReader over the records of the table whose keys are greater than or equal to
+// the specified key, in order. The Summary and Index tables are used to start reading close to
+// the first such record, instead of from the start of the Data table.
+// The DataReader reads through the Reader's files, so it must not be used after the Reader is
+// closed. Closing it does nothing.
+func (r *Reader) Seek(key []byte) (*DataReader, error) {
+	offset, err := seekOffset(r.summary, r.index, key)
+	if err != nil {
+		return nil, err
+	}
+	dr := newDataReader(nil, r.data, r.meta, offset)
+	dr.start = key
+	dr.globalSeq = r.globalSeq
+	return dr, nil
+}
+
+// Iterate returns a DataReader over all records of the table, in order. Like with Seek, it must not
+// be used after the Reader is closed.
+func (r *Reader) Iterate() *DataReader {
+	dr := newDataReader(nil, r.data, r.meta, 0)
+	dr.globalSeq = r.globalSeq
+	return dr
+}
+
+// Properties returns the Properties of the table. The key range and greatest sequence number are
+// kept in the Summary table's header, and the rest in the Metadata table of a v3 table. Older tables
+// don't keep them, so the whole Data table is read to find them, and CreatedAt and OriginLevel are
+// left at 0. If a global sequence number is set, it's reported as the greatest one.
+func (r *Reader) Properties() (Properties, error) {
+	props := Properties{}
+	if r.meta.Properties != nil {
+		props = *r.meta.Properties
+	} else {
+		b := newPropertiesBuilder()
+		dr := r.Iterate()
+		for {
+			rec, err := dr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return Properties{}, err
+			}
+			b.add(rec)
+		}
+		props = b.properties()
+	}
+
+	props.MinKey = r.summary.header.MinKey
+	props.MaxKey = r.summary.header.MaxKey
+	props.MaxSeq = r.summary.header.MaxSeq
+	if r.globalSeq != 0 {
+		props.MaxSeq = r.globalSeq
+	}
+	return props, nil
+}
+
+// Verify reads the whole table and checks that it's intact: the blocks of a v2 or v3 table must match
+// their CRCs, the keys must be in strictly ascending order and span the key range kept in the
+// Summary table, no sequence number may be greater than the one kept there, every key must lead
+// to its record (or its block) through the filter, Summary table and Index table, the Merkle tree
+// built from the values must have the root kept in the Metadata table, and so must the Properties
+// of a v3 table match the records. Returns an error wrapping record.ErrCorruption if any of that
+// doesn't hold.
+// Tables written by the engine always pass, so this is meant for tables that come from elsewhere.
+func (r *Reader) Verify() error {
+	fname := r.files.name(filename.TypeData)
+	header := r.summary.header
+	leaves := []merkletree.MerkleNode{}
+	props := newPropertiesBuilder()
+	var last []byte
+
+	dr := newDataReader(nil, r.data, r.meta, 0) // With the sequence numbers kept in the table.
+	for {
+		rec, err := dr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if last == nil && !bytes.Equal(rec.Key, header.MinKey) {
+			return fmt.Errorf("%w: %s starts with key %q, but its Summary table says %q", record.ErrCorruption, fname, rec.Key, header.MinKey)
+		}
+		if last != nil && bytes.Compare(rec.Key, last) <= 0 {
+			return fmt.Errorf("%w: key %q follows key %q in %s", record.ErrCorruption, rec.Key, last, fname)
+		}
+		offset, err := r.locate(rec.Key)
+		if err != nil {
+			return err
+		}
+		if offset != dr.offset {
+			return fmt.Errorf("%w: key %q in %s isn't found through its filter, Summary and Index tables", record.ErrCorruption, rec.Key, fname)
+		}
+		if rec.Seq > header.MaxSeq {
+			return fmt.Errorf("%w: key %q in %s has sequence number %d, but its Summary table says at most %d", record.ErrCorruption, rec.Key, fname, rec.Seq, header.MaxSeq)
+		}
+		leaves = append(leaves, merkletree.NewLeaf(rec.Value))
+		props.add(rec)
+		last = rec.Key
+	}
+
+	if len(leaves) == 0 {
+		return fmt.Errorf("%w: %s holds no records", record.ErrCorruption, fname)
+	}
+	if !bytes.Equal(last, header.MaxKey) {
+		return fmt.Errorf("%w: %s ends with key %q, but its Summary table says %q", record.ErrCorruption, fname, last, header.MaxKey)
+	}
+	tree, err := merkletree.New(leaves)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(tree.Root.Data, r.root) {
+		return fmt.Errorf("%w: values in %s don't match its Merkle tree", record.ErrCorruption, fname)
+	}
+	if r.meta.Properties != nil {
+		want := *r.meta.Properties
+		want.MinKey, want.MaxKey = header.MinKey, header.MaxKey
+		if !sameContents(props.properties(), want) {
+			return fmt.Errorf("%w: records in %s don't match its properties", record.ErrCorruption, fname)
+		}
+	}
+	return nil
+}
+
+// Close closes the files of the table.
+func (r *Reader) Close() error {
+	return r.files.close()
+}
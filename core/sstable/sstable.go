@@ -4,84 +4,157 @@ package sstable
 import (
 	"nakevaleng/core/record"
 	"nakevaleng/ds/bloomfilter"
-	"nakevaleng/ds/merkletree"
 	"nakevaleng/util/filename"
 
 	"bufio"
+	"bytes"
+	"fmt"
+	"io"
 	"os"
 )
 
 // MakeTable creates a new SSTable from the data given in a Memtable through a record.Iterator.
 // You should only use this when flushing a Memtable to a level 1 SStable (minor compaction).
-// For all other cases (i.e. when major compaction happens), use MakeTableSecondaries().
-func MakeTable(path, dbname string, summaryPageSize, level, run int, rit record.Iterator) {
-	makeDataTable(path, dbname, level, run, rit)
-	{
-		keycontexts := []record.KeyContext{}
-		for rec, last := rit(); !last; rec, last = rit() {
-			keycontexts = append(keycontexts, record.KeyContext{
-				Key:     rec.Key,
-				RecSize: rec.TotalSize(),
-			})
+// For all other cases (i.e. when major compaction happens), write the records through a Writer.
+// The table is written in the v3 format, with the blocks of the Data table compressed with codec,
+// in the given layout (LAYOUT_MULTI or LAYOUT_SINGLE).
+// The files are synced to disk before returning, but they're written under their final names, so a
+// crash may leave a partial table behind. Write tables into filename.Staging(path) and move them
+// into place with MoveTable instead.
+func MakeTable(path, dbname string, summaryPageSize, level, run int, codec, layout string, rit record.Iterator) error {
+	w, err := NewWriter(path, dbname, summaryPageSize, level, run, codec, layout)
+	if err != nil {
+		return err
+	}
+
+	for rec, last := rit(); !last; rec, last = rit() {
+		err = w.Add(rec)
+		if err != nil {
+			w.Abort()
+			return err
 		}
-		makeIndexAndSummary(path, dbname, summaryPageSize, level, run, keycontexts)
-		makeFilter(path, dbname, level, run, keycontexts)
 	}
 
-	makeMetadata(path, dbname, level, run, rit)
+	return w.Finish()
 }
 
-// MakeTableSecondaries creates a new SSTable (except for the Data table) based on input parameters.
-func MakeTableSecondaries(path, dbname string, summaryPageSize, level, run int, merkleleaves []merkletree.MerkleNode, keyctx []record.KeyContext) {
-	makeIndexAndSummary(path, dbname, summaryPageSize, level, run, keyctx)
-	makeFilter(path, dbname, level, run, keyctx)
-
-	// MakeTableSecondaries and makeMetadata are the only places where merkletree New is called, so I guess panic here?
-	// In any case, old behaviour was to panic as well (but in merkletree build)
-	merkleTree, err := merkletree.New(merkleleaves)
-	if err != nil {
-		panic(err)
+// MoveTable renames all files of a table, then syncs the directory they were moved into. Used to
+// move a table from the staging directory into place, where it should be added to the manifest
+// only after MoveTable returns. Renames are atomic, so a crash leaves each file either in one
+// place or the other. Files left in the staging directory are removed on startup, and those
+// that made it into place without being added to the manifest are removed as orphans.
+// A table in the single-file layout is moved with a single rename.
+func MoveTable(fromPath, toPath, dbname string, fromLevel, fromRun, toLevel, toRun int) error {
+	for _, ftype := range tableFileTypes(fromPath, dbname, fromLevel, fromRun) {
+		err := os.Rename(
+			filename.Table(fromPath, dbname, fromLevel, fromRun, ftype),
+			filename.Table(toPath, dbname, toLevel, toRun, ftype),
+		)
+		if err != nil {
+			return err
+		}
 	}
 
-	merkleTree.Serialize(filename.Table(path, dbname, level, run, filename.TypeMetadata))
+	return filename.SyncDir(toPath)
 }
 
-func makeFilter(path, dbname string, level, run int, keyctx []record.KeyContext) {
-	bf, _ := bloomfilter.New(len(keyctx), 0.01)
-	for _, kc := range keyctx {
-		bf.Insert(kc.Key)
+// LinkTable adds a table to the directory at toPath under a new name, by hard linking its files,
+// then syncs the directory. Used to take in tables built elsewhere without rewriting them, so
+// their files must not be changed afterwards (removing them is fine). Files that can't be linked,
+// like those on another file system, are copied instead.
+func LinkTable(fromPath, fromDBName string, fromLevel, fromRun int, toPath, toDBName string, toLevel, toRun int) error {
+	for _, ftype := range tableFileTypes(fromPath, fromDBName, fromLevel, fromRun) {
+		from := filename.Table(fromPath, fromDBName, fromLevel, fromRun, ftype)
+		to := filename.Table(toPath, toDBName, toLevel, toRun, ftype)
+
+		err := os.Link(from, to)
+		if err != nil {
+			err = filename.CopyFile(from, to)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	bf.EncodeToFile(filename.Table(path, dbname, level, run, filename.TypeFilter))
+	return filename.SyncDir(toPath)
 }
 
-func makeMetadata(path, dbname string, level, run int, rit record.Iterator) {
-	merkleNodes := make([]merkletree.MerkleNode, 0)
-	{
-		for rec, last := rit(); !last; rec, last = rit() {
-			merkleNodes = append(merkleNodes, merkletree.NewLeaf(rec.Value))
+// RemoveTable removes all files of a table.
+func RemoveTable(path, dbname string, level, run int) error {
+	for _, ftype := range tableFileTypes(path, dbname, level, run) {
+		err := os.Remove(filename.Table(path, dbname, level, run, ftype))
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
+
+// tableFileTypes returns the types of the files a table is made of, depending on its layout.
+func tableFileTypes(path, dbname string, level, run int) []filename.FileType {
+	layout, _ := ReadLayout(path, dbname, level, run)
+	if layout == LAYOUT_SINGLE {
+		return []filename.FileType{filename.TypeTable}
+	}
+	return sectionTypes[:]
+}
+
+// DataSize returns the size of the Data table of an SSTable in bytes, whichever its layout.
+func DataSize(path, dbname string, level, run int) (int64, error) {
+	t, err := openTable(path, dbname, level, run, filename.TypeData)
+	if err != nil {
+		return 0, err
+	}
+	defer t.close()
+	return t.section(filename.TypeData).Size(), nil
+}
 
-	// MakeTableSecondaries and makeMetadata are the only places where merkletree New is called, so I guess panic here?
-	// In any case, old behaviour was to panic as well (but in merkletree build)
-	merkleTree, err := merkletree.New(merkleNodes)
+// ReadFilter reads the Bloom filter of an SSTable, whichever its layout.
+func ReadFilter(path, dbname string, level, run int) (*bloomfilter.BloomFilter, error) {
+	t, err := openTable(path, dbname, level, run, filename.TypeFilter)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	defer t.close()
+	return readFilter(t)
+}
 
-	merkleTree.Serialize(filename.Table(path, dbname, level, run, filename.TypeMetadata))
+// readFilter reads the Bloom filter from the Filter table of an open SSTable. Returns an error
+// wrapping record.ErrCorruption if it can't be decoded.
+func readFilter(t *tableFiles) (*bloomfilter.BloomFilter, error) {
+	buf, err := io.ReadAll(t.section(filename.TypeFilter))
+	if err != nil {
+		return nil, err
+	}
+	bf, err := bloomfilter.DecodeFromBytes(buf)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad filter in %s: %v", record.ErrCorruption, t.name(filename.TypeFilter), err)
+	}
+	return bf, nil
 }
 
-func makeIndexAndSummary(path, dbname string, summaryPageSize, level, run int, keyctx []record.KeyContext) {
-	fnameIndex := filename.Table(path, dbname, level, run, filename.TypeIndex)
-	fnameSummary := filename.Table(path, dbname, level, run, filename.TypeSummary)
+// makeFilter returns the contents of the Filter table: a Bloom filter holding all the keys.
+func makeFilter(keys [][]byte) ([]byte, error) {
+	bf, err := bloomfilter.New(len(keys), 0.01)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		bf.Insert(key)
+	}
 
-	fIndex, _ := os.Create(fnameIndex)
-	wIndex := bufio.NewWriter(fIndex)
+	return bf.EncodeToBytes(), nil
+}
 
-	fSummary, _ := os.Create(fnameSummary)
-	wSummary := bufio.NewWriter(fSummary)
+// makeIndexAndSummary returns the contents of the Index and Summary tables, with an ITE for each
+// of the entries, which describe blocks of the Data table: the Key of each entry is the last key in
+// its block, RecSize is the size of the block and Seq is the greatest sequence number in it.
+// minKey is the first key in the table.
+func makeIndexAndSummary(summaryPageSize int, minKey []byte, keyctx []record.KeyContext) (index, summary []byte, err error) {
+	bufIndex := bytes.Buffer{}
+	wIndex := bufio.NewWriter(&bufIndex)
+	bufSummary := bytes.Buffer{}
+	wSummary := bufio.NewWriter(&bufSummary)
 
 	offsetIndex := int64(0)   // Refers to the offset in a Data table, used in an Index table
 	offsetSummary := int64(0) // Refers to the offset in an Index table, used in a Summary table
@@ -90,20 +163,21 @@ func makeIndexAndSummary(path, dbname string, summaryPageSize, level, run int, k
 	// to put all the entries into memory first and dump them to disk later, because Summary tables
 	// are meant to be small enough to keep in memory when reading (unlike Index tables).
 
-	summaryHeader := summaryTableHeader{}
+	summaryHeader := summaryTableHeader{MinKey: minKey}
 	summaryEntries := make([]summaryTableEntry, 0)
 
 	for i, kc := range keyctx {
-		// First entry holds min key.
-
-		if i == 0 {
-			summaryHeader.MinKey = kc.Key
+		if kc.Seq > summaryHeader.MaxSeq {
+			summaryHeader.MaxSeq = kc.Seq
 		}
 
-		// Write the ITE for this record.
+		// Write the ITE for this block.
 
 		ite := indexTableEntry{KeySize: uint64(len(kc.Key)), Key: kc.Key, Offset: offsetIndex}
-		ite.Write(wIndex)
+		err = ite.Write(wIndex)
+		if err != nil {
+			return nil, nil, err
+		}
 		offsetIndex += int64(kc.RecSize)
 
 		// Create an STE if we've written k ITE's OR this is the last entry in the slice.
@@ -127,13 +201,21 @@ func makeIndexAndSummary(path, dbname string, summaryPageSize, level, run int, k
 
 	summaryHeader.MinKeySize = uint64(len(summaryHeader.MinKey))
 	summaryHeader.MaxKeySize = uint64(len(summaryHeader.MaxKey))
-	summaryHeader.Write(wSummary)
+	err = summaryHeader.Write(wSummary)
+	if err != nil {
+		return nil, nil, err
+	}
 	for _, ste := range summaryEntries {
-		ste.Write(wSummary)
+		err = ste.Write(wSummary)
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	wSummary.Flush()
-	fSummary.Close()
-	wIndex.Flush()
-	fIndex.Close()
+	err = wSummary.Flush()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = wIndex.Flush()
+	return bufIndex.Bytes(), bufSummary.Bytes(), err
 }
@@ -4,8 +4,11 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
-	"os"
+	"nakevaleng/core/record"
+	"nakevaleng/util/filename"
+	"sort"
 )
 
 // summaryTableEntry (STE) is the building block of a Summary Table.
@@ -22,6 +25,7 @@ type summaryTableHeader struct {
 	MinKeySize uint64 // How many bytes does MinKey take
 	MaxKeySize uint64 // How many bytes does MaxKey take
 	Payload    uint64 // How many bytes do all STEs in this table take
+	MaxSeq     uint64 // Greatest sequence number of all records in the corresponding Data table
 	MinKey     []byte // First key in the corresponding Index table
 	MaxKey     []byte // Last key in the corresponding Index table
 }
@@ -33,146 +37,199 @@ func (ste summaryTableEntry) CalcSize() int64 {
 
 // CalcSize returns the total effective size of the STH in bytes.
 func (sth summaryTableHeader) CalcSize() int64 {
-	return int64(8 + 8 + 8 + sth.MinKeySize + sth.MaxKeySize)
+	return int64(8 + 8 + 8 + 8 + sth.MinKeySize + sth.MaxKeySize)
 }
 
 // Write appends the contents of the STE into a binary file. The order of the attributes is:
 //	KeySize, Offset, Key
-func (ste summaryTableEntry) Write(writer *bufio.Writer) {
+func (ste summaryTableEntry) Write(writer *bufio.Writer) error {
 	binary.Write(writer, binary.LittleEndian, ste.KeySize)
 	binary.Write(writer, binary.LittleEndian, ste.Offset)
-	binary.Write(writer, binary.LittleEndian, ste.Key)
+	return binary.Write(writer, binary.LittleEndian, ste.Key)
 }
 
 // Write appends the contents of the STH into a binary file. The order of the attributes is:
-//	MinKeySize, MaxKeySize, Payload, MinKey, MaxKey
-func (sth summaryTableHeader) Write(writer *bufio.Writer) {
+//	MinKeySize, MaxKeySize, Payload, MaxSeq, MinKey, MaxKey
+func (sth summaryTableHeader) Write(writer *bufio.Writer) error {
 	binary.Write(writer, binary.LittleEndian, sth.MinKeySize)
 	binary.Write(writer, binary.LittleEndian, sth.MaxKeySize)
 	binary.Write(writer, binary.LittleEndian, sth.Payload)
+	binary.Write(writer, binary.LittleEndian, sth.MaxSeq)
 	binary.Write(writer, binary.LittleEndian, sth.MinKey)
-	binary.Write(writer, binary.LittleEndian, sth.MaxKey)
+	return binary.Write(writer, binary.LittleEndian, sth.MaxKey)
 }
 
 // Read reads data from a bytes reader into an STE. Old data in the STH is overwritten. The order of
 // the attributes to be read is:
 //	KeySize, Offset, Key
 // KeySize determines how many bytes to read for the Key field.
-// Returns true if an unexpected EOF error is caught (io.EOF or io.ErrUnexpectedEOF).
-func (ste *summaryTableEntry) Read(reader *bufio.Reader) (eof bool) {
+// Returns io.EOF if there are no more STEs, and an error wrapping record.ErrCorruption if the
+// reader ends in the middle of an STE.
+func (ste *summaryTableEntry) Read(reader *bufio.Reader) error {
 	err := binary.Read(reader, binary.LittleEndian, &ste.KeySize)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	if err != nil {
+		return truncated(err, "summary table entry")
 	}
 
 	err = binary.Read(reader, binary.LittleEndian, &ste.Offset)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
-	}
-
-	ste.Key = make([]byte, ste.KeySize)
-	err = binary.Read(reader, binary.LittleEndian, &ste.Key)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	if err != nil {
+		return truncated(err, "summary table entry")
 	}
 
+	ste.Key, err = record.ReadBytes(reader, ste.KeySize)
 	if err != nil {
-		panic(err.Error())
+		return truncated(err, "summary table entry")
 	}
 
-	return false
+	return nil
 }
 
-// Read reads data from a binary file into an STH. Old data in the STH is overwritten. The order of
-// the attributes to be read is:
-//	MinKeySize, MaxKeySize, Payload, MinKey, MaxKey
-// MinKeySize and MaxKeySize determine how many bytes to read for the MinKey and MaxKey field.
-// Returns true if an unexpected EOF error is caught (io.EOF or io.ErrUnexpectedEOF).
-func (sth *summaryTableHeader) Read(reader *bufio.Reader) bool {
-	err := binary.Read(reader, binary.LittleEndian, &sth.MinKeySize)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+// Read reads data from a binary file into an STH of a table of the given version. Old data in the
+// STH is overwritten. The order of the attributes to be read is:
+//	MinKeySize, MaxKeySize, Payload, MaxSeq, MinKey, MaxKey
+// MinKeySize and MaxKeySize determine how many bytes to read for the MinKey and MaxKey field. A v0
+// table keeps no MaxSeq, so it's left at 0.
+// Every Summary Table starts with an STH, so running out of data at any point returns an error
+// wrapping record.ErrCorruption.
+func (sth *summaryTableHeader) Read(reader *bufio.Reader, version int) error {
+	fields := []interface{}{&sth.MinKeySize, &sth.MaxKeySize, &sth.Payload, &sth.MaxSeq}
+	if version == VERSION_V0 {
+		sth.MaxSeq = 0
+		fields = fields[:3]
 	}
-
-	err = binary.Read(reader, binary.LittleEndian, &sth.MaxKeySize)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	for _, field := range fields {
+		err := binary.Read(reader, binary.LittleEndian, field)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return fmt.Errorf("%w: summary table header cut short", record.ErrCorruption)
+		}
+		if err != nil {
+			return err
+		}
 	}
 
-	err = binary.Read(reader, binary.LittleEndian, &sth.Payload)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	var err error
+	sth.MinKey, err = record.ReadBytes(reader, sth.MinKeySize)
+	if err == nil {
+		sth.MaxKey, err = record.ReadBytes(reader, sth.MaxKeySize)
 	}
-
-	sth.MinKey = make([]byte, sth.MinKeySize)
-	sth.MaxKey = make([]byte, sth.MaxKeySize)
-
-	err = binary.Read(reader, binary.LittleEndian, &sth.MinKey)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: summary table header cut short", record.ErrCorruption)
 	}
+	return err
+}
 
-	err = binary.Read(reader, binary.LittleEndian, &sth.MaxKey)
-	if err == io.EOF || err == io.ErrUnexpectedEOF {
-		return true
-	}
+// summary is a Summary Table loaded into memory. The STEs are sorted by key, so they can be binary
+// searched.
+type summary struct {
+	header  summaryTableHeader
+	entries []summaryTableEntry
+}
+
+// readSummary reads a whole Summary Table of a table of the given version into memory.
+func readSummary(summaryTable io.Reader, version int) (summary, error) {
+	r := bufio.NewReader(summaryTable)
 
+	s := summary{}
+	err := s.header.Read(r, version)
 	if err != nil {
-		panic(err.Error())
+		return summary{}, err
 	}
-
-	return false
+	s.entries, err = readSummaryTableEntries(r, s.header.Payload)
+	return s, err
 }
 
-// FindSummaryTableEntry searches a Summary Table, looking for an STE with the specified key.
-// If no STE with the desired key is found, the return value's Offset field equals -1.
-func FindSummaryTableEntry(summaryTableFname string, key []byte) summaryTableEntry {
-	f, err := os.Open(summaryTableFname)
-	if err != nil {
-		panic(err)
+// findPage returns the range of bytes in the Index table that may hold the key, or -1 for start if
+// the key is out of the table's range.
+// The page begins at the last STE whose key is less than the specified key, and ends with the ITE
+// of the next STE, whose key is greater than or equal to it. Both are found with a binary search.
+// An STE is laid out like the ITE it points to, so the two take up the same number of bytes.
+func (s summary) findPage(key []byte) (start, end int64, err error) {
+	if len(s.entries) == 0 || !s.header.contains(key) {
+		return -1, -1, nil
 	}
-	defer f.Close()
-	r := bufio.NewReader(f)
-
-	// Header and range check.
-
-	sth := summaryTableHeader{}
-	sth.Read(r)
 
-	cmp := bytes.Compare(sth.MinKey, key)
-	if cmp > 0 {
-		return summaryTableEntry{Offset: -1}
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return bytes.Compare(key, s.entries[i].Key) <= 0
+	})
+	if i == len(s.entries) {
+		return 0, 0, fmt.Errorf("%w: summary table ends before its max key", record.ErrCorruption)
 	}
-	cmp = bytes.Compare(key, sth.MaxKey)
-	if cmp > 0 {
-		return summaryTableEntry{Offset: -1}
+
+	if i > 0 {
+		start = s.entries[i-1].Offset
 	}
+	end = s.entries[i].Offset + s.entries[i].CalcSize()
+	return start, end, nil
+}
 
-	// Load all STEs into memory and read from them.
+// contains returns true if the key falls in the range of the Index table.
+func (sth summaryTableHeader) contains(key []byte) bool {
+	return bytes.Compare(sth.MinKey, key) <= 0 && bytes.Compare(key, sth.MaxKey) <= 0
+}
 
-	buf := make([]byte, sth.Payload)
-	_, err = io.ReadFull(r, buf)
+// readSummaryTableEntries reads all STEs of a Summary Table, which take up payload bytes right
+// after the STH. The STEs are decoded straight from the payload, since it's already in memory.
+func readSummaryTableEntries(r *bufio.Reader, payload uint64) ([]summaryTableEntry, error) {
+	buf, err := record.ReadBytes(r, payload)
+	if err == io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("%w: summary table cut short", record.ErrCorruption)
+	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	r = bufio.NewReader(bytes.NewBuffer(buf))
-	var goodSte summaryTableEntry
-	ste := summaryTableEntry{}
+	stes := []summaryTableEntry{}
 
-	for {
-		goodSte = ste
-		if ste.Read(r) {
-			ste.Offset = -1
-			break
+	for len(buf) > 0 {
+		if len(buf) < 16 {
+			return nil, fmt.Errorf("%w: summary table entry cut short", record.ErrCorruption)
 		}
+		ste := summaryTableEntry{
+			KeySize: binary.LittleEndian.Uint64(buf),
+			Offset:  int64(binary.LittleEndian.Uint64(buf[8:])),
+		}
+		if ste.KeySize > uint64(len(buf)-16) {
+			return nil, fmt.Errorf("%w: summary table entry cut short", record.ErrCorruption)
+		}
+		ste.Key = buf[16 : 16+ste.KeySize]
+		stes = append(stes, ste)
+		buf = buf[ste.CalcSize():]
+	}
 
-		cmp := bytes.Compare(key, ste.Key)
+	return stes, nil
+}
 
-		if cmp <= 0 {
-			break
-		}
+// readSummaryTableHeader reads the STH at the start of the Summary Table of an SSTable.
+func readSummaryTableHeader(path, dbname string, level, run int) (summaryTableHeader, error) {
+	t, err := openTable(path, dbname, level, run, filename.TypeSummary, filename.TypeMetadata)
+	if err != nil {
+		return summaryTableHeader{}, err
 	}
+	defer t.close()
+	meta, err := readMetadata(t)
+	if err != nil {
+		return summaryTableHeader{}, err
+	}
+
+	sth := summaryTableHeader{}
+	err = sth.Read(bufio.NewReader(t.section(filename.TypeSummary)), meta.Version)
+	return sth, err
+}
+
+// ReadKeyRange returns the first and the last key of an SSTable, as found in the header of its
+// Summary table.
+//	path    `path to the directory where the table is located`
+//	dbname  `name of the database`
+//	level   `lsm tree level the table belongs to`
+//	run     `ordinal number of the run on the given level for the table`
+func ReadKeyRange(path, dbname string, level, run int) (minKey, maxKey []byte, err error) {
+	sth, err := readSummaryTableHeader(path, dbname, level, run)
+	return sth.MinKey, sth.MaxKey, err
+}
 
-	return goodSte
+// ReadMaxSeq returns the greatest sequence number of all records in an SSTable, as found in the
+// header of its Summary table. The params are the same as for ReadKeyRange.
+func ReadMaxSeq(path, dbname string, level, run int) (uint64, error) {
+	sth, err := readSummaryTableHeader(path, dbname, level, run)
+	return sth.MaxSeq, err
 }
@@ -0,0 +1,198 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"nakevaleng/core/record"
+	"nakevaleng/util/filename"
+	"os"
+)
+
+// Layouts an SSTable can be written in.
+const (
+	LAYOUT_MULTI  = "multi"  // Each table in a file of its own.
+	LAYOUT_SINGLE = "single" // All tables in one file, as sections, followed by a footer.
+)
+
+// FOOTER_MAGIC is written at the very end of every single-file SSTable.
+const FOOTER_MAGIC = "NKVFOOTR"
+
+// sectionTypes are the tables kept as sections of a single-file SSTable, in the order in which
+// they're written.
+var sectionTypes = [...]filename.FileType{
+	filename.TypeData,
+	filename.TypeIndex,
+	filename.TypeSummary,
+	filename.TypeFilter,
+	filename.TypeMetadata,
+}
+
+// footerSize is the size of the footer of a single-file SSTable in bytes:
+//	Offset and Size of each section (8 + 8 bytes each, in the order of sectionTypes),
+//	Version (4 bytes), CRC of everything before it (4 bytes), FOOTER_MAGIC
+const footerSize = len(sectionTypes)*(8+8) + 4 + 4 + len(FOOTER_MAGIC)
+
+// section is the range of bytes a table takes up in a single-file SSTable.
+type section struct {
+	Offset int64
+	Size   int64
+}
+
+// ValidateLayout returns an error if the layout isn't one of LAYOUT_MULTI or LAYOUT_SINGLE.
+func ValidateLayout(layout string) error {
+	switch layout {
+	case LAYOUT_MULTI, LAYOUT_SINGLE:
+		return nil
+	}
+	err := fmt.Errorf("layout must be \"%s\" or \"%s\", but \"%s\" was given", LAYOUT_MULTI, LAYOUT_SINGLE, layout)
+	return err
+}
+
+// ReadLayout returns the layout of an SSTable, telling them apart by the files that are there.
+func ReadLayout(path, dbname string, level, run int) (string, error) {
+	_, err := os.Stat(filename.Table(path, dbname, level, run, filename.TypeTable))
+	if err == nil {
+		return LAYOUT_SINGLE, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	return LAYOUT_MULTI, nil
+}
+
+// tableFiles gives access to the tables of an SSTable, whichever its layout. In the multi-file
+// layout each table is a file, while in the single-file layout each is a section of one file. In
+// both cases, a table is read through a SectionReader, so it starts at offset 0.
+type tableFiles struct {
+	files    []*os.File
+	sections map[filename.FileType]*io.SectionReader
+	names    map[filename.FileType]string // Of the file holding each table, for error messages.
+}
+
+// openTable opens the given tables of an SSTable. In the single-file layout the footer is read to
+// find them, and an error wrapping record.ErrCorruption is returned if it's damaged.
+func openTable(path, dbname string, level, run int, ftypes ...filename.FileType) (*tableFiles, error) {
+	t := &tableFiles{
+		sections: map[filename.FileType]*io.SectionReader{},
+		names:    map[filename.FileType]string{},
+	}
+
+	f, err := os.Open(filename.Table(path, dbname, level, run, filename.TypeTable))
+	if err == nil {
+		t.files = append(t.files, f)
+		sections, err := readFooter(f)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		for i, ftype := range sectionTypes {
+			t.sections[ftype] = io.NewSectionReader(f, sections[i].Offset, sections[i].Size)
+			t.names[ftype] = f.Name() + " (" + ftype.String() + ")"
+		}
+		return t, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	for _, ftype := range ftypes {
+		f, err := os.Open(filename.Table(path, dbname, level, run, ftype))
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.files = append(t.files, f)
+
+		stat, err := f.Stat()
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.sections[ftype] = io.NewSectionReader(f, 0, stat.Size())
+		t.names[ftype] = f.Name()
+	}
+	return t, nil
+}
+
+// section returns the table of the given type, which must have been opened with openTable.
+func (t *tableFiles) section(ftype filename.FileType) *io.SectionReader {
+	return t.sections[ftype]
+}
+
+// name returns the name of the file holding the table of the given type, for error messages.
+func (t *tableFiles) name(ftype filename.FileType) string {
+	return t.names[ftype]
+}
+
+// close closes all files of the SSTable.
+func (t *tableFiles) close() error {
+	var err error
+	for _, f := range t.files {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// readFooter reads the footer at the end of a single-file SSTable, and returns the sections it
+// lists, in the order of sectionTypes.
+func readFooter(f *os.File) ([]section, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() < int64(footerSize) {
+		return nil, fmt.Errorf("%w: %s is too small to hold a footer", record.ErrCorruption, f.Name())
+	}
+
+	footer := make([]byte, footerSize)
+	_, err = f.ReadAt(footer, stat.Size()-int64(footerSize))
+	if err != nil {
+		return nil, err
+	}
+
+	crcAt := footerSize - len(FOOTER_MAGIC) - 4
+	if string(footer[crcAt+4:]) != FOOTER_MAGIC {
+		return nil, fmt.Errorf("%w: bad footer magic in %s", record.ErrCorruption, f.Name())
+	}
+	if crc32.ChecksumIEEE(footer[:crcAt]) != binary.LittleEndian.Uint32(footer[crcAt:]) {
+		return nil, fmt.Errorf("%w: bad footer checksum in %s", record.ErrCorruption, f.Name())
+	}
+	version := binary.LittleEndian.Uint32(footer[crcAt-4:])
+	if version > VERSION_V3 {
+		return nil, fmt.Errorf("sstable: %s has version %d, only versions up to %d are supported", f.Name(), version, VERSION_V3)
+	}
+	if version < VERSION_V2 {
+		return nil, fmt.Errorf("%w: bad footer version %d in %s", record.ErrCorruption, version, f.Name())
+	}
+
+	sections := make([]section, len(sectionTypes))
+	end := stat.Size() - int64(footerSize)
+	for i := range sections {
+		sections[i].Offset = int64(binary.LittleEndian.Uint64(footer[i*16:]))
+		sections[i].Size = int64(binary.LittleEndian.Uint64(footer[i*16+8:]))
+		if sections[i].Offset < 0 || sections[i].Size < 0 || sections[i].Offset+sections[i].Size > end {
+			return nil, fmt.Errorf("%w: footer of %s points past its end", record.ErrCorruption, f.Name())
+		}
+	}
+	return sections, nil
+}
+
+// encodeFooter returns the footer of a single-file SSTable with the given sections, in the order
+// of sectionTypes.
+func encodeFooter(sections []section, version int) []byte {
+	footer := make([]byte, footerSize)
+	for i, s := range sections {
+		binary.LittleEndian.PutUint64(footer[i*16:], uint64(s.Offset))
+		binary.LittleEndian.PutUint64(footer[i*16+8:], uint64(s.Size))
+	}
+	crcAt := footerSize - len(FOOTER_MAGIC) - 4
+	binary.LittleEndian.PutUint32(footer[crcAt-4:], uint32(version))
+	binary.LittleEndian.PutUint32(footer[crcAt:], crc32.ChecksumIEEE(footer[:crcAt]))
+	copy(footer[crcAt+4:], FOOTER_MAGIC)
+	return footer
+}
@@ -0,0 +1,254 @@
+package sstable
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"nakevaleng/core/record"
+	"nakevaleng/ds/merkletree"
+	"nakevaleng/util/filename"
+	"os"
+	"time"
+)
+
+// Writer writes a new SSTable in the v3 format, one record at a time. Records must be added in
+// strictly ascending order of their keys, which Add checks. The Data table is written as records
+// are added, a block at a time, while the other tables are written by Finish: into files of their
+// own, or after the Data table in the same file, depending on the layout. The table's Properties
+// are gathered along the way, and kept in the Metadata table.
+// Both flushes (see MakeTable) and compactions write their tables through a Writer.
+type Writer struct {
+	path            string
+	dbname          string
+	summaryPageSize int
+	level           int
+	run             int
+	codec           string
+	layout          string
+
+	f      *os.File
+	w      *bufio.Writer
+	size   uint64       // Bytes written to the Data table so far.
+	block  bytes.Buffer // Records of the block being filled.
+	last   record.KeyContext
+	minKey []byte
+	blocks []record.KeyContext // For each block: its last key, size in the Data table and greatest sequence number.
+	keys   [][]byte            // Keys of all records, for the filter.
+	leaves []merkletree.MerkleNode
+	props  *propertiesBuilder
+}
+
+// NewWriter creates the Data table of a new SSTable and returns a Writer for it.
+//	path    `path to the directory where the table will be created`
+//	dbname  `name of the database`
+//	level   `lsm tree level this table belongs to`
+//	run     `ordinal number of the run on the given level for this table`
+//	codec   `codec to compress the blocks of the Data table with`
+//	layout  `LAYOUT_MULTI or LAYOUT_SINGLE`
+func NewWriter(path, dbname string, summaryPageSize, level, run int, codec, layout string) (*Writer, error) {
+	err := ValidateCodec(codec)
+	if err != nil {
+		return nil, err
+	}
+	err = ValidateLayout(layout)
+	if err != nil {
+		return nil, err
+	}
+
+	ftype := filename.TypeData
+	if layout == LAYOUT_SINGLE {
+		ftype = filename.TypeTable
+	}
+	f, err := os.Create(filename.Table(path, dbname, level, run, ftype))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		path:            path,
+		dbname:          dbname,
+		summaryPageSize: summaryPageSize,
+		level:           level,
+		run:             run,
+		codec:           codec,
+		layout:          layout,
+		f:               f,
+		w:               bufio.NewWriter(f),
+		props:           newPropertiesBuilder(),
+	}, nil
+}
+
+// Add appends a record to the table. Once the block being filled reaches BLOCK_SIZE bytes, it's
+// compressed and written to the Data table. Returns an error if the key isn't greater than the key
+// of the record added before it, since the Summary and Index tables are binary searched.
+func (w *Writer) Add(rec record.Record) error {
+	if len(w.keys) > 0 && bytes.Compare(rec.Key, w.keys[len(w.keys)-1]) <= 0 {
+		return fmt.Errorf("sstable: key %q added after key %q, keys must be in strictly ascending order", rec.Key, w.keys[len(w.keys)-1])
+	}
+	if w.minKey == nil {
+		w.minKey = rec.Key
+	}
+
+	w.block.Write(rec.ToBytes())
+	w.last.Key = rec.Key
+	if rec.Seq > w.last.Seq {
+		w.last.Seq = rec.Seq
+	}
+	w.keys = append(w.keys, rec.Key)
+	w.leaves = append(w.leaves, merkletree.NewLeaf(rec.Value))
+	w.props.add(rec)
+
+	if w.block.Len() >= BLOCK_SIZE {
+		return w.flushBlock()
+	}
+	return nil
+}
+
+// Abort closes the table without finishing it. The files written so far are left behind, for the
+// caller to remove (or for the cleanup of the staging directory to take care of).
+func (w *Writer) Abort() {
+	w.f.Close()
+}
+
+// Size returns the number of bytes the Data table takes so far, counting the block being filled
+// as if it weren't compressed.
+func (w *Writer) Size() uint64 {
+	return w.size + uint64(w.block.Len())
+}
+
+// flushBlock compresses the block being filled and writes it to the Data table.
+func (w *Writer) flushBlock() error {
+	if w.block.Len() == 0 {
+		return nil
+	}
+
+	block, err := encodeBlock(w.codec, w.block.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(block)
+	if err != nil {
+		return err
+	}
+
+	w.last.RecSize = uint64(len(block))
+	w.blocks = append(w.blocks, w.last)
+	w.size += uint64(len(block))
+	w.block.Reset()
+	w.last = record.KeyContext{}
+	return nil
+}
+
+// Finish writes the last block, then creates the Index, Summary, Filter and Metadata tables and
+// syncs all files of the table. If no records were added, it closes the table like Abort and
+// returns an error.
+func (w *Writer) Finish() error {
+	if len(w.keys) == 0 {
+		w.Abort()
+		return fmt.Errorf("sstable: can't finish a table without records")
+	}
+
+	err := w.flushBlock()
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	tables, err := w.secondaryTables()
+	if err != nil {
+		w.Abort()
+		return err
+	}
+
+	if w.layout == LAYOUT_SINGLE {
+		return w.finishSingle(tables)
+	}
+	return w.finishMulti(tables)
+}
+
+// secondaryTables returns the contents of the Index, Summary, Filter and Metadata tables, in the
+// order of sectionTypes.
+func (w *Writer) secondaryTables() ([][]byte, error) {
+	index, summary, err := makeIndexAndSummary(w.summaryPageSize, w.minKey, w.blocks)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := makeFilter(w.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := merkletree.New(w.leaves)
+	if err != nil {
+		return nil, err
+	}
+	props := w.props.properties()
+	props.CreatedAt = time.Now().Unix()
+	props.OriginLevel = w.level
+	metadata, err := encodeMetadata(Metadata{Version: VERSION_V3, Codec: w.codec, Properties: &props}, tree)
+	if err != nil {
+		return nil, err
+	}
+
+	return [][]byte{index, summary, filter, metadata}, nil
+}
+
+// finishSingle appends the tables to the file after the Data table, followed by the footer, then
+// syncs and closes it.
+func (w *Writer) finishSingle(tables [][]byte) error {
+	sections := []section{{Offset: 0, Size: int64(w.size)}}
+	offset := int64(w.size)
+	for _, table := range tables {
+		w.w.Write(table)
+		sections = append(sections, section{Offset: offset, Size: int64(len(table))})
+		offset += int64(len(table))
+	}
+	w.w.Write(encodeFooter(sections, VERSION_V3))
+
+	return w.closeFile()
+}
+
+// finishMulti syncs and closes the Data table, then writes each of the tables into a file of its
+// own.
+func (w *Writer) finishMulti(tables [][]byte) error {
+	err := w.closeFile()
+	if err != nil {
+		return err
+	}
+
+	for i, table := range tables {
+		err = writeFile(filename.Table(w.path, w.dbname, w.level, w.run, sectionTypes[i+1]), table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// closeFile flushes the file being written to disk and closes it.
+func (w *Writer) closeFile() error {
+	err := w.w.Flush()
+	if err == nil {
+		err = w.f.Sync()
+	}
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeFile creates a file holding the given bytes and flushes it to disk.
+func writeFile(fname string, buf []byte) error {
+	f, err := os.Create(fname)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,327 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"nakevaleng/core/record"
+	"os"
+)
+
+// SEGMENT_MAGIC is written at the start of every segment. Segments without it were written before
+// frames were introduced, and hold records back to back; they can still be read.
+const SEGMENT_MAGIC = "NKVWALF1"
+
+// Each record is written into a segment as one or more frames. A frame looks like this:
+//	CRC (4 bytes), Length (4 bytes), Type (1 byte), Payload (Length bytes)
+// The CRC covers everything that follows it. The payloads of a record's frames, put together, are
+// the serialized record. A record that doesn't fit into the rest of the last segment is split up:
+// its first frame is written there, and the rest go into the segments that follow.
+const FRAME_HEADER_SIZE = 4 + 4 + 1
+
+// Types of frames. Zero is left out, so a zeroed tail is never mistaken for a frame.
+const (
+	FRAME_FULL   = 1 // The whole record.
+	FRAME_FIRST  = 2 // The first fragment of a record.
+	FRAME_MIDDLE = 3 // Neither the first nor the last fragment of a record.
+	FRAME_LAST   = 4 // The last fragment of a record.
+)
+
+// frame is a record, or a fragment of one, as read from a segment.
+type frame struct {
+	Type    uint8
+	Payload []byte
+	Size    int64 // Number of bytes the frame takes up in the segment.
+}
+
+// appendFrame appends a frame with the given type and payload to data.
+func appendFrame(data []byte, frameType uint8, payload []byte) []byte {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	binary.LittleEndian.PutUint32(header[4:], uint32(len(payload)))
+	header[8] = frameType
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(payload)
+	binary.LittleEndian.PutUint32(header[0:], crc.Sum32())
+
+	data = append(data, header...)
+	return append(data, payload...)
+}
+
+// frameType returns the type of a record's frame, depending on whether it holds the start or the
+// end of the record.
+func frameType(first, last bool) uint8 {
+	switch {
+	case first && last:
+		return FRAME_FULL
+	case first:
+		return FRAME_FIRST
+	case last:
+		return FRAME_LAST
+	}
+	return FRAME_MIDDLE
+}
+
+// Formats a segment can be in.
+type segmentFormat int
+
+const (
+	segmentFramed   segmentFormat = iota // Frames, following SEGMENT_MAGIC.
+	segmentLegacy                        // Records back to back, from before frames were introduced.
+	segmentLegacyV0                      // Like segmentLegacy, with records in RECORD_VERSION_V0.
+)
+
+// recordVersion returns the version of the encoding of the records in a segment of the format.
+func (format segmentFormat) recordVersion() int {
+	if format == segmentLegacyV0 {
+		return record.RECORD_VERSION_V0
+	}
+	return record.RECORD_VERSION_V1
+}
+
+// hasMagic returns whether the segment of the given size starts with SEGMENT_MAGIC.
+func hasMagic(segment io.ReaderAt, size int64) (bool, error) {
+	if size < int64(len(SEGMENT_MAGIC)) {
+		return false, nil
+	}
+	magic := make([]byte, len(SEGMENT_MAGIC))
+	_, err := segment.ReadAt(magic, 0)
+	return string(magic) == SEGMENT_MAGIC, err
+}
+
+// readFormat returns the format of the segment of the given size. A legacy segment doesn't say
+// which version its records are encoded in, so its first record is read in each of them, and the
+// one it passes its checksum in is picked. If it passes in neither, an error wrapping
+// record.ErrCorruption is returned, since there's no telling where the segment's intact records
+// end. An empty legacy segment holds no records, so either version will do.
+func readFormat(segment io.ReaderAt, size int64, segmentPath string) (segmentFormat, error) {
+	framed, err := hasMagic(segment, size)
+	if err != nil {
+		return segmentLegacy, err
+	}
+	if framed {
+		return segmentFramed, nil
+	}
+	if size == 0 {
+		return segmentLegacy, nil
+	}
+
+	for _, format := range []segmentFormat{segmentLegacy, segmentLegacyV0} {
+		_, ok, err := readLegacyFrame(segment, 0, size, format.recordVersion())
+		if err != nil {
+			return segmentLegacy, err
+		}
+		if ok {
+			return format, nil
+		}
+	}
+	return segmentLegacy, fmt.Errorf("%w: can't read the first record of %s", record.ErrCorruption, segmentPath)
+}
+
+// readFrame reads the frame at the offset of a segment, which has to end before limit. Returns
+// false if there's no intact frame there: it's incomplete, fails its checksum or has an unknown
+// type. Only failing to read the segment is an error.
+// The length in the header is checked before anything else, so a torn length can't make us read
+// past the limit.
+// In a legacy segment (one without SEGMENT_MAGIC), each record is read as a FRAME_FULL frame.
+func readFrame(segment io.ReaderAt, offset, limit int64, format segmentFormat) (frame, bool, error) {
+	if format != segmentFramed {
+		return readLegacyFrame(segment, offset, limit, format.recordVersion())
+	}
+
+	if limit-offset < FRAME_HEADER_SIZE {
+		return frame{}, false, nil
+	}
+	header := make([]byte, FRAME_HEADER_SIZE)
+	_, err := segment.ReadAt(header, offset)
+	if err != nil {
+		return frame{}, false, err
+	}
+
+	length := binary.LittleEndian.Uint32(header[4:8])
+	frameType := header[8]
+	if int64(length) > limit-offset-FRAME_HEADER_SIZE {
+		return frame{}, false, nil
+	}
+	if frameType < FRAME_FULL || frameType > FRAME_LAST {
+		return frame{}, false, nil
+	}
+
+	payload := make([]byte, length)
+	_, err = segment.ReadAt(payload, offset+FRAME_HEADER_SIZE)
+	if err != nil {
+		return frame{}, false, err
+	}
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(payload)
+	if crc.Sum32() != binary.LittleEndian.Uint32(header[0:4]) {
+		return frame{}, false, nil
+	}
+
+	return frame{Type: frameType, Payload: payload, Size: FRAME_HEADER_SIZE + int64(length)}, true, nil
+}
+
+// readLegacyFrame is readFrame for segments written before frames were introduced, which hold
+// records back to back, encoded in the given version. Returns false if the record is incomplete or
+// fails its checksum.
+func readLegacyFrame(segment io.ReaderAt, offset, limit int64, version int) (frame, bool, error) {
+	headerSize := int64(record.HeaderSize(version))
+	if limit-offset < headerSize {
+		return frame{}, false, nil
+	}
+	header := make([]byte, headerSize)
+	_, err := segment.ReadAt(header, offset)
+	if err != nil {
+		return frame{}, false, err
+	}
+	if !fitsRecord(header, uint64(limit-offset), version) {
+		return frame{}, false, nil
+	}
+
+	keySize, valSize := recordSizes(header)
+	data := make([]byte, uint64(headerSize)+keySize+valSize)
+	_, err = segment.ReadAt(data, offset)
+	if err != nil {
+		return frame{}, false, err
+	}
+	rec := record.Record{}
+	if rec.DeserializeVersion(bufio.NewReader(bytes.NewReader(data)), version) != nil {
+		return frame{}, false, nil
+	}
+
+	return frame{Type: FRAME_FULL, Payload: data, Size: int64(len(data))}, true, nil
+}
+
+// scanSegment reads frames from the segment until the end of the file or the first frame that
+// isn't intact. Returns the number of bytes the intact frames take up (along with SEGMENT_MAGIC)
+// and the size of the segment. A torn or corrupt frame is not an error; failing to read the segment
+// is.
+func scanSegment(segmentPath string) (validSize int64, size int64, err error) {
+	file, err := os.Open(segmentPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size = stat.Size()
+
+	format, err := readFormat(file, size, segmentPath)
+	if err != nil {
+		return 0, 0, err
+	}
+	if format == segmentFramed {
+		validSize = int64(len(SEGMENT_MAGIC))
+	}
+	for {
+		f, ok, err := readFrame(file, validSize, size, format)
+		if err != nil {
+			return 0, 0, err
+		}
+		if !ok {
+			break
+		}
+		validSize += f.Size
+	}
+
+	return validSize, size, nil
+}
+
+// fitsRecord returns whether size bytes are enough to hold the record whose header is at the start
+// of data, going by the key and value sizes in it. The record is encoded in the given version.
+func fitsRecord(data []byte, size uint64, version int) bool {
+	headerSize := record.HeaderSize(version)
+	if uint64(len(data)) < headerSize || size < headerSize {
+		return false
+	}
+	keySize, valSize := recordSizes(data[:headerSize])
+	available := size - headerSize
+	return keySize <= available && valSize <= available-keySize
+}
+
+// recordSizes returns the key and value sizes kept at the end of a record's header, in either
+// version.
+func recordSizes(header []byte) (keySize, valSize uint64) {
+	keySize = binary.LittleEndian.Uint64(header[len(header)-16:])
+	valSize = binary.LittleEndian.Uint64(header[len(header)-8:])
+	return keySize, valSize
+}
+
+// assembler puts records back together from the frames of one or more segments, read in order.
+type assembler struct {
+	started   bool   // Whether a FRAME_FULL or FRAME_FIRST frame was read yet.
+	inRecord  bool   // Whether the frames of a record are being put together.
+	record    []byte // Payloads of the frames read so far for that record.
+	frameSize int64  // Number of bytes those frames take up.
+	discarded int64  // Number of bytes of frames that didn't add up to a record.
+}
+
+// add takes the next frame and returns the serialized record it completes, if it does.
+// A record that's interrupted by the start of another one was torn by a crash, so its frames are
+// discarded. The same goes for the fragments of a record whose start is missing, unless they come
+// before any record has started: then they're the rest of a record in a segment that has since been
+// removed.
+func (a *assembler) add(f frame) ([]byte, bool) {
+	switch f.Type {
+	case FRAME_FULL:
+		a.drop()
+		a.started = true
+		return f.Payload, true
+	case FRAME_FIRST:
+		a.drop()
+		a.started = true
+		a.inRecord = true
+		a.record = append([]byte{}, f.Payload...)
+		a.frameSize = f.Size
+		return nil, false
+	}
+
+	if !a.inRecord {
+		if a.started {
+			a.discarded += f.Size
+		}
+		return nil, false
+	}
+	a.record = append(a.record, f.Payload...)
+	a.frameSize += f.Size
+	if f.Type == FRAME_MIDDLE {
+		return nil, false
+	}
+
+	rec := a.record
+	a.inRecord = false
+	a.record = nil
+	return rec, true
+}
+
+// drop discards the frames of the record being put together, if any.
+func (a *assembler) drop() {
+	if a.inRecord {
+		a.discarded += a.frameSize
+	}
+	a.inRecord = false
+	a.record = nil
+}
+
+// decodeRecord deserializes a record put together by an assembler, encoded in the given version.
+// Since its frames passed their checksums, a record that can't be deserialized means the WAL is
+// damaged in a way frames can't tell, so an error wrapping record.ErrCorruption is returned.
+func decodeRecord(data []byte, version int, segmentPath string) (record.Record, error) {
+	if !fitsRecord(data, uint64(len(data)), version) {
+		return record.Record{}, fmt.Errorf("%w: bad record in %s", record.ErrCorruption, segmentPath)
+	}
+	rec := record.Record{}
+	err := rec.DeserializeVersion(bufio.NewReader(bytes.NewReader(data)), version)
+	if err != nil || uint64(len(data)) != record.HeaderSize(version)+rec.KeySize+rec.ValueSize {
+		return record.Record{}, fmt.Errorf("%w: bad record in %s", record.ErrCorruption, segmentPath)
+	}
+	return rec, nil
+}
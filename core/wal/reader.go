@@ -0,0 +1,282 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"nakevaleng/core/record"
+	"nakevaleng/util/filename"
+	"os"
+	"sync"
+)
+
+// ErrSegmentRemoved is returned by a Reader that has to read a segment which is no longer in the
+// WAL (nor in its archive), for example because its records were flushed in the meantime.
+var ErrSegmentRemoved = errors.New("wal: segment removed")
+
+// Position is a point in the WAL: an offset into the segment with the given ID.
+type Position struct {
+	Segment int
+	Offset  int64
+}
+
+// Reader streams the records of a WAL from a given position, one frame at a time, so that only the
+// record being read is held in memory. Batch markers are handed out like any other record.
+// A Reader of a WAL that's being appended to only reads what the appends have finished writing,
+// which may not have been synced yet. In follow mode, once it reaches the end of the WAL, it waits
+// for more records to be appended instead of returning io.EOF.
+// Whatever follows the last intact frame of a segment is skipped, as are the frames of records cut
+// short by it. The number of bytes skipped is kept, see Discarded.
+type Reader struct {
+	paths  []string // Directories where segments are looked for, in order.
+	dbname string
+	wal    *WAL // Nil when nothing is appended to the WAL while it's read.
+	follow bool
+	last   int // ID of the last segment to read, or -1 to read them all.
+
+	mu        sync.Mutex
+	closed    bool
+	file      *os.File      // Segment being read, if it's open.
+	format    segmentFormat // Of that segment.
+	sealed    int64         // Size of that segment, once nothing can be appended to it, or -1.
+	next      Position      // Of the next frame.
+	pos       Position      // Right after the last record handed out.
+	a         assembler
+	discarded int64
+
+	stopped bool // Set by Close, so a waiting Next gives up. Guarded by wal.syncMu.
+}
+
+// NewReader returns a Reader over the WAL, starting from the given position, which should be
+// either a position returned by Reader.Position, or the start or the end of the WAL (see Bounds).
+// Unlike the rest of the WAL, it's safe to call and use the Reader while other goroutines keep
+// appending. Segments that were moved into the archive directory (see SetArchivePath) are read
+// from there.
+// Returns an error if the position is past the end of the WAL.
+func (wal *WAL) NewReader(from Position, follow bool) (*Reader, error) {
+	wal.syncMu.Lock()
+	end := wal.end
+	wal.syncMu.Unlock()
+
+	if from.Segment > end.Segment || (from.Segment == end.Segment && from.Offset > end.Offset) {
+		return nil, fmt.Errorf("position %v is past the end of the WAL at %v", from, end)
+	}
+	return wal.newReader(from, -1, follow), nil
+}
+
+// newReader returns a Reader over the WAL, which stops after the segment with the ID last, unless
+// it's -1.
+func (wal *WAL) newReader(from Position, last int, follow bool) *Reader {
+	paths := []string{wal.walPath}
+	if wal.archivePath != "" {
+		paths = append(paths, wal.archivePath)
+	}
+	r := OpenReader(paths, wal.dbname, from)
+	r.wal = wal
+	r.last = last
+	r.follow = follow
+	return r
+}
+
+// OpenReader returns a Reader over the segments of a WAL that's not being appended to, starting
+// from the given position. It reads up to the end of the last segment.
+// Each segment is looked for in the given directories, in order, so the segments of a WAL can be
+// read along with those that were moved into its archive directory.
+//	walPaths `paths to the directories where the segments are located`
+//	dbname   `name of the database`
+func OpenReader(walPaths []string, dbname string, from Position) *Reader {
+	return &Reader{
+		paths:  walPaths,
+		dbname: dbname,
+		last:   -1,
+		sealed: -1,
+		next:   from,
+		pos:    from,
+	}
+}
+
+// Bounds returns the position of the start of the oldest segment and of the end of the last frame
+// written. Like appends, it must not be called concurrently with them.
+func (wal *WAL) Bounds() (Position, Position) {
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+	return Position{Segment: segmentID(wal.segmentPaths[0])}, wal.end
+}
+
+// Next returns the next record. At the end of the WAL, returns io.EOF, unless the Reader is in
+// follow mode, in which case it waits for more records to be appended, until the WAL or the Reader
+// is closed. Returns an error wrapping ErrSegmentRemoved if a segment it has to read is gone.
+func (r *Reader) Next() (record.Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for !r.closed {
+		if r.file == nil {
+			err := r.open()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return record.Record{}, err
+			}
+		}
+
+		limit, sealed, err := r.limit()
+		if err != nil {
+			return record.Record{}, err
+		}
+
+		if r.next.Offset < limit {
+			f, ok, err := readFrame(r.file, r.next.Offset, limit, r.format)
+			if err != nil {
+				return record.Record{}, err
+			}
+			if !ok {
+				r.discarded += limit - r.next.Offset
+				r.a.drop()
+				r.next.Offset = limit
+				continue
+			}
+
+			r.next.Offset += f.Size
+			data, done := r.a.add(f)
+			if !done {
+				continue
+			}
+			rec, err := decodeRecord(data, r.format.recordVersion(), r.file.Name())
+			if err != nil {
+				return record.Record{}, err
+			}
+			r.pos = r.next
+			return rec, nil
+		}
+
+		if sealed && r.next.Segment != r.last {
+			r.file.Close()
+			r.file = nil
+			r.sealed = -1
+			r.next = Position{Segment: r.next.Segment + 1}
+			continue
+		}
+		if !r.follow || r.wal == nil {
+			break
+		}
+
+		// Wait until something is appended, the WAL is closed or Close is called.
+
+		r.mu.Unlock()
+		r.wal.syncMu.Lock()
+		for r.wal.end == (Position{r.next.Segment, limit}) && !r.wal.closed && !r.stopped {
+			r.wal.appendCond.Wait()
+		}
+		stop := r.wal.closed || r.stopped
+		r.wal.syncMu.Unlock()
+		r.mu.Lock()
+		if stop {
+			break
+		}
+	}
+
+	r.a.drop()
+	return record.Record{}, io.EOF
+}
+
+// open opens the segment holding the next frame, from the first directory that has it.
+func (r *Reader) open() error {
+	var file *os.File
+	err := os.ErrNotExist
+	for _, path := range r.paths {
+		file, err = os.Open(filename.Log(path, r.dbname, r.next.Segment))
+		if !errors.Is(err, os.ErrNotExist) {
+			break
+		}
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		// Without a WAL to tell otherwise, a missing segment after the first one is the end.
+		if r.wal == nil && r.next != r.pos {
+			return io.EOF
+		}
+		return fmt.Errorf("%w: segment %d in %v", ErrSegmentRemoved, r.next.Segment, r.paths)
+	}
+	if err != nil {
+		return err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	format, err := readFormat(file, stat.Size(), file.Name())
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if format == segmentFramed && r.next.Offset < int64(len(SEGMENT_MAGIC)) {
+		r.next.Offset = int64(len(SEGMENT_MAGIC))
+	}
+
+	r.file = file
+	r.format = format
+	return nil
+}
+
+// limit returns the offset in the segment being read up to which frames can be read, and whether
+// the segment is sealed, so nothing more will be appended to it. Only the last segment of a WAL
+// that's being appended to isn't sealed, and the end of what's been written to it is the limit.
+func (r *Reader) limit() (int64, bool, error) {
+	if r.sealed == -1 && r.wal != nil {
+		r.wal.syncMu.Lock()
+		end := r.wal.end
+		r.wal.syncMu.Unlock()
+		if end.Segment == r.next.Segment {
+			return end.Offset, false, nil
+		}
+	}
+
+	if r.sealed == -1 {
+		stat, err := r.file.Stat()
+		if err != nil {
+			return 0, false, err
+		}
+		r.sealed = stat.Size()
+	}
+	return r.sealed, true, nil
+}
+
+// Position returns the position right after the last record returned by Next, which is where a
+// new Reader should start to carry on from there.
+func (r *Reader) Position() Position {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.pos
+}
+
+// Discarded returns the number of bytes skipped so far: those after the last intact frame of a
+// segment, and those of frames that didn't add up to a record.
+func (r *Reader) Discarded() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.discarded + r.a.discarded
+}
+
+// Close closes the Reader. It can be called while another goroutine waits in Next, which then
+// returns io.EOF.
+func (r *Reader) Close() error {
+	if r.wal != nil {
+		r.wal.syncMu.Lock()
+		r.stopped = true
+		r.wal.appendCond.Broadcast()
+		r.wal.syncMu.Unlock()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
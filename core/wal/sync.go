@@ -0,0 +1,228 @@
+package wal
+
+import (
+	"fmt"
+	"nakevaleng/util/filename"
+	"os"
+	"time"
+)
+
+// Modes in which the WAL makes the records written to its segments durable. Records are written
+// through a memory map, so they survive a crash of the process right away, but until the segment
+// is synced they may still be lost on power loss.
+const (
+	SYNC_NONE     = "none"     // Never sync, leaving it to the OS.
+	SYNC_ALWAYS   = "always"   // Sync after every write, see Commit and Sync.
+	SYNC_INTERVAL = "interval" // Write every record right away, but sync every so often in the background.
+	SYNC_BUFFER   = "buffer"   // Sync whenever the buffer is flushed, see Commit.
+)
+
+// ValidateSyncParams returns an error if the sync mode isn't one of the SYNC_ constants, or if the
+// WAL should sync every so often but the interval isn't positive.
+func ValidateSyncParams(syncMode string, syncInterval time.Duration) error {
+	switch syncMode {
+	case SYNC_NONE, SYNC_ALWAYS, SYNC_BUFFER:
+		return nil
+	case SYNC_INTERVAL:
+		if syncInterval <= 0 {
+			err := fmt.Errorf("syncInterval must be positive, but %s was given", syncInterval)
+			return err
+		}
+		return nil
+	}
+	err := fmt.Errorf("syncMode must be \"%s\", \"%s\", \"%s\" or \"%s\", but \"%s\" was given",
+		SYNC_NONE, SYNC_ALWAYS, SYNC_INTERVAL, SYNC_BUFFER, syncMode)
+	return err
+}
+
+// Commit is called after appending the records of a write, and returns the point that Sync must
+// reach for them to be as durable as the sync mode asks for. With SYNC_ALWAYS and SYNC_INTERVAL,
+// the buffer is flushed first, so the records reach the last segment. With SYNC_BUFFER, the records
+// may stay in the buffer, and the point only covers those flushed from it so far: the write that
+// filled up the buffer syncs it, and the ones after it have nothing to wait for. With SYNC_NONE,
+// there's nothing to wait for and 0 is returned.
+// Returns the error of an earlier sync if it failed, see Sync.
+func (wal *WAL) Commit() (uint64, error) {
+	wal.syncMu.Lock()
+	err := wal.syncErr
+	wal.syncMu.Unlock()
+	if err != nil || wal.syncMode == SYNC_NONE {
+		return 0, err
+	}
+
+	if wal.syncMode != SYNC_BUFFER {
+		err = wal.FlushBuffer()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+	return wal.written, nil
+}
+
+// Sync blocks until the records written to the segments up to the point returned by Commit are
+// durable. Unlike the rest of the WAL, it's safe to call while other goroutines keep appending, so
+// the caller should release whatever lock it appends under before calling it. This way writers
+// share syncs: while one syncs the segments, the others pile up behind it, and the next one to sync
+// covers all of them at once. With SYNC_INTERVAL, the background syncer does all of the syncing,
+// and Sync only waits for it.
+// Once a sync fails, it's unknown which records made it to disk, so every following call (and
+// Commit) returns the same error.
+func (wal *WAL) Sync(upTo uint64) error {
+	return wal.sync(upTo, wal.syncMode == SYNC_INTERVAL)
+}
+
+// sync is Sync, except that with byRunningSyncer set, it leaves the syncing to the background
+// syncer for as long as it's running.
+func (wal *WAL) sync(upTo uint64, byRunningSyncer bool) error {
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+
+	for wal.synced < upTo && wal.syncErr == nil {
+		if wal.syncing || (byRunningSyncer && wal.syncerRunning) {
+			wal.syncCond.Wait()
+			continue
+		}
+
+		wal.syncing = true
+		target := wal.written
+		files := append(wal.unsynced, wal.current)
+		wal.unsynced = nil
+		dirDirty := wal.dirDirty
+		wal.dirDirty = false
+		wal.syncMu.Unlock()
+
+		err := syncFiles(wal.walPath, files, dirDirty)
+
+		wal.syncMu.Lock()
+		wal.syncing = false
+		if err != nil {
+			wal.syncErr = err
+		} else {
+			fmt.Println("[DBG]\t[WAL] Synced", target-wal.synced, "records")
+			wal.synced = target
+		}
+		wal.syncCond.Broadcast()
+	}
+	return wal.syncErr
+}
+
+// syncAll makes everything written to the segments so far durable, syncing them right away.
+func (wal *WAL) syncAll() error {
+	wal.syncMu.Lock()
+	written := wal.written
+	wal.syncMu.Unlock()
+	return wal.sync(written, false)
+}
+
+// syncFiles syncs the segments, and then the directory holding them if segments were created,
+// renamed or removed. The segments which are no longer the last one are closed afterwards.
+// On Linux, syncing a segment also writes out the pages changed through its memory maps.
+func syncFiles(walPath string, files []*os.File, dirDirty bool) error {
+	var err error
+	for _, f := range files {
+		if syncErr := f.Sync(); err == nil {
+			err = syncErr
+		}
+	}
+	for _, f := range files[:len(files)-1] {
+		f.Close()
+	}
+	if err == nil && dirDirty {
+		err = filename.SyncDir(walPath)
+	}
+	return err
+}
+
+// syncEvery syncs the segments every interval, until Close is called. Once it stops, Sync stops
+// waiting for it and syncs on its own.
+func (wal *WAL) syncEvery(interval time.Duration) {
+	defer close(wal.syncerDone)
+	defer func() {
+		wal.syncMu.Lock()
+		wal.syncerRunning = false
+		wal.syncCond.Broadcast()
+		wal.syncMu.Unlock()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wal.stopSyncer:
+			return
+		case <-ticker.C:
+			err := wal.syncAll()
+			if err != nil {
+				fmt.Println("[DBG]\t[WAL] Sync failed:", err)
+				return
+			}
+		}
+	}
+}
+
+// wrote counts records that were written to the last segment, and lets the Readers waiting for
+// appends know about them.
+func (wal *WAL) wrote(numOfRecords int) {
+	wal.syncMu.Lock()
+	wal.written += uint64(numOfRecords)
+	wal.end = Position{segmentID(wal.lastSegmentPath), int64(wal.lastSegmentSize)}
+	wal.appendCond.Broadcast()
+	wal.syncMu.Unlock()
+}
+
+// setCurrent opens the segment that just became the last one, to be synced from now on. The segment
+// that was the last one before it is synced (and closed) by the next sync.
+func (wal *WAL) setCurrent(segmentPath string) error {
+	file, err := os.OpenFile(segmentPath, os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+	if wal.current != nil {
+		wal.unsynced = append(wal.unsynced, wal.current)
+	}
+	wal.current = file
+	wal.dirDirty = true
+	wal.end = Position{segmentID(segmentPath), int64(wal.lastSegmentSize)}
+	wal.appendCond.Broadcast()
+	return nil
+}
+
+// markDirDirty notes that segments were renamed or removed, so the next sync syncs the directory.
+func (wal *WAL) markDirDirty() {
+	wal.syncMu.Lock()
+	wal.dirDirty = true
+	wal.syncMu.Unlock()
+}
+
+// Close flushes the buffer, syncs the segments (unless the WAL never syncs) and closes them. The
+// WAL must not be used afterwards, and Readers waiting for appends give up.
+func (wal *WAL) Close() error {
+	if wal.stopSyncer != nil {
+		close(wal.stopSyncer)
+		<-wal.syncerDone
+	}
+
+	err := wal.FlushBuffer()
+	if err == nil && wal.syncMode != SYNC_NONE {
+		err = wal.syncAll()
+	}
+
+	wal.syncMu.Lock()
+	defer wal.syncMu.Unlock()
+	wal.closed = true
+	wal.appendCond.Broadcast()
+	for _, f := range wal.unsynced {
+		f.Close()
+	}
+	wal.unsynced = nil
+	if closeErr := wal.current.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
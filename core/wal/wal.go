@@ -3,75 +3,155 @@
 package wal
 
 import (
-	"bufio"
-	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"nakevaleng/core/record"
 	"nakevaleng/util/filename"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/edsrzf/mmap-go"
 )
 
 // WAL is the implementation of a buffered, segmented Write-Ahead-Log, used for data integrity and recovery.
+// Each segment has an ID, which is in its filename. A new segment gets the ID after the one of the
+// last segment, and segments are never renamed, so IDs only ever go up.
 type WAL struct {
-	walPath string
-	dbname  string
+	walPath     string
+	dbname      string
+	archivePath string // Where segments are moved instead of being removed, if set. See SetArchivePath.
 
-	segmentPaths            []string
-	lastSegmentPath         string
-	lastSegmentNumOfRecords int
-	maxRecordsInSegment     int
-	lowWaterMarkIndex       int
+	segmentPaths      []string // From the oldest to the newest.
+	lastSegmentPath   string
+	lastSegmentSize   uint64
+	maxSegmentSize    uint64
+	lowWaterMarkIndex int   // Number of segments kept by DeleteSegmentsBefore, even if they could be removed.
+	truncated         int64 // Number of bytes of torn or corrupt frames cut off the last segment by New.
 
 	appendingBufferCapacity int
 	appendingBuffer         []record.Record
+
+	// See sync.go. The fields below syncMu may be used by a goroutine syncing the segments while
+	// another one appends, so they're guarded by it.
+
+	syncMode   string
+	stopSyncer chan struct{} // Closed by Close to stop the background syncer, if there is one.
+	syncerDone chan struct{} // Closed once the background syncer stops.
+
+	syncMu        sync.Mutex
+	syncCond      *sync.Cond // Signaled whenever a sync finishes. Uses syncMu.
+	appendCond    *sync.Cond // Signaled whenever end changes or the WAL is closed, for Readers. Uses syncMu.
+	end           Position   // End of the last frame written to the last segment.
+	closed        bool       // Set by Close.
+	syncing       bool       // Whether a sync is in progress.
+	syncerRunning bool       // Whether the background syncer is running.
+	syncErr       error      // Error of the sync that failed, if any.
+	written       uint64     // Number of records written to the segments so far.
+	synced        uint64     // Value of written as of the last sync.
+	current       *os.File   // Last segment.
+	unsynced      []*os.File // Segments that stopped being the last one since the last sync.
+	dirDirty      bool       // Whether segments were created, renamed or removed since the last sync.
 }
 
 // Returns a pointer to a WAL object.
 // If no segments are present in the directory, it will create one.
-func New(walPath, dbname string, maxRecordsInSegment, lowWaterMarkIndex, appendingBufferCapacity int) (*WAL, error) {
-	err := ValidateParams(maxRecordsInSegment, lowWaterMarkIndex, appendingBufferCapacity)
+// Segments grow up to maxSegmentSize bytes, and a record that doesn't fit into the rest of the last
+// segment is split up between it and new segments, see frame.go.
+// Whatever follows the last intact frame of the last segment is the tail of an append that was
+// interrupted by a crash, so it's truncated before anything is appended after it. Other segments
+// are left as they are, and readers skip what follows their last intact frame.
+// The WAL makes the records durable as the sync mode says (see sync.go), and if that's SYNC_INTERVAL,
+// syncs every syncInterval in the background until it's closed.
+func New(walPath, dbname string, maxSegmentSize uint64, lowWaterMarkIndex, appendingBufferCapacity int, syncMode string, syncInterval time.Duration) (*WAL, error) {
+	err := ValidateParams(maxSegmentSize, lowWaterMarkIndex, appendingBufferCapacity)
+	if err != nil {
+		return nil, err
+	}
+	err = ValidateSyncParams(syncMode, syncInterval)
 	if err != nil {
 		return nil, err
 	}
 
-	segmentPaths := filename.GetSegmentPaths(walPath, dbname)
+	segmentPaths, err := filename.GetSegmentPaths(walPath, dbname)
+	if err != nil {
+		return nil, err
+	}
 	if len(segmentPaths) == 0 {
 		lastSegmentPath := filename.Log(walPath, dbname, 0)
 
-		file, err := os.Create(lastSegmentPath)
+		err := createSegment(lastSegmentPath)
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		defer file.Close()
 
 		segmentPaths = append(segmentPaths, lastSegmentPath)
 	}
 
 	lastSegmentPath := segmentPaths[len(segmentPaths)-1]
-	lastSegmentNumOfRecords := calculateNumOfRecordsInSegment(lastSegmentPath)
+	truncated, err := repairSegment(lastSegmentPath)
+	if err != nil {
+		return nil, err
+	}
+	lastSegmentSize, err := segmentSize(lastSegmentPath)
+	if err != nil {
+		return nil, err
+	}
 
 	appendingBuffer := make([]record.Record, 0, appendingBufferCapacity)
 
-	return &WAL{
+	wal := &WAL{
 		walPath:                 walPath,
 		dbname:                  dbname,
 		segmentPaths:            segmentPaths,
 		lastSegmentPath:         lastSegmentPath,
-		lastSegmentNumOfRecords: lastSegmentNumOfRecords,
-		maxRecordsInSegment:     maxRecordsInSegment,
+		lastSegmentSize:         lastSegmentSize,
+		maxSegmentSize:          maxSegmentSize,
 		lowWaterMarkIndex:       lowWaterMarkIndex,
+		truncated:               truncated,
 		appendingBufferCapacity: appendingBufferCapacity,
 		appendingBuffer:         appendingBuffer,
-	}, nil
+		syncMode:                syncMode,
+	}
+	wal.syncCond = sync.NewCond(&wal.syncMu)
+	wal.appendCond = sync.NewCond(&wal.syncMu)
+	err = wal.setCurrent(lastSegmentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Frames can't follow records written before frames were introduced, so they go into a new
+	// segment.
+	framed, err := isFramed(lastSegmentPath)
+	if err != nil {
+		return nil, err
+	}
+	if !framed {
+		fmt.Println("[DBG]\t[WAL] Created new segment")
+		err = wal.addSegment()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if syncMode == SYNC_INTERVAL {
+		wal.stopSyncer = make(chan struct{})
+		wal.syncerDone = make(chan struct{})
+		wal.syncerRunning = true
+		go wal.syncEvery(syncInterval)
+	}
+	return wal, nil
 }
 
 // ValidateParams is a helper function that returns an error representing  the validity of params
 // passed to WAL's New.
-func ValidateParams(maxRecordsInSegment, lowWaterMarkIndex, appendingBufferCapacity int) error {
-	if maxRecordsInSegment <= 0 {
-		err := fmt.Errorf("maxRecordsInSegment must be a positive number, but %d was given", maxRecordsInSegment)
+func ValidateParams(maxSegmentSize uint64, lowWaterMarkIndex, appendingBufferCapacity int) error {
+	minSegmentSize := uint64(len(SEGMENT_MAGIC) + FRAME_HEADER_SIZE)
+	if maxSegmentSize <= minSegmentSize {
+		err := fmt.Errorf("maxSegmentSize must be greater than %d, but %d was given", minSegmentSize, maxSegmentSize)
 		return err
 	}
 	if lowWaterMarkIndex < 0 {
@@ -86,326 +166,542 @@ func ValidateParams(maxRecordsInSegment, lowWaterMarkIndex, appendingBufferCapac
 	return nil
 }
 
-// Helper function that returns the current number of records present in the segment.
-func calculateNumOfRecordsInSegment(filename string) int {
-	file, err := os.Open(filename)
+// Helper function that returns the size of the segment in bytes.
+func segmentSize(segmentPath string) (uint64, error) {
+	stat, err := os.Stat(segmentPath)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
-	defer file.Close()
-
-	numOfRecords := 0
-	reader := bufio.NewReader(file)
-	rec := record.Record{}
-	for eof := rec.Deserialize(reader); !eof; eof = rec.Deserialize(reader) {
-		numOfRecords++
-	}
-
-	return numOfRecords
+	return uint64(stat.Size()), nil
 }
 
-// Appends a single record into the last segment. If the last segment is full,
-// Append will add a new segment and append the record into the new segment.
-func (wal *WAL) Append(rec record.Record) {
-	if wal.lastSegmentNumOfRecords == wal.maxRecordsInSegment {
-		fmt.Println("[DBG]\t[WAL] Created new segment")
-		wal.addSegment() // Append is now operating on the new last segment
-	}
+// segmentID returns the ID of the segment, taken from its filename.
+func segmentID(segmentPath string) int {
+	_, id, _, _ := filename.Query(segmentPath)
+	return id
+}
 
-	file, err := os.OpenFile(wal.lastSegmentPath, os.O_RDWR, 0666)
+// isFramed returns whether the segment starts with SEGMENT_MAGIC.
+func isFramed(segmentPath string) (bool, error) {
+	file, err := os.Open(segmentPath)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		panic(err)
-	}
-
-	oldSize := stat.Size()
-	newSize := oldSize + int64(rec.TotalSize())
-	err = file.Truncate(newSize)
-	if err != nil {
-		panic(err)
+		return false, err
 	}
+	return hasMagic(file, stat.Size())
+}
 
-	mmapf, err := mmap.Map(file, mmap.RDWR, 0)
-	if err != nil {
-		panic(err)
+// spaceLeft returns the size of the biggest payload that fits into a frame appended to the last
+// segment, once the given number of bytes are appended to it first.
+func (wal *WAL) spaceLeft(appended int) int {
+	size := wal.lastSegmentSize + uint64(appended) + FRAME_HEADER_SIZE
+	if size >= wal.maxSegmentSize {
+		return 0
 	}
-	defer mmapf.Unmap()
-
-	copy(mmapf[oldSize:], rec.ToBytes())
+	return int(wal.maxSegmentSize - size)
+}
 
-	wal.lastSegmentNumOfRecords++
+// Appends a single record into the last segment. If the record doesn't fit,
+// Append will add new segments for the rest of it.
+func (wal *WAL) Append(rec record.Record) error {
+	_, err := wal.writeRecords([]record.Record{rec})
+	return err
 }
 
 // Appends a record into the buffer stored within the WAL.
 // When the buffer is full, it will be flushed.
-func (wal *WAL) BufferedAppend(rec record.Record) {
+func (wal *WAL) BufferedAppend(rec record.Record) error {
 	wal.appendingBuffer = append(wal.appendingBuffer, rec)
 	fmt.Println("[DBG]\t[WAL] Inserted", string(rec.Key))
 	if len(wal.appendingBuffer) == wal.appendingBufferCapacity {
-		wal.FlushBuffer()
+		return wal.FlushBuffer()
 	}
+	return nil
+}
+
+// AppendBatch appends the records into the buffer as a single unit, framed by a begin and a commit
+// marker. When replaying, a batch whose commit marker never made it to disk is discarded as a whole.
+// Like with BufferedAppend, the buffer is flushed whenever it fills up.
+func (wal *WAL) AppendBatch(recs []record.Record) error {
+	err := wal.BufferedAppend(newBatchMarker(record.RECORD_BATCH_BEGIN, len(recs)))
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		err = wal.BufferedAppend(rec)
+		if err != nil {
+			return err
+		}
+	}
+	return wal.BufferedAppend(newBatchMarker(record.RECORD_BATCH_COMMIT, len(recs)))
+}
+
+// newBatchMarker creates a marker record for AppendBatch. Its value holds the size of the batch.
+func newBatchMarker(status uint8, batchSize int) record.Record {
+	val := make([]byte, 8)
+	binary.LittleEndian.PutUint64(val, uint64(batchSize))
+
+	marker := record.New([]byte{}, val)
+	marker.Status = status
+	return marker
 }
 
 // Appends the buffer's records into the WAL's segments.
 // Depending on the size of the buffer and the fullness of the last segment,
 // FlushBuffer can cause the creation of new segments.
-func (wal *WAL) FlushBuffer() {
+// If an error occurs, the records that weren't written yet are kept in the buffer.
+// The segments aren't synced here, even with SYNC_BUFFER: that's up to the Sync following the next
+// Commit, which can be called without holding the lock the records are appended under.
+func (wal *WAL) FlushBuffer() error {
 	fmt.Println("[DBG]\t[WAL] Flushing")
-	for len(wal.appendingBuffer) != 0 {
-		if wal.lastSegmentNumOfRecords == wal.maxRecordsInSegment {
-			fmt.Println("[DBG]\t[WAL] Created new segment")
-			wal.addSegment() // Append is now operating on the new last segment
-		}
+	numOfRecs, err := wal.writeRecords(wal.appendingBuffer)
+	wal.appendingBuffer = wal.appendingBuffer[numOfRecs:]
+	return err
+}
 
-		numOfRecsToAppend := wal.maxRecordsInSegment - wal.lastSegmentNumOfRecords
-		if numOfRecsToAppend > len(wal.appendingBuffer) {
-			numOfRecsToAppend = len(wal.appendingBuffer)
-		}
+// writeRecords appends the records to the segments as frames, splitting up those that don't fit
+// into the last segment. The frames for each segment are appended at once. Returns the number of
+// records written in full, which may be less than all of them if an error occurs.
+func (wal *WAL) writeRecords(recs []record.Record) (int, error) {
+	written := 0
+	frames := make([]byte, 0) // Yet to be appended to the last segment.
+	numOfRecs := 0            // Whose last frame is in frames.
 
-		partialBuffer := wal.appendingBuffer[:numOfRecsToAppend]
-		wal.flushPartialBufferToSegment(partialBuffer)
+	appendFrames := func() error {
+		err := appendToSegment(wal.lastSegmentPath, frames)
+		if err != nil {
+			return err
+		}
+		wal.lastSegmentSize += uint64(len(frames))
+		wal.wrote(numOfRecs)
+		written += numOfRecs
+		frames = frames[:0]
+		numOfRecs = 0
+		return nil
+	}
+
+	for _, rec := range recs {
+		payload := rec.ToBytes()
+		first := true
+		for {
+			space := wal.spaceLeft(len(frames))
+			if space == 0 {
+				if len(frames) != 0 {
+					err := appendFrames()
+					if err != nil {
+						return written, err
+					}
+				}
+				fmt.Println("[DBG]\t[WAL] Created new segment")
+				err := wal.addSegment() // Appending now operates on the new last segment
+				if err != nil {
+					return written, err
+				}
+				continue
+			}
+
+			n := len(payload)
+			if n > space {
+				n = space
+			}
+			last := n == len(payload)
+			frames = appendFrame(frames, frameType(first, last), payload[:n])
+			payload = payload[n:]
+			first = false
+			if last {
+				break
+			}
+		}
+		numOfRecs++
+	}
 
-		wal.appendingBuffer = wal.appendingBuffer[numOfRecsToAppend:]
-		wal.lastSegmentNumOfRecords += numOfRecsToAppend
+	if len(frames) != 0 {
+		err := appendFrames()
+		if err != nil {
+			return written, err
+		}
 	}
+	return written, nil
 }
 
-// Utility function for adding a new segment to the WAL,
-// setting it as the last segment and setting its number of records to zero.
-func (wal *WAL) addSegment() {
-	_, logNo, _, _ := filename.Query(wal.lastSegmentPath)
-	logNo++
+// Utility function for adding a new segment to the WAL, with the ID after the one of
+// the last segment, and setting it as the last segment.
+func (wal *WAL) addSegment() error {
+	newLastSegmentPath := filename.Log(wal.walPath, wal.dbname, segmentID(wal.lastSegmentPath)+1)
 
-	newLastSegmentPath := filename.Log(wal.walPath, wal.dbname, logNo)
-
-	file, err := os.Create(newLastSegmentPath)
+	err := createSegment(newLastSegmentPath)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer file.Close()
 
 	wal.segmentPaths = append(wal.segmentPaths, newLastSegmentPath)
 	wal.lastSegmentPath = newLastSegmentPath
-	wal.lastSegmentNumOfRecords = 0
+	wal.lastSegmentSize = uint64(len(SEGMENT_MAGIC))
+	return wal.setCurrent(newLastSegmentPath)
+}
+
+// CreateSegment creates an empty segment with the given ID. A WAL opened by New in a directory
+// without segments starts from ID 0, so this is used to make it start from another ID instead,
+// like one after the IDs of the segments in an archive directory (see SetArchivePath) it's going
+// to share.
+//	walPath `path to the directory where the segment is created`
+//	dbname  `name of the database`
+//	id      `ID of the segment`
+func CreateSegment(walPath, dbname string, id int) error {
+	return createSegment(filename.Log(walPath, dbname, id))
 }
 
-// Helper function used by FlushBuffer to partially flush its contents to the
-// segment.
-func (wal *WAL) flushPartialBufferToSegment(partialBuffer []record.Record) {
-	file, err := os.OpenFile(wal.lastSegmentPath, os.O_RDWR, 0666)
+// createSegment creates an empty segment, which holds only SEGMENT_MAGIC.
+func createSegment(segmentPath string) error {
+	file, err := os.Create(segmentPath)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer file.Close()
 
-	sizeOfBuffer := int64(0) // number of bytes in the buffer
-	bytesOfBuffer := make([]byte, 0)
-	for _, rec := range partialBuffer {
-		sizeOfBuffer += int64(rec.TotalSize())
-		bytesOfBuffer = append(bytesOfBuffer, rec.ToBytes()...)
+	_, err = file.WriteString(SEGMENT_MAGIC)
+	return err
+}
+
+// appendToSegment grows the segment by len(data) bytes and copies data into the new space through
+// a memory map. If the copy never happens, the zeroed tail is truncated by New on the next startup.
+func appendToSegment(segmentPath string, data []byte) error {
+	file, err := os.OpenFile(segmentPath, os.O_RDWR, 0666)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
 	stat, err := file.Stat()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	oldSize := stat.Size()
-	newSize := oldSize + sizeOfBuffer
+	newSize := oldSize + int64(len(data))
 	err = file.Truncate(newSize)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	mmapf, err := mmap.Map(file, mmap.RDWR, 0)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer mmapf.Unmap()
 
-	copy(mmapf[oldSize:], bytesOfBuffer)
+	copy(mmapf[oldSize:], data)
+	return mmapf.Unmap()
 }
 
 // Returns a slice of all the records found in the last segment.
-func (wal *WAL) ReadLastSegment() []record.Record {
-	return readEntireSegment(wal.lastSegmentPath)
+// Like with the other ways of reading segments, records split up between the segments that are read
+// and the ones that aren't are left out. Use a Reader to go through the WAL without holding all of
+// it in memory.
+func (wal *WAL) ReadLastSegment() ([]record.Record, error) {
+	return wal.readAllRecords(len(wal.segmentPaths)-1, len(wal.segmentPaths))
 }
 
 // Returns a slice of all the records found in the segment with the given index.
-func (wal *WAL) ReadSegmentAt(index int) []record.Record {
+// Indices are positions of the segments, starting from the oldest one, not their IDs.
+func (wal *WAL) ReadSegmentAt(index int) ([]record.Record, error) {
 	if index < 0 {
-		errMsg := fmt.Sprint("index must be greater than or equal to zero, but ", index, " was given.")
-		panic(errMsg)
+		return nil, fmt.Errorf("index must be greater than or equal to zero, but %d was given", index)
 	}
 	if index > len(wal.segmentPaths)-1 {
-		errMsg := "index is out of bounds."
-		panic(errMsg)
+		return nil, fmt.Errorf("index %d is out of bounds", index)
 	}
 
-	segmentPath := wal.segmentPaths[index]
-	return readEntireSegment(segmentPath)
+	return wal.readAllRecords(index, index+1)
 }
 
 // Returns a slice of all the records found in the segments with indices
 // in the range [begin, end)
-func (wal *WAL) ReadSegmentsInRange(begin int, end int) []record.Record {
+func (wal *WAL) ReadSegmentsInRange(begin int, end int) ([]record.Record, error) {
 	if begin < 0 {
-		errMsg := fmt.Sprint("begin must be greater than or equal to zero, but ", begin, " was given.")
-		panic(errMsg)
+		return nil, fmt.Errorf("begin must be greater than or equal to zero, but %d was given", begin)
 	}
 	if end <= 0 {
-		errMsg := fmt.Sprint("end must be greater than zero, but ", end, " was given.")
-		panic(errMsg)
+		return nil, fmt.Errorf("end must be greater than zero, but %d was given", end)
 	}
 	if begin >= end {
-		errMsg := "begin must be lesser than end."
-		panic(errMsg)
+		return nil, fmt.Errorf("begin must be lesser than end, but [%d, %d) was given", begin, end)
 	}
 	if end > len(wal.segmentPaths) {
-		errMsg := "end must be lesser than or equal to the length of the total amount of segments."
-		panic(errMsg)
+		return nil, fmt.Errorf("end must be lesser than or equal to the number of segments (%d), but %d was given", len(wal.segmentPaths), end)
 	}
 
-	recs := make([]record.Record, 0)
-	for ; begin < end; begin++ {
-		segmentPath := wal.segmentPaths[begin]
-		recs = append(recs, readEntireSegment(segmentPath)...)
-	}
-
-	return recs
+	return wal.readAllRecords(begin, end)
 }
 
 // Returns a slice of all the records found in all of the segments.
-func (wal *WAL) ReadAllSegments() []record.Record {
+func (wal *WAL) ReadAllSegments() ([]record.Record, error) {
+	return wal.readAllRecords(0, len(wal.segmentPaths))
+}
+
+// readAllRecords returns a slice of all the records found in the segments with indices in the
+// range [begin, end).
+func (wal *WAL) readAllRecords(begin, end int) ([]record.Record, error) {
+	from := Position{Segment: segmentID(wal.segmentPaths[begin])}
+	r := wal.newReader(from, segmentID(wal.segmentPaths[end-1]), false)
+	defer r.Close()
+
 	recs := make([]record.Record, 0)
-	for _, segmentPath := range wal.segmentPaths {
-		recs = append(recs, readEntireSegment(segmentPath)...)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return recs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, rec)
 	}
-	return recs
 }
 
-// Returns a slice of all the records found in the segment.
-func readEntireSegment(segmentPath string) []record.Record {
-	file, err := os.Open(segmentPath)
-	if err != nil {
-		panic(err)
+// Replay streams all records from all of the segments, in the order they were appended, into
+// apply. The segments are read through a Reader, so the entire WAL is never held in memory.
+// Records appended through AppendBatch are held back until their commit marker is read, and then
+// applied together. Batches without a commit marker are discarded. Markers are never applied.
+// Returns the number of bytes of the WAL that were discarded: torn or corrupt frames, including
+// those cut off the last segment by New, and fragments of records that were never written in full.
+func (wal *WAL) Replay(apply func(rec record.Record) error) (int64, error) {
+	batch := []record.Record{}
+	batchSize := 0
+	inBatch := false
+
+	from, _ := wal.Bounds()
+	r := wal.newReader(from, -1, false)
+	defer r.Close()
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return r.Discarded() + wal.truncated, err
+		}
+
+		if rec.Status&record.RECORD_BATCH_BEGIN != 0 {
+			if inBatch {
+				fmt.Println("[DBG]\t[WAL] Discarded uncommitted batch of", len(batch), "records")
+			}
+			batch = batch[:0]
+			batchSize = int(binary.LittleEndian.Uint64(rec.Value))
+			inBatch = true
+		} else if rec.Status&record.RECORD_BATCH_COMMIT != 0 {
+			// A commit without a begin marker means the start of the batch was in a segment
+			// that has since been deleted, so the batch is already on disk.
+			if inBatch && len(batch) == batchSize {
+				for _, batchRec := range batch {
+					err = apply(batchRec)
+					if err != nil {
+						return r.Discarded() + wal.truncated, err
+					}
+				}
+			}
+			inBatch = false
+		} else if inBatch {
+			batch = append(batch, rec)
+		} else {
+			err = apply(rec)
+			if err != nil {
+				return r.Discarded() + wal.truncated, err
+			}
+		}
 	}
-	defer file.Close()
 
-	stat, err := file.Stat()
-	if err != nil {
-		panic(err)
+	if inBatch {
+		fmt.Println("[DBG]\t[WAL] Discarded uncommitted batch of", len(batch), "records")
 	}
-	if stat.Size() == 0 {
-		return make([]record.Record, 0)
+	discarded := r.Discarded() + wal.truncated
+	if discarded != 0 {
+		fmt.Println("[DBG]\t[WAL] Discarded", discarded, "bytes of torn or corrupt frames")
 	}
+	return discarded, nil
+}
 
-	mmapf, err := mmap.Map(file, mmap.RDONLY, 0)
-	if err != nil {
-		panic(err)
+// repairSegment truncates the segment to the end of its last intact frame. Whatever follows it
+// is the tail of an append that was interrupted by a crash and can't be trusted. Returns the
+// number of bytes truncated.
+// A legacy segment whose first record can't be read in any version is left as it is, and an error
+// wrapping record.ErrCorruption is returned: it's more likely to be in a format we don't know than
+// to be torn as a whole, and truncating it would throw away every record in it.
+func repairSegment(segmentPath string) (int64, error) {
+	validSize, size, err := scanSegment(segmentPath)
+	if err != nil || validSize == size {
+		return 0, err
 	}
-	defer mmapf.Unmap()
 
-	bytesOfRecs := make([]byte, len(mmapf))
-
-	copy(bytesOfRecs, mmapf)
+	fmt.Println("[DBG]\t[WAL] Truncating", size-validSize, "torn bytes from", segmentPath)
+	return size - validSize, os.Truncate(segmentPath, validSize)
+}
 
-	bytesReader := bytes.NewReader(bytesOfRecs)
-	bufferedReader := bufio.NewReader(bytesReader)
+// CutSegment flushes the buffer and, unless the last segment is empty, adds a new segment. This way,
+// every record appended so far ends up in a segment before the last one. Returns the ID of the last
+// segment, which is the low-water mark to pass to DeleteSegmentsBefore once those records are no
+// longer needed.
+func (wal *WAL) CutSegment() (int, error) {
+	err := wal.FlushBuffer()
+	if err != nil {
+		return 0, err
+	}
 
-	recs := make([]record.Record, 0)
-	rec := record.Record{}
-	for eof := rec.Deserialize(bufferedReader); !eof; eof = rec.Deserialize(bufferedReader) {
-		recs = append(recs, rec)
+	if wal.lastSegmentSize != uint64(len(SEGMENT_MAGIC)) {
+		fmt.Println("[DBG]\t[WAL] Created new segment")
+		err = wal.addSegment()
+		if err != nil {
+			return 0, err
+		}
 	}
 
-	return recs
+	return segmentID(wal.lastSegmentPath), nil
 }
 
-// DeleteOldSegments removes the old segments from the filesystem (based on the low water mark index) and renames
-// the remaining ones so they reflect the new state.
-func (wal *WAL) DeleteOldSegments() {
-	if len(wal.segmentPaths) <= wal.lowWaterMarkIndex {
-		return
-	}
+// DeleteOldSegments removes the old segments from the filesystem, keeping as many of the newest
+// ones as the low water mark index says.
+func (wal *WAL) DeleteOldSegments() error {
+	_, err := wal.DeleteSegmentsBefore(segmentID(wal.lastSegmentPath) + 1)
+	return err
+}
 
-	fmt.Println("[DBG]\t[WAL] Removing old segments")
+// DeleteSegmentsBefore is like DeleteOldSegments, but only the segments with IDs lower than the
+// low-water mark are considered for removal. The remaining segments are left as they are. If the
+// last segment is removed, a new one is added first, so that IDs keep going up. Returns the number
+// of segments removed.
+func (wal *WAL) DeleteSegmentsBefore(lowWaterMark int) (int, error) {
+	return wal.deleteSegmentsBefore(lowWaterMark, wal.lowWaterMarkIndex)
+}
 
-	maxIndex := len(wal.segmentPaths) - wal.lowWaterMarkIndex
+// DropSegmentsBefore is like DeleteSegmentsBefore, but doesn't keep any segments because of the low
+// water mark index. Used when the records in those segments mustn't be replayed anymore, because
+// newer versions of them are on disk without being in the WAL.
+func (wal *WAL) DropSegmentsBefore(lowWaterMark int) (int, error) {
+	return wal.deleteSegmentsBefore(lowWaterMark, 0)
+}
 
-	segmentsForDeletion := wal.segmentPaths[:maxIndex]
-	for _, segmentPath := range segmentsForDeletion {
-		err := os.Remove(segmentPath)
-		fmt.Println("[DBG]\t[WAL] Removed", segmentPath)
+// deleteSegmentsBefore removes the segments with IDs lower than the low-water mark, except for the
+// given number of the newest ones. See DeleteSegmentsBefore.
+func (wal *WAL) deleteSegmentsBefore(lowWaterMark, keep int) (int, error) {
+	maxCount := len(wal.segmentPaths) - keep
+	count := 0
+	for count < maxCount && segmentID(wal.segmentPaths[count]) < lowWaterMark {
+		count++
+	}
+	if count == 0 {
+		return 0, nil
+	}
+	if count == len(wal.segmentPaths) {
+		fmt.Println("[DBG]\t[WAL] Created new segment")
+		err := wal.addSegment()
 		if err != nil {
-			panic(err)
+			return 0, err
 		}
 	}
 
-	wal.segmentPaths = wal.segmentPaths[maxIndex:]
-	for i, oldPath := range wal.segmentPaths {
-		newPath := filename.Log(wal.walPath, wal.dbname, i)
+	fmt.Println("[DBG]\t[WAL] Removing old segments")
+	err := wal.removeSegments(count)
+	return count, err
+}
 
-		err := os.Rename(oldPath, newPath)
+// removeSegments removes the first count segments from the filesystem, or moves them into the
+// archive directory if there is one.
+func (wal *WAL) removeSegments(count int) error {
+	defer wal.markDirDirty()
+	archived := false
+	for count > 0 {
+		err := wal.retireSegment(wal.segmentPaths[0])
 		if err != nil {
-			panic(err)
+			return err
 		}
+		archived = wal.archivePath != ""
 
-		wal.segmentPaths[i] = newPath
+		wal.segmentPaths = wal.segmentPaths[1:]
+		count--
 	}
 
-	if len(wal.segmentPaths) != 0 {
-		wal.lastSegmentPath = wal.segmentPaths[len(wal.segmentPaths)-1]
-		wal.lastSegmentNumOfRecords = calculateNumOfRecordsInSegment(wal.lastSegmentPath)
-	} else {
-		newSegmentPath := filename.Log(wal.walPath, wal.dbname, 0)
-
-		file, err := os.Create(newSegmentPath)
-		if err != nil {
-			panic(err)
-		}
-		defer file.Close()
-
-		wal.segmentPaths = append(wal.segmentPaths, newSegmentPath)
-		wal.lastSegmentPath = newSegmentPath
-		wal.lastSegmentNumOfRecords = 0
+	if archived {
+		return filename.SyncDir(wal.archivePath)
 	}
+	return nil
 }
 
-// Removes all the segments from the filesystem. This should be called after flushing the memtable.
-// Note that this will leave one (emptied) segment, preparing the WAL for new appends.
-func (wal *WAL) DeleteAllSegments() {
-	for _, segmentPath := range wal.segmentPaths {
+// retireSegment removes the segment, or moves it into the archive directory under the same name.
+// A segment that can't be moved there, like one on another file system, is copied and then removed.
+func (wal *WAL) retireSegment(segmentPath string) error {
+	if wal.archivePath == "" {
 		err := os.Remove(segmentPath)
-		if err != nil {
-			panic(err)
+		if err == nil {
+			fmt.Println("[DBG]\t[WAL] Removed", segmentPath)
 		}
+		return err
 	}
-	wal.segmentPaths = wal.segmentPaths[:0]
 
-	newSegmentPath := filename.Log(wal.walPath, wal.dbname, 0)
-	file, err := os.Create(newSegmentPath)
+	// Renaming would replace an archived segment with the same ID, which should never be there.
+
+	archivedPath := filename.Log(wal.archivePath, wal.dbname, segmentID(segmentPath))
+	_, err := os.Stat(archivedPath)
+	if err == nil {
+		return fmt.Errorf("segment %s is already archived at %s", segmentPath, archivedPath)
+	}
+	err = os.Rename(segmentPath, archivedPath)
 	if err != nil {
-		panic(err)
+		err = filename.CopyFile(segmentPath, archivedPath)
+		if err == nil {
+			err = os.Remove(segmentPath)
+		}
 	}
-	defer file.Close()
+	if err == nil {
+		fmt.Println("[DBG]\t[WAL] Archived", segmentPath)
+	}
+	return err
+}
+
+// SetArchivePath makes the WAL move the segments it no longer needs into the directory at
+// archivePath, instead of removing them, so that the records in them can be replayed later on
+// (see OpenReader). The directory is created if it doesn't exist, and must not be the one holding
+// the WAL. It must be called before any segment is removed.
+//	archivePath `path to the directory where the retired segments are moved, ending with '/'`
+func (wal *WAL) SetArchivePath(archivePath string) error {
+	if !strings.HasSuffix(archivePath, "/") {
+		return fmt.Errorf("archivePath must end with '/', but \"%s\" was given", archivePath)
+	}
+	if filepath.Clean(archivePath) == filepath.Clean(wal.walPath) {
+		return fmt.Errorf("archivePath must not be the WAL's directory (\"%s\")", wal.walPath)
+	}
+	err := os.MkdirAll(archivePath, 0777)
+	if err != nil {
+		return err
+	}
+	wal.archivePath = archivePath
+	return nil
+}
 
-	wal.segmentPaths = append(wal.segmentPaths, newSegmentPath)
-	wal.lastSegmentPath = newSegmentPath
-	wal.lastSegmentNumOfRecords = 0
+// Removes all the segments from the filesystem. This should be called after flushing the memtable.
+// Note that this will leave one (empty) segment, preparing the WAL for new appends. Its ID is
+// the one after the ID of the last removed segment.
+func (wal *WAL) DeleteAllSegments() error {
+	fmt.Println("[DBG]\t[WAL] Created new segment")
+	err := wal.addSegment()
+	if err != nil {
+		return err
+	}
+	return wal.removeSegments(len(wal.segmentPaths) - 1)
 }
 
-// Truncates the last segment, and sets its number of records to zero.
-func (wal *WAL) ResetLastSegment() {
-	err := os.Truncate(wal.lastSegmentPath, 0)
+// Truncates the last segment, so it has no records.
+func (wal *WAL) ResetLastSegment() error {
+	err := os.Truncate(wal.lastSegmentPath, int64(len(SEGMENT_MAGIC)))
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	wal.lastSegmentNumOfRecords = 0
+	wal.lastSegmentSize = uint64(len(SEGMENT_MAGIC))
+	wal.wrote(0)
+	return nil
 }
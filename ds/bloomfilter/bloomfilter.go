@@ -92,14 +92,16 @@ func (bf *BloomFilter) Insert(element []byte) {
 
 // Query searches for a byte sequence in the filter. Returns false if the sequence is *not* in the
 // filter, otherwise it returns true (the sequence *may* be in the filter).
+// Unlike Insert, Query makes its own hash functions from the seeds instead of using the shared ones,
+// so it's safe to query the same filter from many goroutines at once.
 func (bf *BloomFilter) Query(element []byte) bool {
-	for _, v := range bf.hashes {
+	for _, seed := range bf.HashSeeds {
+		v := murmur3.New32WithSeed(seed)
 		_, err := v.Write(element)
 		if err != nil {
 			panic(err)
 		}
 		index := v.Sum32() % bf.M
-		v.Reset()
 
 		byteIndex := index / 8
 		bitIndex := index % 8
@@ -114,10 +116,10 @@ func (bf *BloomFilter) Query(element []byte) bool {
 
 // DecodeFromFile reads data from a file and returns a bloom filter generated by it.
 // Uses gob encoding.
-func DecodeFromFile(filename string) *BloomFilter {
+func DecodeFromFile(filename string) (*BloomFilter, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer f.Close()
 	return decode(f)
@@ -125,20 +127,33 @@ func DecodeFromFile(filename string) *BloomFilter {
 
 // DecodeFromBytes reads data from a byte sequence and returns a bloom filter generated by it.
 // Uses gob encoding.
-func DecodeFromBytes(data []byte) *BloomFilter {
+func DecodeFromBytes(data []byte) (*BloomFilter, error) {
 	reader := bytes.NewReader(data)
 	return decode(reader)
 }
 
 // Read from decoder. Uses gob encoding.
-func decode(reader io.Reader) *BloomFilter {
+// Returns an error if the data can't be decoded or doesn't describe a valid filter, so that a
+// damaged filter is never used (a zero M would make Query divide by zero, and too few bytes would
+// make it index past them).
+func decode(reader io.Reader) (*BloomFilter, error) {
 	// Read all data into the filter.
 
 	decoder := gob.NewDecoder(reader)
 	bf := &BloomFilter{}
 	err := decoder.Decode(bf)
 	if err != nil && err != io.EOF {
-		panic(err)
+		return nil, err
+	}
+
+	if bf.M == 0 {
+		return nil, fmt.Errorf("bloomfilter: no bits")
+	}
+	if uint64(len(bf.Contents))*8 < uint64(bf.M) {
+		return nil, fmt.Errorf("bloomfilter: %d bytes can't hold %d bits", len(bf.Contents), bf.M)
+	}
+	if len(bf.HashSeeds) == 0 {
+		return nil, fmt.Errorf("bloomfilter: no hash seeds")
 	}
 
 	// Make hashes.
@@ -148,23 +163,20 @@ func decode(reader io.Reader) *BloomFilter {
 		bf.hashes[i] = murmur3.New32WithSeed(seed)
 	}
 
-	return bf
+	return bf, nil
 }
 
 // EncodeToFile writes bloom filter data into a file.
 // Uses gob encoding.
-func (bf *BloomFilter) EncodeToFile(fName string) {
+func (bf *BloomFilter) EncodeToFile(fName string) error {
 	outBin, err := os.Create(fName)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer outBin.Close()
 
 	encoder := gob.NewEncoder(outBin)
-	err = encoder.Encode(bf)
-	if err != nil {
-		panic(err)
-	}
+	return encoder.Encode(bf)
 }
 
 // EncodeToBytes writes bloom filter data into a sequence of bytes.
@@ -191,14 +203,14 @@ func main() {
 	fmt.Println(bf.Contents)
 	bfBytes := bf.EncodeToBytes()
 	fmt.Println(bfBytes)
-	bf2 := DecodeFromBytes(bfBytes)
+	bf2, _ := DecodeFromBytes(bfBytes)
 	// should be true false true
 	fmt.Println(bf2.Query([]byte{1, 2}))
 	fmt.Println(bf2.Query([]byte{2, 5}))
 	fmt.Println(bf2.Query([]byte{3, 4}))
 	fmt.Println(bf2.HashSeeds)
 	bf.EncodeToFile("bf31451.bin")
-	bf3 := DecodeFromFile("bf31451.bin")
+	bf3, _ := DecodeFromFile("bf31451.bin")
 	fmt.Println("---FROM FILE---")
 	fmt.Println(bf3.Query([]byte{1, 2}))
 	fmt.Println(bf3.Query([]byte{2, 5}))
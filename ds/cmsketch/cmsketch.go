@@ -143,14 +143,30 @@ func (cms *CountMinSketch) EncodeToFile(filename string) {
 
 // decode data from the reader and return a CMS built from it.
 // Uses gob encoding.
-func decode(reader io.Reader) *CountMinSketch {
+// Returns an error if the data can't be decoded or doesn't describe a valid CMS, so that a damaged
+// CMS is never used (a zero M would make Insert and Query divide by zero).
+func decode(reader io.Reader) (*CountMinSketch, error) {
 	// Read all data into the CMS.
 
 	decoder := gob.NewDecoder(reader)
 	cms := &CountMinSketch{}
 	err := decoder.Decode(cms)
 	if err != nil && err != io.EOF {
-		panic(err)
+		return nil, err
+	}
+
+	// Check that the table matches its dimensions.
+
+	if cms.M == 0 || cms.M > math.MaxUint32 {
+		return nil, fmt.Errorf("cmsketch: invalid number of columns %d", cms.M)
+	}
+	if uint(len(cms.HashSeeds)) != cms.K || uint(len(cms.Contents)) != cms.K {
+		return nil, fmt.Errorf("cmsketch: %d hash seeds and %d rows, but K is %d", len(cms.HashSeeds), len(cms.Contents), cms.K)
+	}
+	for i, row := range cms.Contents {
+		if uint(len(row)) != cms.M {
+			return nil, fmt.Errorf("cmsketch: row %d has %d columns, but M is %d", i, len(row), cms.M)
+		}
 	}
 
 	// Recreate hash functions (we only serialize their seeds).
@@ -160,22 +176,24 @@ func decode(reader io.Reader) *CountMinSketch {
 		cms.hashes[i] = murmur3.New32WithSeed(seed)
 	}
 
-	return cms
+	return cms, nil
 }
 
 // DecodeFromBytes reads data from a byte stream and writes into a new CMS.
 // Uses gob encoding.
-func DecodeFromBytes(data []byte) *CountMinSketch {
+// Returns an error if the data doesn't hold a valid CMS.
+func DecodeFromBytes(data []byte) (*CountMinSketch, error) {
 	reader := bytes.NewReader(data)
 	return decode(reader)
 }
 
 // DecodeFromFile reads data from a file and writes into a new CMS.
 // Uses gob encoding.
-func DecodeFromFile(filename string) *CountMinSketch {
+// Returns an error if the file can't be read or doesn't hold a valid CMS.
+func DecodeFromFile(filename string) (*CountMinSketch, error) {
 	reader, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer reader.Close()
 	return decode(reader)
@@ -193,12 +211,12 @@ func main() {
 	fmt.Println(cms.Query([]byte{3, 4}))
 	fmt.Println(cms.Query([]byte{2, 5}))
 	cmsBytes := cms.EncodeToBytes()
-	cms2 := DecodeFromBytes(cmsBytes)
+	cms2, _ := DecodeFromBytes(cmsBytes)
 	fmt.Println(cms2.Query([]byte{1, 2}))
 	fmt.Println(cms2.Query([]byte{3, 4}))
 	fmt.Println(cms2.Query([]byte{2, 5}))
 	cms2.EncodeToFile("cms31451.bin")
-	cms3 := DecodeFromFile("cms31451.bin")
+	cms3, _ := DecodeFromFile("cms31451.bin")
 	fmt.Println(cms3.Query([]byte{1, 2}))
 	fmt.Println(cms3.Query([]byte{3, 4}))
 	fmt.Println(cms3.Query([]byte{2, 5}))
@@ -93,10 +93,11 @@ func (hll *HLL) Estimate() float64 {
 
 // Reads data from a file and returns a hyperloglog generated by it.
 // Uses gob encoding.
-func DecodeFromFile(filename string) *HLL {
+// Returns an error if the file can't be read or doesn't hold a valid hyperloglog.
+func DecodeFromFile(filename string) (*HLL, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer f.Close()
 	return decode(f)
@@ -104,23 +105,33 @@ func DecodeFromFile(filename string) *HLL {
 
 // Reads data from a byte sequence and returns a hyperloglog generated by it.
 // Uses gob encoding.
-func DecodeFromBytes(data []byte) *HLL {
+// Returns an error if the data doesn't hold a valid hyperloglog.
+func DecodeFromBytes(data []byte) (*HLL, error) {
 	reader := bytes.NewReader(data)
 	return decode(reader)
 }
 
 // Read from decoder. Uses gob encoding.
-func decode(reader io.Reader) *HLL {
+// Returns an error if the data can't be decoded, or if the precision and registers don't match, so
+// that a damaged hyperloglog is never used (Add would index past the registers).
+func decode(reader io.Reader) (*HLL, error) {
 	// Read all data into the filter.
 
 	decoder := gob.NewDecoder(reader)
 	hll := &HLL{}
 	err := decoder.Decode(hll)
 	if err != nil && err != io.EOF {
-		panic(err)
+		return nil, err
+	}
+
+	if hll.P < HLL_MIN_PRECISION || hll.P > HLL_MAX_PRECISION {
+		return nil, fmt.Errorf("hll: precision must be between %d and %d, but it's %d", HLL_MIN_PRECISION, HLL_MAX_PRECISION, hll.P)
+	}
+	if hll.M != 1<<hll.P || uint64(len(hll.Reg)) != hll.M {
+		return nil, fmt.Errorf("hll: %d registers and M of %d, but precision %d needs %d", len(hll.Reg), hll.M, hll.P, 1<<hll.P)
 	}
 
-	return hll
+	return hll, nil
 }
 
 // Writes hyperloglog data into a file.
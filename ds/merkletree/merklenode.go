@@ -34,7 +34,7 @@ func NewLeaf(data []byte) MerkleNode {
 }
 
 // Serialize appends node data to the specified file.
-func (node *MerkleNode) Serialize(writer *bufio.Writer) {
+func (node *MerkleNode) Serialize(writer *bufio.Writer) error {
 	// Flags
 
 	flags := byte(0)
@@ -49,7 +49,7 @@ func (node *MerkleNode) Serialize(writer *bufio.Writer) {
 
 	_, err := writer.Write(flagsBuffer)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	if (flags & MERKLE_NODE_EMPTY) == MERKLE_NODE_EMPTY {
@@ -57,23 +57,22 @@ func (node *MerkleNode) Serialize(writer *bufio.Writer) {
 	} else {
 		_, err := writer.Write(node.Data)
 		if err != nil {
-			panic(err)
+			return err
 		}
 	}
+	return nil
 }
 
 // Deserialize reads data from file reader into this node's Data field.
 // Child references are not overwritten!
-func (node *MerkleNode) Deserialize(reader *bufio.Reader) bool {
+// Returns io.EOF if there are no more nodes, and io.ErrUnexpectedEOF if the reader ends in the
+// middle of a node.
+func (node *MerkleNode) Deserialize(reader *bufio.Reader) error {
 	flagsBuf := make([]byte, 1)
 	_, err := io.ReadFull(reader, flagsBuf)
 
 	if err != nil {
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
-			return true
-		} else {
-			panic(err)
-		}
+		return err
 	}
 
 	if (flagsBuf[0] & MERKLE_NODE_EMPTY) == MERKLE_NODE_EMPTY {
@@ -82,17 +81,16 @@ func (node *MerkleNode) Deserialize(reader *bufio.Reader) bool {
 		dataBuf := make([]byte, 20)
 		_, err = io.ReadFull(reader, dataBuf)
 
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
 		if err != nil {
-			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				return true
-			} else {
-				panic(err)
-			}
+			return err
 		}
 
 		node.Data = dataBuf[:]
 	}
-	return false
+	return nil
 }
 
 // rehash recalculates the hash data for this node (and all its child nodes).
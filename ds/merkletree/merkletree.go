@@ -6,6 +6,7 @@ import (
 	"bufio"
 	"crypto/sha1"
 	"errors"
+	"io"
 	"os"
 )
 
@@ -64,14 +65,24 @@ func (tree *MerkleTree) build(level []MerkleNode) []MerkleNode {
 }
 
 // Serialize writes the entire tree to disk using breadth-first traversal.
-func (tree *MerkleTree) Serialize(fname string) {
-	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE, 0666)
+func (tree *MerkleTree) Serialize(fname string) error {
+	file, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
 	if err != nil {
-		panic(err)
+		return err
 	}
 	defer file.Close()
 	writer := bufio.NewWriter(file)
 
+	err = tree.Write(writer)
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// Write appends the entire tree to a buffered writer using breadth-first traversal, in the same
+// format as Serialize. The writer does not get flushed.
+func (tree *MerkleTree) Write(writer *bufio.Writer) error {
 	queue := make([]*MerkleNode, 0)
 	queue = append(queue, tree.Root)
 	for len(queue) > 0 {
@@ -85,42 +96,51 @@ func (tree *MerkleTree) Serialize(fname string) {
 			queue = append(queue, n.Right)
 		}
 
-		n.Serialize(writer)
+		err := n.Serialize(writer)
+		if err != nil {
+			return err
+		}
 	}
 
-	writer.Flush()
+	return nil
 }
 
 // Deserialize builds the tree from a file.
 // The file should be generated by Serialize().
 // All old data of the tree is removed.
-func (tree *MerkleTree) Deserialize(fname string) {
-	nodes := make([]MerkleNode, 0)
-
-	// Load tree into linear array.
-
+func (tree *MerkleTree) Deserialize(fname string) error {
 	file, err := os.OpenFile(fname, os.O_RDONLY, 0666)
 	if err != nil {
-		panic(err)
+		return err
 	}
-	reader := bufio.NewReader(file)
+	defer file.Close()
+	return tree.Read(bufio.NewReader(file))
+}
+
+// Read builds the tree from the nodes left in a buffered reader, in the format written by Write.
+// All old data of the tree is removed.
+func (tree *MerkleTree) Read(reader *bufio.Reader) error {
+	nodes := make([]MerkleNode, 0)
+
+	// Load tree into linear array.
 
 	for true {
 		n := MerkleNode{}
-		eof := n.Deserialize(reader)
-		if eof {
+		err := n.Deserialize(reader)
+		if err == io.EOF {
 			break
 		}
+		if err != nil {
+			return err
+		}
 		nodes = append(nodes, n)
 	}
 
-	file.Close()
-
 	// In case nothing was loaded, we're done.
 
 	if len(nodes) == 0 {
 		tree.Root = nil
-		return
+		return nil
 	}
 
 	// We have a slice of nodes now, so we'll build the tree.
@@ -154,6 +174,8 @@ func (tree *MerkleTree) Deserialize(fname string) {
 		i++
 		queue = append(queue, nodes[i])
 	}
+
+	return nil
 }
 
 // Validate recalculates the hash for the root and compares it with the current hash.
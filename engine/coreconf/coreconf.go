@@ -10,10 +10,13 @@ import (
 	"nakevaleng/core/lru"
 	"nakevaleng/core/lsmtree"
 	"nakevaleng/core/skiplist"
+	"nakevaleng/core/sstable"
 	"nakevaleng/core/wal"
 	"nakevaleng/ds/tokenbucket"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -23,6 +26,12 @@ const (
 	_FLUSH_THRESHOLD = 1 << 1
 )
 
+// Possible values for CompactionStrategy.
+const (
+	COMPACTION_SIZE_TIERED = "size_tiered"
+	COMPACTION_LEVELED     = "leveled"
+)
+
 // Default values for the configuration.
 const (
 	PATH                    = "data/"
@@ -33,15 +42,26 @@ const (
 	MEMTABLE_CAPACITY       = 10
 	MEMTABLE_THRESHOLD      = "2 KB" // The space is important!
 	MEMTABLE_FLUSH_STRATEGY = _FLUSH_CAPACITY | _FLUSH_THRESHOLD
+	MEMTABLE_MAX_IMMUTABLE  = 2
 	CACHE_CAPACITY          = 5
+	TABLE_CACHE_CAPACITY    = 16
 	SUMMARY_PAGE_SIZE       = 3
+	SSTABLE_CODEC           = sstable.CODEC_NONE
+	SSTABLE_LAYOUT          = sstable.LAYOUT_MULTI
 	LSM_LVL_MAX             = 4
 	LSM_RUN_MAX             = 4
+	COMPACTION_STRATEGY     = COMPACTION_SIZE_TIERED
+	LSM_LEVEL_SIZE          = "16 KB"
+	LSM_LEVEL_MULTIPLIER    = 10
+	LSM_TABLE_SIZE          = "4 KB"
 	TOKENBUCKET_TOKENS      = 100
 	TOKENBUCKET_INTERVAL    = 1
-	WAL_MAX_RECS_IN_SEG     = 5
+	WAL_SEGMENT_SIZE        = "1 KB"
 	WAL_LWM_IDX             = 2
 	WAL_BUFFER_CAPACITY     = 5
+	WAL_SYNC_MODE           = wal.SYNC_BUFFER
+	WAL_SYNC_INTERVAL       = 100
+	WAL_ARCHIVE_PATH        = "" // No archive: retired segments are removed.
 	INTERNAL_START          = "$"
 )
 
@@ -56,15 +76,30 @@ type CoreConfig struct {
 	MemtableCapacity      int    `yaml:"memtable_capacity"`
 	MemtableThreshold     string `yaml:"memtable_threshold"`
 	MemtableFlushStrategy int    `yaml:"memtable_flush_strategy"`
+	MemtableMaxImmutable  int    `yaml:"memtable_max_immutable"`
 	CacheCapacity         int    `yaml:"cache_capacity"`
+	TableCacheCapacity    int    `yaml:"table_cache_capacity"`
 	SummaryPageSize       int    `yaml:"summary_page_size"`
+	SSTableCodec          string `yaml:"sstable_codec"`
+	SSTableLayout         string `yaml:"sstable_layout"`
 	LsmLvlMax             int    `yaml:"lsm_lvl_max"`
 	LsmRunMax             int    `yaml:"lsm_run_max"`
+	CompactionStrategy    string `yaml:"compaction_strategy"`
+	LsmLevelSize          string `yaml:"lsm_level_size"`
+	LsmLevelMultiplier    int    `yaml:"lsm_level_multiplier"`
+	LsmTableSize          string `yaml:"lsm_table_size"`
 	TokenBucketTokens     int    `yaml:"token_bucket_tokens"`
 	TokenBucketInterval   int64  `yaml:"token_bucket_interval"`
-	WalMaxRecsInSeg       int    `yaml:"wal_max_recs_in_seg"`
+	WalSegmentSize        string `yaml:"wal_segment_size"`
 	WalLwmIdx             int    `yaml:"wal_lwm_idx"`
 	WalBufferCapacity     int    `yaml:"wal_buffer_capacity"`
+	WalSyncMode           string `yaml:"wal_sync_mode"`
+	WalSyncInterval       int    `yaml:"wal_sync_interval"`
+	WalArchivePath        string `yaml:"wal_archive_path"`
+
+	// Deprecated: segments are rotated by size now, see WalSegmentSize. Still accepted, so that
+	// configs written before that keep loading, but ignored.
+	WalMaxRecsInSeg int `yaml:"wal_max_recs_in_seg,omitempty"`
 
 	InternalStart string `yaml:"internal_start"`
 }
@@ -92,37 +127,54 @@ func GetDefault() CoreConfig {
 	config.MemtableCapacity = MEMTABLE_CAPACITY
 	config.MemtableThreshold = MEMTABLE_THRESHOLD
 	config.MemtableFlushStrategy = MEMTABLE_FLUSH_STRATEGY
+	config.MemtableMaxImmutable = MEMTABLE_MAX_IMMUTABLE
 	config.CacheCapacity = CACHE_CAPACITY
+	config.TableCacheCapacity = TABLE_CACHE_CAPACITY
 	config.SummaryPageSize = SUMMARY_PAGE_SIZE
+	config.SSTableCodec = SSTABLE_CODEC
+	config.SSTableLayout = SSTABLE_LAYOUT
 	config.LsmLvlMax = LSM_LVL_MAX
 	config.LsmRunMax = LSM_RUN_MAX
+	config.CompactionStrategy = COMPACTION_STRATEGY
+	config.LsmLevelSize = LSM_LEVEL_SIZE
+	config.LsmLevelMultiplier = LSM_LEVEL_MULTIPLIER
+	config.LsmTableSize = LSM_TABLE_SIZE
 	config.TokenBucketTokens = TOKENBUCKET_TOKENS
 	config.TokenBucketInterval = TOKENBUCKET_INTERVAL
-	config.WalMaxRecsInSeg = WAL_MAX_RECS_IN_SEG
+	config.WalSegmentSize = WAL_SEGMENT_SIZE
 	config.WalLwmIdx = WAL_LWM_IDX
 	config.WalBufferCapacity = WAL_BUFFER_CAPACITY
+	config.WalSyncMode = WAL_SYNC_MODE
+	config.WalSyncInterval = WAL_SYNC_INTERVAL
+	config.WalArchivePath = WAL_ARCHIVE_PATH
 	config.InternalStart = INTERNAL_START
 	return config
 }
 
 // LoadConfig reads the YAML file at filePath and returns a config object and
 // an error indicating whether or not the config object was made successfully.
+// If the file can't be read, the defaults are used. If it can, but isn't valid, an error is
+// returned, rather than running with settings nobody asked for.
 func LoadConfig(filePath string) (*CoreConfig, error) {
 	config := GetDefault()
 
 	configData, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		log.Println("Config file at", filePath, "is not available for reading. Using defaults")
-	} else {
-		err = yaml.UnmarshalStrict(configData, &config)
-		if err != nil {
-			log.Println("Config file at", filePath, "is not valid. Using defaults. Error is:\n", err)
-		} else {
-			err := config.validate()
-			if err != nil {
-				return nil, err
-			}
-		}
+		return &config, nil
+	}
+
+	err = yaml.UnmarshalStrict(configData, &config)
+	if err != nil {
+		return nil, fmt.Errorf("config file at %s is not valid: %w", filePath, err)
+	}
+	if config.WalMaxRecsInSeg != 0 {
+		log.Println("Config file at", filePath, "sets wal_max_recs_in_seg, which is ignored. Use wal_segment_size instead")
+		config.WalMaxRecsInSeg = 0
+	}
+	err = config.validate()
+	if err != nil {
+		return nil, err
 	}
 
 	return &config, nil
@@ -152,30 +204,77 @@ func (conf *CoreConfig) validate() error {
 		return err
 	}
 
+	if conf.MemtableMaxImmutable <= 0 {
+		err := fmt.Errorf("memtable config: max immutable must be a positive number, but %d was given", conf.MemtableMaxImmutable)
+		return err
+	}
+
 	err = lru.ValidateParams(conf.CacheCapacity)
 	if err != nil {
 		err := fmt.Errorf("lru config: %s", err.Error())
 		return err
 	}
 
+	err = sstable.ValidateCacheParams(conf.TableCacheCapacity)
+	if err != nil {
+		err := fmt.Errorf("table cache config: %s", err.Error())
+		return err
+	}
+
+	err = sstable.ValidateCodec(conf.SSTableCodec)
+	if err != nil {
+		err := fmt.Errorf("sstable config: %s", err.Error())
+		return err
+	}
+
+	err = sstable.ValidateLayout(conf.SSTableLayout)
+	if err != nil {
+		err := fmt.Errorf("sstable config: %s", err.Error())
+		return err
+	}
+
 	err = lsmtree.ValidateParams(conf.SummaryPageSize, 1, conf.LsmLvlMax, conf.LsmRunMax)
 	if err != nil {
 		err := fmt.Errorf("lsm config: %s", err.Error())
 		return err
 	}
 
+	_, err = conf.LsmStrategy()
+	if err != nil {
+		err := fmt.Errorf("lsm config: %s", err.Error())
+		return err
+	}
+
 	err = tokenbucket.ValidateParams(conf.TokenBucketTokens, conf.TokenBucketInterval)
 	if err != nil {
 		err := fmt.Errorf("tokenbucket config: %s", err.Error())
 		return err
 	}
 
-	err = wal.ValidateParams(conf.WalMaxRecsInSeg, conf.WalLwmIdx, conf.WalBufferCapacity)
+	segmentSize, err := conf.WalSegmentSizeBytes()
+	if err != nil {
+		err := fmt.Errorf("wal config: %s", err.Error())
+		return err
+	}
+	err = wal.ValidateParams(segmentSize, conf.WalLwmIdx, conf.WalBufferCapacity)
 	if err != nil {
 		err := fmt.Errorf("wal config: %s", err.Error())
 		return err
 	}
 
+	err = wal.ValidateSyncParams(conf.WalSyncMode, conf.WalSyncIntervalDuration())
+	if err != nil {
+		err := fmt.Errorf("wal config: %s", err.Error())
+		return err
+	}
+
+	if conf.WalArchivePath != "" {
+		if filepath.Clean(conf.WalArchivePath) == filepath.Clean(conf.WalPath) {
+			err := fmt.Errorf("wal config: archive path \"%s\" must not be the wal path", conf.WalArchivePath)
+			return err
+		}
+	}
+
 	if conf.InternalStart == "" {
 		return errors.New("internal start cannot be an empty string")
 	}
@@ -184,20 +283,73 @@ func (conf *CoreConfig) validate() error {
 }
 
 // Dump writes the config object to filePath.
-func (conf CoreConfig) Dump(filePath string) {
+func (conf CoreConfig) Dump(filePath string) error {
 	configData, err := yaml.Marshal(conf)
 	if err != nil {
-		panic(err)
-	}
-	err = ioutil.WriteFile(filePath, configData, 0644)
-	if err != nil {
-		log.Println("Can't dump at", filePath)
+		return err
 	}
+	return ioutil.WriteFile(filePath, configData, 0644)
 }
 
 // MemtableThresholdBytes parses the config's memtable threshold
 // parameter and returns it as an uint64.
 func (conf *CoreConfig) MemtableThresholdBytes() (uint64, error) {
+	bytes, err := parseBytes(conf.MemtableThreshold)
+	if err != nil {
+		conf.MemtableThreshold = GetDefault().MemtableThreshold
+		fallback, _ := conf.MemtableThresholdBytes()
+		return fallback, err
+	}
+	return bytes, nil
+}
+
+// WalSegmentSizeBytes parses the config's WAL segment size parameter and returns it in bytes.
+func (conf *CoreConfig) WalSegmentSizeBytes() (uint64, error) {
+	bytes, err := parseBytes(conf.WalSegmentSize)
+	if err != nil {
+		return 0, fmt.Errorf("segment size: %s", err.Error())
+	}
+	return bytes, nil
+}
+
+// WalSyncIntervalDuration returns the interval at which the WAL is synced in the background, which
+// is kept in the config in milliseconds.
+func (conf *CoreConfig) WalSyncIntervalDuration() time.Duration {
+	return time.Duration(conf.WalSyncInterval) * time.Millisecond
+}
+
+// LsmStrategy returns the compaction strategy described by the config, and an error if any of
+// its parameters is not valid.
+func (conf *CoreConfig) LsmStrategy() (lsmtree.Strategy, error) {
+	var strategy lsmtree.Strategy
+
+	switch conf.CompactionStrategy {
+	case COMPACTION_SIZE_TIERED:
+		strategy = lsmtree.SizeTiered{}
+	case COMPACTION_LEVELED:
+		levelSize, err := parseBytes(conf.LsmLevelSize)
+		if err != nil {
+			return nil, fmt.Errorf("level size: %s", err.Error())
+		}
+		tableSize, err := parseBytes(conf.LsmTableSize)
+		if err != nil {
+			return nil, fmt.Errorf("table size: %s", err.Error())
+		}
+		strategy = lsmtree.Leveled{
+			LevelSize:  levelSize,
+			Multiplier: conf.LsmLevelMultiplier,
+			TableSize:  tableSize,
+		}
+	default:
+		return nil, fmt.Errorf("compaction strategy must be \"%s\" or \"%s\", but \"%s\" was given",
+			COMPACTION_SIZE_TIERED, COMPACTION_LEVELED, conf.CompactionStrategy)
+	}
+
+	return strategy, strategy.Validate()
+}
+
+// parseBytes parses a size such as "2 KB" or "16MB" and returns it in bytes.
+func parseBytes(size string) (uint64, error) {
 	isNum := func(s rune) bool {
 		return s >= '0' && s <= '9'
 	}
@@ -210,7 +362,7 @@ func (conf *CoreConfig) MemtableThresholdBytes() (uint64, error) {
 		"", // Unit of memory
 	}
 
-	for _, ch := range conf.MemtableThreshold {
+	for _, ch := range size {
 		if ch == ' ' {
 			continue
 		}
@@ -226,9 +378,7 @@ func (conf *CoreConfig) MemtableThresholdBytes() (uint64, error) {
 	// How many units
 	howMany, err := strconv.Atoi(parts[0])
 	if err != nil {
-		conf.MemtableThreshold = GetDefault().MemtableThreshold
-		fallback, _ := conf.MemtableThresholdBytes()
-		return fallback, err
+		return 0, err
 	}
 	unit := parts[1]
 
@@ -242,9 +392,7 @@ func (conf *CoreConfig) MemtableThresholdBytes() (uint64, error) {
 	// Bad unit
 	exp, ok := exponent[unit]
 	if !ok {
-		conf.MemtableThreshold = GetDefault().MemtableThreshold
-		fallback, _ := conf.MemtableThresholdBytes()
-		return fallback, fmt.Errorf("bad unit: %s", unit)
+		return 0, fmt.Errorf("bad unit: %s", unit)
 	}
 
 	// Convert to bytes
@@ -0,0 +1,141 @@
+package coreeng
+
+import (
+	"fmt"
+	"nakevaleng/core/manifest"
+	"nakevaleng/core/sstable"
+	"nakevaleng/core/wal"
+	"nakevaleng/util/filename"
+	"os"
+	"path/filepath"
+)
+
+// Backup copies the database into the directory at dir (ending with '/'), which restore.Restore
+// can bring it back from, on its own or along with the records archived since (see
+// wal_archive_path). The backup holds the tables listed in the manifest, a manifest listing them,
+// and the WAL's segments, which go into filename.BackupLog(dir). Tables never change once
+// written, so their files are hard linked where possible.
+// The WAL is cut first, so the backup holds every write made before Backup was called. Only that
+// and picking what to copy is done under the write lock. The copying itself isn't, so writes,
+// flushes and compactions go on meanwhile: the tables are pinned in the manifest, so compactions
+// leave their files in place, and the segments are opened up front, so they stay readable even if
+// they're removed.
+func (cen *CoreEngine) Backup(dir string) error {
+	dbname := cen.conf.DBName
+	_, err := os.Stat(filename.Manifest(dir, dbname))
+	if err == nil {
+		return fmt.Errorf("backup: %s already holds a backup of %s", dir, dbname)
+	}
+	logDir := filename.BackupLog(dir)
+	err = os.MkdirAll(logDir, 0777)
+	if err != nil {
+		return err
+	}
+
+	cen.mu.Lock()
+	if cen.closed {
+		cen.mu.Unlock()
+		return ErrClosed
+	}
+	lastSegment, err := cen.wal.CutSegment()
+	if err != nil {
+		cen.mu.Unlock()
+		return err
+	}
+	segments, err := openSegmentsBefore(cen.conf.WalPath, dbname, lastSegment)
+	if err != nil {
+		cen.mu.Unlock()
+		return err
+	}
+	tables := cen.manifest.Snapshot()
+	ids := make([]manifest.TableID, len(tables))
+	for i, t := range tables {
+		ids[i] = manifest.TableID{Level: t.Level, Run: t.Run}
+	}
+	cen.manifest.Ref(ids)
+	cen.mu.Unlock()
+
+	defer func() {
+		for _, segment := range segments {
+			segment.Close()
+		}
+	}()
+	err = cen.copyBackup(dir, tables, segments, lastSegment)
+
+	// Tables removed by a compaction while they were pinned are left for the last Unref to remove.
+
+	cen.mu.Lock()
+	for _, id := range cen.manifest.Unref(ids) {
+		removeErr := sstable.RemoveTable(cen.conf.Path, dbname, id.Level, id.Run)
+		if err == nil {
+			err = removeErr
+		}
+	}
+	cen.mu.Unlock()
+
+	if err == nil {
+		fmt.Println("[DBG]\t[Backup] Copied", len(tables), "tables and", len(segments)+1, "segments into", dir)
+	}
+	return err
+}
+
+// copyBackup copies the tables, a manifest listing them and the segments into the backup at dir.
+// The last segment was empty when the WAL was cut, so an empty one is created in its place.
+func (cen *CoreEngine) copyBackup(dir string, tables []manifest.Table, segments []*os.File, lastSegment int) error {
+	dbname := cen.conf.DBName
+	logDir := filename.BackupLog(dir)
+
+	for _, t := range tables {
+		err := sstable.LinkTable(cen.conf.Path, dbname, t.Level, t.Run, dir, dbname, t.Level, t.Run)
+		if err != nil {
+			return err
+		}
+	}
+	err := manifest.WriteSnapshot(dir, dbname, tables)
+	if err != nil {
+		return err
+	}
+
+	for _, segment := range segments {
+		err = filename.CopyFrom(segment, logDir+filepath.Base(segment.Name()))
+		if err != nil {
+			return err
+		}
+	}
+	err = wal.CreateSegment(logDir, dbname, lastSegment)
+	if err != nil {
+		return err
+	}
+
+	err = filename.SyncDir(logDir)
+	if err == nil {
+		err = filename.SyncDir(dir)
+	}
+	return err
+}
+
+// openSegmentsBefore opens the segments of the WAL at walPath whose IDs are lower than the given
+// one, from the oldest to the newest.
+func openSegmentsBefore(walPath, dbname string, id int) ([]*os.File, error) {
+	segmentPaths, err := filename.GetSegmentPaths(walPath, dbname)
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []*os.File{}
+	for _, segmentPath := range segmentPaths {
+		_, segmentID, _, _ := filename.Query(filepath.Base(segmentPath))
+		if segmentID >= id {
+			continue
+		}
+		segment, err := os.Open(segmentPath)
+		if err != nil {
+			for _, segment := range segments {
+				segment.Close()
+			}
+			return nil, err
+		}
+		segments = append(segments, segment)
+	}
+	return segments, nil
+}
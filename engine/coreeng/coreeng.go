@@ -3,86 +3,293 @@
 package coreeng
 
 import (
-	"bufio"
+	"bytes"
+	"errors"
 	"fmt"
 	"nakevaleng/core/memtable"
 	"nakevaleng/core/wal"
 	"nakevaleng/engine/coreconf"
 	"os"
+	"sync"
 	"time"
 
 	"nakevaleng/core/lru"
+	"nakevaleng/core/lsmtree"
+	"nakevaleng/core/manifest"
 	"nakevaleng/core/record"
 	"nakevaleng/core/sstable"
-	"nakevaleng/ds/bloomfilter"
 	"nakevaleng/ds/tokenbucket"
 	"nakevaleng/util/filename"
 )
 
+// Errors returned by CoreEngine. Errors caused by damaged files wrap ErrCorruption, so use
+// errors.Is to check for any of these.
+var (
+	ErrNotFound    = errors.New("record not found")
+	ErrRateLimited = errors.New("rate limit exceeded")
+	ErrIllegalKey  = errors.New("illegal key")
+	ErrClosed      = errors.New("engine closed")
+	ErrCorruption  = record.ErrCorruption
+)
+
 // CoreEngine is an aggregate structure of all components required for a complete read and write path for nakevaleng.
+// It's safe for concurrent use. Reads share the engine, while writes are serialized, which also
+// serializes appends to the WAL. Token buckets are updated in memory under their own lock, so that
+// taking a token doesn't serialize reads, and are written into the Memtable once it's full. They're
+// not durable: they aren't logged in the WAL, so tokens taken since the last full Memtable are
+// given back on a restart, crash or not.
+// Waiting for the WAL to be synced is done outside of the lock, see commit.
+// Full Memtables are flushed to disk in the background, see flush.go. The LSM tree is compacted in
+// the background too, by an lsmtree.Scheduler that takes the write lock to swap tables.
 type CoreEngine struct {
 	conf  *coreconf.CoreConfig
 	cache *lru.LRU
 	mt    *memtable.Memtable
 	wal   *wal.WAL
+	seq   uint64       // Sequence number of the last record written
+	mu    sync.RWMutex // Guards everything except conf and the cache, which has its own lock.
+
+	imm         []*memtable.Memtable // Full Memtables waiting to be flushed, from the oldest to the newest.
+	immSegments []int                // For each of imm, the ID of the first WAL segment not holding its records.
+	walFlushed  int                  // ID of the first WAL segment holding records that aren't in SSTables.
+	flushCond   *sync.Cond           // Signaled whenever imm changes. Uses mu.
+	flushErr    error                // Error that stopped the background flusher.
+	closed      bool                 // Set by Close.
+	flusherDone chan struct{}        // Closed once the background flusher stops.
+	compactor   *lsmtree.Scheduler   // Compacts the LSM tree in the background.
+	manifest    *manifest.Manifest   // Lists the SSTables that make up the LSM tree.
+	tables      *sstable.TableCache  // Keeps recently read SSTables open. Has its own lock.
+
+	buckets   map[string]*tokenbucket.TokenBucket // Token buckets used since the last rotate, by user.
+	bucketsMu sync.Mutex                          // Guards buckets. Taken while holding mu for reading.
 }
 
 // New returns a pointer to a new CoreEngine object, as well as an error
 // indicating whether or not it was successful.
 func New(conf *coreconf.CoreConfig) (*CoreEngine, error) {
-	// Since New uses CoreConfig (which should always have valid values), we don't need to check for errors here
-	lru, _ := lru.New(conf.CacheCapacity)
-	memtable, _ := memtable.New(conf)
-	wal, _ := wal.New(conf.WalPath, conf.DBName, conf.WalMaxRecsInSeg, conf.WalLwmIdx, conf.WalBufferCapacity)
-
-	return &CoreEngine{
-		conf,
-		lru,
-		memtable,
-		wal,
-	}, nil
+	lru, err := lru.New(conf.CacheCapacity)
+	if err != nil {
+		return nil, err
+	}
+	memtable, err := memtable.New(conf)
+	if err != nil {
+		return nil, err
+	}
+	segmentSize, err := conf.WalSegmentSizeBytes()
+	if err != nil {
+		return nil, err
+	}
+	wal, err := wal.New(conf.WalPath, conf.DBName, segmentSize, conf.WalLwmIdx, conf.WalBufferCapacity,
+		conf.WalSyncMode, conf.WalSyncIntervalDuration())
+	if err != nil {
+		return nil, err
+	}
+	if conf.WalArchivePath != "" {
+		err = wal.SetArchivePath(conf.WalArchivePath)
+		if err != nil {
+			wal.Close()
+			return nil, err
+		}
+	}
+	tables, err := sstable.NewTableCache(conf.Path, conf.DBName, conf.TableCacheCapacity)
+	if err != nil {
+		return nil, err
+	}
+
+	cen := &CoreEngine{
+		conf:        conf,
+		cache:       lru,
+		mt:          memtable,
+		wal:         wal,
+		tables:      tables,
+		flusherDone: make(chan struct{}),
+		buckets:     make(map[string]*tokenbucket.TokenBucket),
+	}
+	cen.flushCond = sync.NewCond(&cen.mu)
+
+	// Anything left in the staging directory is from a flush or compaction that never finished.
+	// The records are still in the WAL, or in the tables that were being compacted.
+
+	err = os.RemoveAll(filename.Staging(conf.Path))
+	if err != nil {
+		return nil, err
+	}
+	err = os.MkdirAll(filename.Staging(conf.Path), 0777)
+	if err != nil {
+		return nil, err
+	}
+
+	strategy, err := conf.LsmStrategy()
+	if err != nil {
+		return nil, err
+	}
+	cen.manifest, err = manifest.Open(conf.Path, conf.DBName)
+	if err != nil {
+		return nil, err
+	}
+	orphans, err := cen.manifest.RemoveOrphans()
+	if err != nil {
+		cen.manifest.Close()
+		cen.wal.Close()
+		return nil, err
+	}
+	if orphans > 0 {
+		fmt.Println("[DBG]\t[Manifest] Removed", orphans, "files of unfinished flushes and compactions")
+	}
+	cen.seq = cen.lastSeqOnDisk()
+
+	// The scheduler may start compacting right away, so recovery must hold the lock while it adds
+	// tables, like the flusher does.
+
+	cen.compactor, err = lsmtree.NewScheduler(cen.manifest, conf.SummaryPageSize, conf.SSTableCodec, conf.SSTableLayout, conf.LsmLvlMax, conf.LsmRunMax, strategy, &cen.mu, cen.tables)
+	if err != nil {
+		cen.manifest.Close()
+		cen.wal.Close()
+		return nil, err
+	}
+	cen.mu.Lock()
+	err = cen.recover()
+	cen.mu.Unlock()
+	if err != nil {
+		cen.compactor.Close()
+		cen.manifest.Close()
+		cen.tables.Close()
+		cen.wal.Close()
+		return nil, err
+	}
+
+	go cen.flushLoop()
+
+	return cen, nil
 }
 
-// IsLegal returns true if legal key, otherwise false.
-func (cen CoreEngine) IsLegal(key []byte) bool {
-	start := []byte(cen.conf.InternalStart)
-	count := 0
-	for i, c := range start {
-		if key[i] == c {
-			count += 1
+// recover rebuilds the Memtable from the records found in the WAL. Records are applied in the
+// order they were logged, and the newest version of each key (including tombstones) wins.
+// The engine's sequence number is moved past the greatest one found in the WAL.
+// If the Memtable fills up during recovery, it's flushed right away, since the background flusher
+// isn't running yet. In that case the rest of the replayed records are flushed as well once the
+// replay is done, and the WAL is cut and its segments removed, like after a regular flush.
+// Otherwise every restart before the next regular flush would replay the same records and write
+// the same tables again.
+func (cen *CoreEngine) recover() error {
+	replayed := 0
+	flushed := false
+
+	_, err := cen.wal.Replay(func(rec record.Record) error {
+		// Records written before sequence numbers were added have none, so they're given new ones
+		// in the order they were written in. They're newer than anything in the tables.
+		if rec.Seq == 0 {
+			rec.Seq = cen.nextSeq()
+		}
+		if rec.Seq > cen.seq {
+			cen.seq = rec.Seq
 		}
+
+		old, exists := cen.mt.Find(rec.Key)
+		if exists && old.Seq > rec.Seq {
+			return nil
+		}
+
+		cen.mt.Add(rec)
+		replayed++
+
+		if cen.mt.ShouldFlush() {
+			err := cen.writeTable(cen.mt)
+			if err != nil {
+				return err
+			}
+			flushed = true
+			cen.mt, err = memtable.New(cen.conf)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("[DBG]\t[WAL] Replayed %d records\n", replayed)
+
+	if !flushed {
+		return nil
 	}
-	if count == len(start) {
-		return false
+	count, _ := cen.mt.Count()
+	if count > 0 {
+		err = cen.writeTable(cen.mt)
+		if err != nil {
+			return err
+		}
+		cen.mt, err = memtable.New(cen.conf)
+		if err != nil {
+			return err
+		}
 	}
-	return true
+	lowWaterMark, err := cen.wal.CutSegment()
+	if err != nil {
+		return err
+	}
+	cen.walFlushed = lowWaterMark
+	_, err = cen.wal.DeleteSegmentsBefore(lowWaterMark)
+	return err
+}
+
+// lastSeqOnDisk returns the greatest sequence number of all records in all SSTables, as kept in
+// the manifest.
+func (cen *CoreEngine) lastSeqOnDisk() uint64 {
+	seq := uint64(0)
+
+	for j := 1; j <= cen.manifest.LastLevel(); j++ {
+		for _, t := range cen.manifest.Tables(j) {
+			if t.MaxSeq > seq {
+				seq = t.MaxSeq
+			}
+		}
+	}
+
+	return seq
 }
 
-// Get returns a record stored in the system based on the passed key, as well as
-// whether or not the record is present.
-func (cen CoreEngine) Get(user, key []byte) (record.Record, bool) {
+// nextSeq returns the sequence number for a new record. The caller must hold the write lock.
+func (cen *CoreEngine) nextSeq() uint64 {
+	cen.seq++
+	return cen.seq
+}
+
+// IsLegal returns true if legal key, otherwise false.
+func (cen *CoreEngine) IsLegal(key []byte) bool {
+	return !bytes.HasPrefix(key, []byte(cen.conf.InternalStart))
+}
+
+// Get returns a record stored in the system based on the passed key.
+// Returns ErrNotFound if the record isn't present (or is deleted), ErrIllegalKey if the key is
+// reserved for internal use and ErrRateLimited if the user ran out of tokens.
+func (cen *CoreEngine) Get(user, key []byte) (record.Record, error) {
 	legal := cen.IsLegal(key)
 	if !legal {
-		return record.Record{}, false
+		return record.Record{}, ErrIllegalKey
 	}
-	tb := cen.getTokenBucket(user)
-	if !tb.HasEnoughTokens() {
-		fmt.Printf("Slow down, %d seconds to go\n", tb.ResetInterval-(time.Now().Unix()-tb.Timestamp))
-		return record.Record{}, false
+	err := cen.takeToken(user)
+	if err != nil {
+		return record.Record{}, err
 	}
-	cen.putTokenBucket(user, tb)
+
+	cen.mu.RLock()
+	defer cen.mu.RUnlock()
 	return cen.get(key)
 }
 
-// Get without checking legality or getting token buckets
-func (cen CoreEngine) get(key []byte) (record.Record, bool) {
+// Get without checking legality or getting token buckets. The caller must hold the lock.
+// Memtables waiting to be flushed are searched after the current one, from the newest to the oldest.
+func (cen *CoreEngine) get(key []byte) (record.Record, error) {
 	rec, exists := cen.mt.Find(key)
+	for i := len(cen.imm) - 1; i >= 0 && !exists; i-- {
+		rec, exists = cen.imm[i].Find(key)
+	}
 	if exists {
 		cen.cache.Set(rec)
 		if rec.IsDeleted() {
-			return record.Record{}, false
+			return record.Record{}, ErrNotFound
 		}
-		return rec, true
+		return rec, nil
 	}
 
 	// Cache
@@ -91,118 +298,324 @@ func (cen CoreEngine) get(key []byte) (record.Record, bool) {
 	if foundInCache {
 		cen.cache.Set(r)
 		if r.IsDeleted() {
-			return record.Record{}, false
+			return record.Record{}, ErrNotFound
 		}
-		return r, true
+		return r, nil
 	}
 
 	// Disk
 
-	greatestLevel := filename.GetLastLevel(cen.conf.Path, cen.conf.DBName)
+	for j := 1; j <= cen.manifest.LastLevel(); j++ {
+		tables := cen.manifest.Tables(j)
 
-	for j := 1; j <= greatestLevel; j++ {
-		greatestRun := filename.GetLastRun(cen.conf.Path, cen.conf.DBName, j)
+		for k := len(tables) - 1; k >= 0; k-- {
+			if !tables[k].Contains(key) {
+				continue
+			}
 
-		for i := greatestRun; i >= 0; i-- {
-			// Filter
+			rec, found, err := cen.tables.Get(j, tables[k].Run, tables[k].GlobalSeq, key)
+			if err != nil {
+				return record.Record{}, err
+			}
+			if !found {
+				continue
+			}
 
-			q := bloomfilter.
-				DecodeFromFile(filename.Table(cen.conf.Path, cen.conf.DBName, j, i, filename.TypeFilter)).
-				Query(key)
+			cen.cache.Set(rec) // Even if it's deleted, it might get searched for, so we cache it.
 
-			if !q {
-				//fmt.Printf("%s Not found @ [FILTER] @ L%d R%d\n", key, j, i)
-				continue
+			if rec.IsDeleted() {
+				return record.Record{}, ErrNotFound
 			}
+			return rec, nil
+		}
+	}
+
+	return record.Record{}, ErrNotFound
+}
 
-			// Summary
+// ScanIterator iterates over the results of a Scan. Next follows the same convention as
+// record.Iterator. Once Next reports that the iterator is exhausted, Err should be checked: if
+// reading one of the SSTables failed, iteration stops early and Err returns the reason.
+type ScanIterator struct {
+	it  record.Iterator
+	err *error
+}
 
-			ste := sstable.FindSummaryTableEntry(
-				filename.Table(cen.conf.Path, cen.conf.DBName, j, i, filename.TypeSummary),
-				key,
-			)
+// Next returns the next record, or true if there are no more records.
+func (si *ScanIterator) Next() (record.Record, bool) {
+	return si.it()
+}
 
-			if ste.Offset == -1 {
-				//fmt.Printf("%s Not found @ [SUMMARY] @ L%d R%d\n", key, j, i)
-				continue
-			}
+// Err returns the error that stopped the iteration, if any.
+func (si *ScanIterator) Err() error {
+	return *si.err
+}
 
-			// Index
+// Scan returns an iterator over all records stored in the system whose keys fall in the range
+// [start, end), in ascending key order. Returns ErrRateLimited if the user ran out of tokens.
+// An empty end means there is no upper bound. Deleted records and internal keys are skipped.
+// The iterator holds open the Data tables it reads from until it's exhausted.
+func (cen *CoreEngine) Scan(user, start, end []byte) (*ScanIterator, error) {
+	err := cen.takeToken(user)
+	if err != nil {
+		return nil, err
+	}
 
-			ite := sstable.FindIndexTableEntry(
-				filename.Table(cen.conf.Path, cen.conf.DBName, j, i, filename.TypeIndex),
-				key,
-				ste.Offset,
-			)
+	cen.mu.RLock()
+	defer cen.mu.RUnlock()
+	return cen.scan(start, end)
+}
 
-			if ite.Offset == -1 {
-				//fmt.Printf("%s Not found @ [INDEX] @ L%d R%d\n", key, j, i)
+// Scan without getting token buckets. The caller must hold the lock.
+// Sources are merged from the newest to the oldest: the Memtable, the Memtables waiting to be
+// flushed, then every level from the first to the last, and on each level every run from the newest
+// to the oldest. Tables whose key ranges don't intersect the range are skipped. The cache only ever
+// holds copies of records found in those sources, so there's no need to read from it.
+// The iterator outlives the lock, so the Memtables' parts of the range are copied up front, while
+// the Data tables are opened before returning. Files removed by a compaction in the meantime stay
+// readable through their open handles.
+func (cen *CoreEngine) scan(start, end []byte) (*ScanIterator, error) {
+	iterErr := new(error)
+
+	its := []record.Iterator{copyRange(cen.mt, start, end)}
+	for i := len(cen.imm) - 1; i >= 0; i-- {
+		its = append(its, copyRange(cen.imm[i], start, end))
+	}
+
+	for j := 1; j <= cen.manifest.LastLevel(); j++ {
+		tables := cen.manifest.Tables(j)
+		for k := len(tables) - 1; k >= 0; k-- {
+			if !tables[k].Intersects(start, end) {
 				continue
 			}
+			it, err := sstable.NewRangeIterator(cen.conf.Path, cen.conf.DBName, j, tables[k].Run, tables[k].GlobalSeq, start, end, iterErr)
+			if err != nil {
+				return nil, err
+			}
+			its = append(its, it)
+		}
+	}
 
-			// Data
+	merged := lsmtree.NewMergeIterator(its)
+	internal := []byte(cen.conf.InternalStart)
+
+	return &ScanIterator{
+		it: func() (record.Record, bool) {
+			// A failed table stops returning records, so whatever the merge returns past that
+			// point could be an outdated version of a key.
+			for rec, last := merged(); !last && *iterErr == nil; rec, last = merged() {
+				if rec.IsDeleted() || bytes.HasPrefix(rec.Key, internal) {
+					continue
+				}
+				return rec, false
+			}
+			return record.NewEmpty(), true
+		},
+		err: iterErr,
+	}, nil
+}
 
-			f, _ := os.Open(filename.Table(cen.conf.Path, cen.conf.DBName, j, i, filename.TypeData))
-			r := bufio.NewReader(f)
+// copyRange copies the records of the Memtable whose keys fall in the range [start, end), and
+// returns an iterator over the copies. Once it's exhausted, it keeps returning true.
+func copyRange(mt *memtable.Memtable, start, end []byte) record.Iterator {
+	recs := []record.Record{}
+	it := mt.NewRangeIterator(start, end)
+	for rec, last := it(); !last; rec, last = it() {
+		recs = append(recs, rec)
+	}
 
-			f.Seek(ite.Offset, 0)
-			rec := record.Record{}
-			rec.Deserialize(r)
-			f.Close()
+	i := 0
+	return func() (record.Record, bool) {
+		if i == len(recs) {
+			return record.NewEmpty(), true
+		}
+		i++
+		return recs[i-1], false
+	}
+}
 
-			cen.cache.Set(rec) // Even if it's deleted, it might get searched for, so we cache it.
+// takeToken takes a token from the user's token bucket. Returns ErrRateLimited if there are none.
+// The bucket is loaded from the system the first time it's used after a rotate, and is updated in
+// memory from then on, so this only takes the read lock.
+func (cen *CoreEngine) takeToken(user []byte) error {
+	cen.mu.RLock()
+	defer cen.mu.RUnlock()
 
-			if rec.IsDeleted() {
-				return record.Record{}, false
-			}
-			return rec, true
+	if cen.closed {
+		return ErrClosed
+	}
+
+	cen.bucketsMu.Lock()
+	_, ok := cen.buckets[string(user)]
+	cen.bucketsMu.Unlock()
+
+	// Loading is done outside of bucketsMu, since it may read from disk. Someone else might load
+	// the same bucket in the meantime, in which case theirs is kept.
+
+	var loaded tokenbucket.TokenBucket
+	if !ok {
+		var err error
+		loaded, err = cen.getTokenBucket(user)
+		if err != nil {
+			return err
 		}
 	}
 
-	return record.Record{}, false
+	cen.bucketsMu.Lock()
+	defer cen.bucketsMu.Unlock()
+	tb, ok := cen.buckets[string(user)]
+	if !ok {
+		tb = &loaded
+		cen.buckets[string(user)] = tb
+	}
+	if !tb.HasEnoughTokens() {
+		return fmt.Errorf("%w: %d seconds to go", ErrRateLimited, tb.ResetInterval-(time.Now().Unix()-tb.Timestamp))
+	}
+	return nil
 }
 
-func (cen CoreEngine) getTokenBucket(user []byte) tokenbucket.TokenBucket {
+// getTokenBucket reads the user's token bucket from the system, or returns a full one if there is
+// none. The caller must hold the lock.
+func (cen *CoreEngine) getTokenBucket(user []byte) (tokenbucket.TokenBucket, error) {
 	tbKey := []byte(cen.conf.InternalStart)
 	tbKey = append(tbKey, user...)
-	tbRec, found := cen.get(tbKey)
-	if !found {
-		tb, _ := tokenbucket.New(cen.conf.TokenBucketTokens, cen.conf.TokenBucketInterval)
-		return *tb
+	tbRec, err := cen.get(tbKey)
+	if err == ErrNotFound {
+		tb, err := tokenbucket.New(cen.conf.TokenBucketTokens, cen.conf.TokenBucketInterval)
+		if err != nil {
+			return tokenbucket.TokenBucket{}, err
+		}
+		return *tb, nil
 	}
-	return tokenbucket.FromBytes(tbRec.Value)
+	if err != nil {
+		return tokenbucket.TokenBucket{}, err
+	}
+	return tokenbucket.FromBytes(tbRec.Value), nil
 }
 
-func (cen CoreEngine) putTokenBucket(user []byte, bucket tokenbucket.TokenBucket) {
-	tbKey := []byte(cen.conf.InternalStart)
-	tbKey = append(tbKey, user...)
-	cen.put(record.New(tbKey, bucket.ToBytes()))
+// putTokenBuckets writes the token buckets used since the last call into the Memtable and forgets
+// them, so that they're loaded from the system again the next time they're used. Token buckets
+// aren't logged in the WAL, so they only survive a restart once the Memtable is flushed. Until
+// then, a restart resets the rate limits of the users who took tokens since the last call.
+// The caller must hold the write lock.
+func (cen *CoreEngine) putTokenBuckets() {
+	for user, bucket := range cen.buckets {
+		tbKey := []byte(cen.conf.InternalStart)
+		tbKey = append(tbKey, user...)
+		rec := record.New(tbKey, bucket.ToBytes())
+		rec.Seq = cen.nextSeq()
+		cen.apply(rec)
+	}
+	cen.buckets = make(map[string]*tokenbucket.TokenBucket)
 }
 
 // Put writes a new record in the system based on the passed key, val and typeInfo
-// parameters.
-func (cen CoreEngine) Put(user, key, val []byte, typeInfo byte) bool {
+// parameters. Returns ErrIllegalKey if the key is reserved for internal use and ErrRateLimited if
+// the user ran out of tokens.
+func (cen *CoreEngine) Put(user, key, val []byte, typeInfo byte) error {
 	legal := cen.IsLegal(key)
 	if !legal {
-		return false
+		return ErrIllegalKey
 	}
-	tb := cen.getTokenBucket(user)
-	if !tb.HasEnoughTokens() {
-		fmt.Printf("Slow down, %d seconds to go\n", tb.ResetInterval-(time.Now().Unix()-tb.Timestamp))
-		return false
+	err := cen.takeToken(user)
+	if err != nil {
+		return err
 	}
-	cen.putTokenBucket(user, tb)
 	rec := record.New(key, val)
 	rec.TypeInfo = typeInfo
-	cen.put(rec)
-	return true
+
+	cen.mu.Lock()
+	err = cen.writable()
+	if err != nil {
+		cen.mu.Unlock()
+		return err
+	}
+	return cen.commit(cen.put(rec))
 }
 
-func (cen CoreEngine) put(rec record.Record) {
-	isTokenBucket := !cen.IsLegal(rec.Key)
-	if !isTokenBucket {
-		cen.wal.BufferedAppend(rec)
+// writable returns ErrClosed if the engine was closed, or the error that stopped the background
+// flusher, if any. Writes check it once they hold the write lock, since Close may have come in
+// after they took their token. The caller must hold the write lock.
+func (cen *CoreEngine) writable() error {
+	if cen.closed {
+		return ErrClosed
 	}
+	return cen.flushErr
+}
+
+// put writes the record into the WAL, the cache and the Memtable. The caller must hold the write
+// lock.
+func (cen *CoreEngine) put(rec record.Record) error {
+	rec.Seq = cen.nextSeq()
+	err := cen.wal.BufferedAppend(rec)
+	if err != nil {
+		return err
+	}
+	cen.apply(rec)
+	return cen.flushIfNeeded()
+}
+
+// commit finishes a write made under the write lock, whose error is passed in, and releases the
+// lock. Unless the write failed, it then waits until the WAL has made the write as durable as
+// wal_sync_mode asks for. The wait happens outside of the lock, so that the writes coming in
+// meanwhile can share the WAL's next sync. The write is visible to reads before it's durable.
+func (cen *CoreEngine) commit(err error) error {
+	var upTo uint64
+	if err == nil {
+		upTo, err = cen.wal.Commit()
+	}
+	cen.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return cen.wal.Sync(upTo)
+}
+
+// Write applies all operations in the batch atomically: they're logged in the WAL as a single unit
+// and inserted into the Memtable together, so a crash can never leave only a part of the batch in
+// the system. Returns ErrIllegalKey without applying anything if any of the keys is illegal, and
+// ErrRateLimited if the user ran out of tokens.
+func (cen *CoreEngine) Write(user []byte, wb *WriteBatch) error {
+	for _, rec := range wb.recs {
+		if !cen.IsLegal(rec.Key) {
+			return ErrIllegalKey
+		}
+	}
+	err := cen.takeToken(user)
+	if err != nil {
+		return err
+	}
+
+	cen.mu.Lock()
+	err = cen.writable()
+	if err != nil {
+		cen.mu.Unlock()
+		return err
+	}
+	return cen.commit(cen.write(wb))
+}
+
+// write logs the batch in the WAL and applies it. The caller must hold the write lock.
+func (cen *CoreEngine) write(wb *WriteBatch) error {
+	recs := make([]record.Record, len(wb.recs))
+	for i, rec := range wb.recs {
+		rec.Seq = cen.nextSeq()
+		recs[i] = rec
+	}
+
+	err := cen.wal.AppendBatch(recs)
+	if err != nil {
+		return err
+	}
+	for _, rec := range recs {
+		cen.apply(rec)
+	}
+	return cen.flushIfNeeded()
+}
+
+// apply writes the record into the cache and the Memtable.
+func (cen *CoreEngine) apply(rec record.Record) {
 	cen.cache.Set(rec)
 	cen.mt.Add(rec)
 
@@ -210,45 +623,66 @@ func (cen CoreEngine) put(rec record.Record) {
 
 	cnt, _ := cen.mt.Count()
 	fmt.Printf("[DBG]\t[Memtable] %d/%d\n", cnt, cen.conf.MemtableCapacity)
-
-	if cen.mt.ShouldFlush() {
-		cen.mt.Flush()
-		cen.FlushWALBuffer()
-		cen.wal.DeleteOldSegments()
-	}
 }
 
-// Delete does logical deletion of the record with the passed key in the system
-// (if it exists). Returns whether or not the deletion was successful.
-func (cen CoreEngine) Delete(user, key []byte) bool {
+// Delete does logical deletion of the record with the passed key in the system.
+// Returns ErrNotFound if there is no such record, ErrIllegalKey if the key is reserved for
+// internal use and ErrRateLimited if the user ran out of tokens.
+func (cen *CoreEngine) Delete(user, key []byte) error {
 	legal := cen.IsLegal(key)
 	if !legal {
-		return false
+		return ErrIllegalKey
 	}
-	tb := cen.getTokenBucket(user)
-	if !tb.HasEnoughTokens() {
-		fmt.Printf("Slow down, %d seconds to go\n", tb.ResetInterval-(time.Now().Unix()-tb.Timestamp))
-		return false
+	err := cen.takeToken(user)
+	if err != nil {
+		return err
 	}
-	cen.putTokenBucket(user, tb)
-	rec, found := cen.get(key)
-	if !found {
-		return false
+
+	cen.mu.Lock()
+	err = cen.writable()
+	if err != nil {
+		cen.mu.Unlock()
+		return err
 	}
+	return cen.commit(cen.delete(key))
+}
 
-	if rec.IsDeleted() {
-		return false
+// delete writes a tombstone for the record with the passed key. The caller must hold the write lock.
+func (cen *CoreEngine) delete(key []byte) error {
+	rec, err := cen.get(key)
+	if err != nil {
+		return err
 	}
+
 	rec.Status |= record.RECORD_TOMBSTONE_REMOVED
 	rec.Timestamp = time.Now().Unix()
 	fmt.Println("Deleting...", rec)
-	cen.put(rec)
-	return true
+	return cen.put(rec)
+}
+
+// FlushWALBuffer is a convenience function for flushing the WAL's buffer. Like a write, it returns
+// once the records are as durable as wal_sync_mode asks for, see commit.
+func (cen *CoreEngine) FlushWALBuffer() error {
+	cen.mu.Lock()
+	return cen.commit(cen.wal.FlushBuffer())
+}
+
+// WALBounds returns the positions of the start and the end of the WAL, to start a WALReader from.
+func (cen *CoreEngine) WALBounds() (wal.Position, wal.Position) {
+	cen.mu.RLock()
+	defer cen.mu.RUnlock()
+	return cen.wal.Bounds()
 }
 
-// FlushWALBuffer is a convenience function for flushing the WAL's buffer.
-func (cen CoreEngine) FlushWALBuffer() {
-	cen.wal.FlushBuffer()
+// WALReader returns a Reader over the records in the WAL, starting from the given position, which
+// can be kept up with writes to the engine in follow mode. See wal.Reader.
+// Records still in the WAL's buffer aren't read until it's flushed. Once a Memtable is flushed,
+// the segments holding its records are removed, so a Reader that falls behind gets an error
+// wrapping wal.ErrSegmentRemoved.
+func (cen *CoreEngine) WALReader(from wal.Position, follow bool) (*wal.Reader, error) {
+	cen.mu.RLock()
+	defer cen.mu.RUnlock()
+	return cen.wal.NewReader(from, follow)
 }
 
 func main() {
@@ -258,10 +692,10 @@ func main() {
 	}
 
 	engine, _ := New(conf)
-	test(*engine)
+	test(engine)
 }
 
-func test(engine CoreEngine) {
+func test(engine *CoreEngine) {
 	user := "USER"
 	noType := byte(0) // doesn't matter for now, the wrapper engine should bother with it
 
@@ -318,13 +752,13 @@ func test(engine CoreEngine) {
 		"key_134",
 	}
 	for _, key := range keysToSearch {
-		rec, found := engine.Get([]byte(user), []byte(key))
+		rec, err := engine.Get([]byte(user), []byte(key))
 		v := rec.Value
-		if found {
+		if err == nil {
 			fmt.Printf("%s found: ", key)
 			fmt.Println(string(v))
 		} else {
-			fmt.Printf("%s not found\n", key)
+			fmt.Printf("%s %s\n", key, err)
 		}
 	}
 	engine.FlushWALBuffer()
@@ -0,0 +1,200 @@
+package coreeng
+
+import (
+	"fmt"
+	"nakevaleng/core/manifest"
+	"nakevaleng/core/memtable"
+	"nakevaleng/core/sstable"
+	"nakevaleng/util/filename"
+)
+
+// flushIfNeeded hands the Memtable over to the background flusher if it's full, and replaces it
+// with a fresh one. If there are already too many full Memtables waiting to be flushed, the write
+// stalls until the flusher catches up.
+// The caller must hold the write lock, which is released while waiting.
+func (cen *CoreEngine) flushIfNeeded() error {
+	for cen.mt.ShouldFlush() {
+		if cen.flushErr != nil {
+			return cen.flushErr
+		}
+		if len(cen.imm) < cen.conf.MemtableMaxImmutable {
+			return cen.rotate()
+		}
+
+		fmt.Println("[DBG]\t[Memtable] Waiting for", len(cen.imm), "memtables to flush")
+		cen.flushCond.Wait()
+	}
+	return nil
+}
+
+// rotate moves the Memtable to the back of the flush queue and replaces it with a fresh one. The WAL
+// is cut at this point, so that once the Memtable is flushed, the segments holding its records can
+// be removed. The token buckets used meanwhile are written into the Memtable before it's moved.
+// The caller must hold the write lock.
+func (cen *CoreEngine) rotate() error {
+	cen.putTokenBuckets()
+
+	lowWaterMark, err := cen.wal.CutSegment()
+	if err != nil {
+		return err
+	}
+	mt, err := memtable.New(cen.conf)
+	if err != nil {
+		return err
+	}
+
+	cen.imm = append(cen.imm, cen.mt)
+	cen.immSegments = append(cen.immSegments, lowWaterMark)
+	cen.mt = mt
+	cen.flushCond.Broadcast()
+	return nil
+}
+
+// flushLoop is the background flusher. It flushes full Memtables from the oldest to the newest, for
+// as long as the engine is open and there are Memtables waiting. A Memtable stays in the queue (and
+// is searched by reads) until its SSTable is in place.
+// Writing the SSTable is done without holding the lock, since nobody writes to a full Memtable.
+// If a flush fails, the flusher stops and the error is returned by all writes from then on. Reads
+// keep working, since the Memtables stay in the queue.
+func (cen *CoreEngine) flushLoop() {
+	defer close(cen.flusherDone)
+
+	cen.mu.Lock()
+	defer cen.mu.Unlock()
+
+	for {
+		for len(cen.imm) == 0 && !cen.closed {
+			cen.flushCond.Wait()
+		}
+		if len(cen.imm) == 0 {
+			return
+		}
+
+		mt := cen.imm[0]
+		cen.mu.Unlock()
+		err := mt.Flush(filename.Staging(cen.conf.Path), 0)
+		cen.mu.Lock()
+
+		if err == nil {
+			err = cen.installFlushed()
+		}
+		if err != nil {
+			fmt.Println("[DBG]\t[Memtable] Background flush failed:", err)
+			cen.flushErr = err
+			cen.flushCond.Broadcast()
+			return
+		}
+	}
+}
+
+// installFlushed moves the SSTable of the oldest waiting Memtable into place, removes the Memtable
+// from the queue and removes the WAL segments holding its records. The caller must hold the write
+// lock.
+func (cen *CoreEngine) installFlushed() error {
+	err := cen.installTable()
+	if err != nil {
+		return err
+	}
+
+	lowWaterMark := cen.immSegments[0]
+	cen.imm = cen.imm[1:]
+	cen.immSegments = cen.immSegments[1:]
+	cen.walFlushed = lowWaterMark
+	cen.flushCond.Broadcast()
+
+	_, err = cen.wal.DeleteSegmentsBefore(lowWaterMark)
+	return err
+}
+
+// writeTable flushes the Memtable and moves its SSTable into place, all at once. Used during
+// recovery, before the background flusher is started. The caller must hold the write lock.
+func (cen *CoreEngine) writeTable(mt *memtable.Memtable) error {
+	err := mt.Flush(filename.Staging(cen.conf.Path), 0)
+	if err != nil {
+		return err
+	}
+	return cen.installTable()
+}
+
+// installTable moves the SSTable in the staging directory into the next free run on level 1, adds
+// it to the manifest and lets the compaction scheduler know. The caller must hold the write lock.
+func (cen *CoreEngine) installTable() error {
+	run := cen.manifest.NextRun(1)
+
+	err := sstable.MoveTable(filename.Staging(cen.conf.Path), cen.conf.Path, cen.conf.DBName, 1, 0, 1, run)
+	if err != nil {
+		return err
+	}
+
+	t, err := manifest.ReadTable(cen.conf.Path, cen.conf.DBName, 1, run)
+	if err != nil {
+		return err
+	}
+	err = cen.manifest.Apply(manifest.Edit{Added: []manifest.Table{t}})
+	if err != nil {
+		return err
+	}
+
+	cen.compactor.Notify()
+	return nil
+}
+
+// PauseCompactions stops the background compaction from starting new compactions, and waits for
+// the one in progress (if any) to finish. Flushes carry on, so level 1 keeps growing until
+// ResumeCompactions is called.
+func (cen *CoreEngine) PauseCompactions() {
+	cen.compactor.Pause()
+}
+
+// ResumeCompactions lets the background compaction carry on after PauseCompactions.
+func (cen *CoreEngine) ResumeCompactions() {
+	cen.compactor.Resume()
+}
+
+// WaitIdle blocks until all full Memtables are flushed and no compaction is left to do (or, if
+// compactions are paused, the one in progress is finished). Returns the error that stopped the
+// flusher or the compaction, if any. Mostly useful for tests, which want the tree to settle
+// before looking at it.
+func (cen *CoreEngine) WaitIdle() error {
+	cen.mu.Lock()
+	for len(cen.imm) > 0 && cen.flushErr == nil {
+		cen.flushCond.Wait()
+	}
+	err := cen.flushErr
+	cen.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	return cen.compactor.WaitIdle()
+}
+
+// Close waits for all full Memtables to be flushed, stops the background flusher and compaction,
+// closes the manifest and the cached SSTables, and closes the WAL, which flushes its buffer. The
+// contents of the current Memtable are left in the WAL, to be replayed on the next start.
+// Operations made after Close return ErrClosed.
+func (cen *CoreEngine) Close() error {
+	cen.mu.Lock()
+	cen.closed = true
+	cen.flushCond.Broadcast()
+	cen.mu.Unlock()
+
+	<-cen.flusherDone
+	compactErr := cen.compactor.Close()
+
+	cen.mu.Lock()
+	defer cen.mu.Unlock()
+	manifestErr := cen.manifest.Close()
+	cen.tables.Close()
+	walErr := cen.wal.Close()
+	if cen.flushErr != nil {
+		return cen.flushErr
+	}
+	if compactErr != nil {
+		return compactErr
+	}
+	if manifestErr != nil {
+		return manifestErr
+	}
+	return walErr
+}
@@ -0,0 +1,232 @@
+package coreeng
+
+import (
+	"bytes"
+	"fmt"
+	"nakevaleng/core/manifest"
+	"nakevaleng/core/memtable"
+	"nakevaleng/core/sstable"
+	"nakevaleng/util/filename"
+	"path/filepath"
+)
+
+// ingested is an SSTable passed to Ingest.
+type ingested struct {
+	path   string // Directory holding the table's files.
+	dbname string // Level and run as found in the names of the table's files.
+	level  int
+	run    int
+	table  manifest.Table // Where the table goes in the LSM tree, once that's decided.
+}
+
+// Ingest adds SSTables built outside of the engine (through an sstable.Writer, for example) to the
+// LSM tree, without rewriting them. Each table is given by the path to any one of its files, named
+// the way the sstable package names them. Returns an error wrapping ErrCorruption without adding
+// anything if any of the tables is damaged, and ErrIllegalKey if any may hold internal keys.
+// The records of an ingested table are newer than everything written before Ingest, whatever
+// sequence numbers they were written with: the table is given a global sequence number, which all
+// of its records are read with. If more than one table holds a key, the one given last wins.
+// Memtables holding keys in the tables' key ranges are flushed first, so that they don't hide the
+// new records, and the WAL segments holding only flushed records are removed (or archived) whatever
+// wal_lwm_idx says, so that they aren't replayed over the tables on restart. Each table then goes
+// to the last level such that no table on it or on the levels before it overlaps the ingested one
+// (or, failing that, to level 1, as its newest run).
+// The files are hard linked into the database's directory, so they must not be changed afterwards,
+// but they may be removed. All tables are added to the manifest in a single edit.
+func (cen *CoreEngine) Ingest(files []string) error {
+	tables := []ingested{}
+	for _, file := range files {
+		t, err := cen.checkIngested(file)
+		if err != nil {
+			return err
+		}
+		tables = append(tables, t)
+	}
+	if len(tables) == 0 {
+		return nil
+	}
+
+	cen.mu.Lock()
+	defer cen.mu.Unlock()
+
+	err := cen.flushOverlapping(tables)
+	if err != nil {
+		return err
+	}
+
+	// The WAL segments kept after flushes (see wal_lwm_idx) are replayed on restart, and the older
+	// versions of the ingested keys in them would hide the new ones, since sequence numbers of
+	// replayed records are only compared with those in the Memtable. The segments left after that
+	// only hold records of the Memtables, none of which are in the tables' key ranges anymore.
+
+	_, err = cen.wal.DropSegmentsBefore(cen.walFlushed)
+	if err != nil {
+		return err
+	}
+
+	// Place the tables, each one knowing where the ones before it went.
+
+	edit := manifest.Edit{}
+	nextRun := map[int]int{}
+	for i := range tables {
+		t := &tables[i].table
+		t.GlobalSeq = cen.nextSeq()
+		t.MaxSeq = t.GlobalSeq
+		t.Level = cen.ingestLevel(*t, edit.Added)
+
+		if _, ok := nextRun[t.Level]; !ok {
+			nextRun[t.Level] = cen.manifest.NextRun(t.Level)
+		}
+		t.Run = nextRun[t.Level]
+		nextRun[t.Level]++
+
+		edit.Added = append(edit.Added, *t)
+	}
+
+	// Files that make it into place without being added to the manifest are removed as orphans,
+	// either here or on startup.
+
+	for i, t := range tables {
+		err = sstable.LinkTable(t.path, t.dbname, t.level, t.run, cen.conf.Path, cen.conf.DBName, t.table.Level, t.table.Run)
+		if err == nil {
+			continue
+		}
+		for _, linked := range tables[:i+1] {
+			sstable.RemoveTable(cen.conf.Path, cen.conf.DBName, linked.table.Level, linked.table.Run)
+		}
+		return err
+	}
+	err = cen.manifest.Apply(edit)
+	if err != nil {
+		return err
+	}
+
+	// Cached records in the key ranges may be outdated now.
+
+	for _, t := range tables {
+		cen.cache.RemoveRange(string(t.table.MinKey), string(t.table.MaxKey))
+		fmt.Println("[DBG]\t[Ingest] Added", t.path+t.dbname, "lvl", t.level, "run", t.run,
+			"as lvl", t.table.Level, "run", t.table.Run, "with seq", t.table.GlobalSeq)
+	}
+	cen.compactor.Notify()
+	return nil
+}
+
+// checkIngested verifies the SSTable the file belongs to, and describes it.
+func (cen *CoreEngine) checkIngested(file string) (ingested, error) {
+	dbname, level, run, ftype := filename.Query(file)
+	if !ftype.IsSSTable() {
+		return ingested{}, fmt.Errorf("ingest: %s is not an SSTable file", file)
+	}
+	path := filepath.Dir(file) + "/"
+
+	ours, err := filepath.Abs(cen.conf.Path)
+	if err != nil {
+		return ingested{}, err
+	}
+	theirs, err := filepath.Abs(path)
+	if err != nil {
+		return ingested{}, err
+	}
+	if ours == theirs && dbname == cen.conf.DBName {
+		return ingested{}, fmt.Errorf("ingest: %s belongs to the database", file)
+	}
+
+	r, err := sstable.OpenReader(path, dbname, level, run)
+	if err != nil {
+		return ingested{}, err
+	}
+	err = r.Verify()
+	r.Close()
+	if err != nil {
+		return ingested{}, err
+	}
+
+	t, err := manifest.ReadTable(path, dbname, level, run)
+	if err != nil {
+		return ingested{}, err
+	}
+	if cen.mayHoldInternal(t) {
+		return ingested{}, fmt.Errorf("%w: %s may hold internal keys", ErrIllegalKey, file)
+	}
+
+	return ingested{path: path, dbname: dbname, level: level, run: run, table: t}, nil
+}
+
+// mayHoldInternal returns true if the table's key range holds any keys reserved for internal use,
+// all of which begin with InternalStart.
+func (cen *CoreEngine) mayHoldInternal(t manifest.Table) bool {
+	internal := []byte(cen.conf.InternalStart)
+	if bytes.Compare(t.MaxKey, internal) < 0 {
+		return false
+	}
+	return bytes.Compare(t.MinKey, internal) < 0 || bytes.HasPrefix(t.MinKey, internal)
+}
+
+// flushOverlapping makes sure that no Memtable holds keys in the key ranges of the ingested tables.
+// The current Memtable is handed over to the flusher if it does, and then the flusher is waited on
+// until none of the Memtables waiting to be flushed do. Writes made in the meantime may go into the
+// new Memtable, so it's checked again every time.
+// The caller must hold the write lock, which is released while waiting.
+func (cen *CoreEngine) flushOverlapping(tables []ingested) error {
+	for {
+		if cen.closed {
+			return ErrClosed
+		}
+		if cen.flushErr != nil {
+			return cen.flushErr
+		}
+
+		if overlaps(cen.mt, tables) {
+			if len(cen.imm) < cen.conf.MemtableMaxImmutable {
+				err := cen.rotate()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+		} else {
+			waiting := false
+			for _, mt := range cen.imm {
+				waiting = waiting || overlaps(mt, tables)
+			}
+			if !waiting {
+				return nil
+			}
+		}
+
+		fmt.Println("[DBG]\t[Ingest] Waiting for", len(cen.imm), "memtables to flush")
+		cen.flushCond.Wait()
+	}
+}
+
+// overlaps returns true if the Memtable holds any keys (tombstones included) in the key ranges of
+// the ingested tables.
+func overlaps(mt *memtable.Memtable, tables []ingested) bool {
+	for _, t := range tables {
+		end := append(append([]byte{}, t.table.MaxKey...), 0) // Just past MaxKey.
+		_, last := mt.NewRangeIterator(t.table.MinKey, end)()
+		if !last {
+			return true
+		}
+	}
+	return false
+}
+
+// ingestLevel returns the level an ingested table goes to: the last one such that no table on it
+// or on the levels before it overlaps the ingested one, so that all older versions of its keys are
+// found after it. If a table on level 1 overlaps it, that's level 1, where it becomes the newest
+// run. Tables placed by the same Ingest count too. The caller must hold the write lock.
+func (cen *CoreEngine) ingestLevel(t manifest.Table, placed []manifest.Table) int {
+	level := 1
+	for l := 1; l <= cen.conf.LsmLvlMax; l++ {
+		tables := append(cen.manifest.Tables(l), placed...)
+		for _, u := range tables {
+			if u.Level == l && u.Overlaps(t) {
+				return level
+			}
+		}
+		level = l
+	}
+	return level
+}
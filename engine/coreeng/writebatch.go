@@ -0,0 +1,41 @@
+package coreeng
+
+import (
+	"nakevaleng/core/record"
+)
+
+// WriteBatch is a group of puts and deletes that are applied to the system atomically, through
+// CoreEngine's Write. Operations are applied in the order they were added to the batch.
+type WriteBatch struct {
+	recs []record.Record
+}
+
+// NewWriteBatch returns a pointer to a new, empty WriteBatch object.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{
+		recs: make([]record.Record, 0),
+	}
+}
+
+// Put adds a put of a new record based on the passed key, val and typeInfo parameters to the batch.
+func (wb *WriteBatch) Put(key, val []byte, typeInfo byte) {
+	wb.recs = append(wb.recs, record.NewTyped(key, val, typeInfo))
+}
+
+// Delete adds a logical deletion of the record with the passed key to the batch. Unlike
+// CoreEngine's Delete, the tombstone is written whether or not the record exists.
+func (wb *WriteBatch) Delete(key []byte) {
+	rec := record.New(key, []byte{})
+	rec.Status |= record.RECORD_TOMBSTONE_REMOVED
+	wb.recs = append(wb.recs, rec)
+}
+
+// Count returns the number of operations in the batch.
+func (wb *WriteBatch) Count() int {
+	return len(wb.recs)
+}
+
+// Clear removes all operations from the batch, so it can be reused.
+func (wb *WriteBatch) Clear() {
+	wb.recs = wb.recs[:0]
+}
@@ -0,0 +1,300 @@
+// Package restore implements point-in-time recovery: bringing a database back from a backup made by
+// CoreEngine.Backup, as of a chosen point after the backup, by replaying the WAL segments archived
+// since (see wal_archive_path).
+package restore
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"nakevaleng/core/manifest"
+	"nakevaleng/core/record"
+	"nakevaleng/core/sstable"
+	"nakevaleng/core/wal"
+	"nakevaleng/engine/coreconf"
+	"nakevaleng/util/filename"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ErrTargetBeforeBackup is returned by Restore when the backup already holds records past the
+// target, so it can't be restored as of the target.
+var ErrTargetBeforeBackup = errors.New("restore: target is before the backup")
+
+// Target is the point in time to restore the database to. A zero field means no limit, so a zero
+// Target replays every record there is.
+type Target struct {
+	Seq       uint64 // Sequence number of the last record to keep.
+	Timestamp int64  // Records created after this UNIX timestamp are left out.
+}
+
+// includes returns whether the record was written at or before the target.
+func (t Target) includes(rec record.Record) bool {
+	if t.Seq != 0 && rec.Seq > t.Seq {
+		return false
+	}
+	return t.Timestamp == 0 || rec.Timestamp <= t.Timestamp
+}
+
+// Result describes a finished Restore.
+type Result struct {
+	Tables        int    // Number of tables restored from the backup.
+	Records       int    // Number of records written into the new WAL.
+	LastSeq       uint64 // Sequence number of the last record written into the new WAL, or 0.
+	LastTimestamp int64  // Creation time of that record, or 0.
+	Discarded     int64  // Number of bytes of torn or corrupt frames skipped in the segments read.
+}
+
+// Restore brings back the database described by conf from the backup at backupPath, as of the
+// target. The backup's tables and manifest are put into conf.Path, and the records logged since
+// the backup, up to the target, are written into a new WAL at conf.WalPath, so the engine
+// replays them once it's opened with conf. Neither directory may hold the database yet.
+// The segments are read starting from the oldest one in the backup. Each is looked for in
+// walPaths, in order, and then in the backup itself; those would usually be the archive directory
+// and the WAL's directory of the database the backup was made from. They must follow each other
+// without gaps. The new WAL's segments get IDs after all of them, but conf.WalArchivePath should
+// still be a new archive directory: in the old one, they'd follow the segments holding the records
+// past the target, which a later restore would replay along with them.
+// Records are replayed in the order they were logged, up to the first one past the target, and
+// batches are kept only if all of their records are within it. Returns ErrTargetBeforeBackup if
+// the backup itself holds records past the target. Tables ingested after the backup was made
+// aren't in the WAL, so they're not restored.
+// On error, whatever was put into conf.Path and conf.WalPath is left there.
+func Restore(conf *coreconf.CoreConfig, backupPath string, walPaths []string, target Target) (Result, error) {
+	result := Result{}
+	dbname := conf.DBName
+	for _, path := range append([]string{backupPath}, walPaths...) {
+		if !strings.HasSuffix(path, "/") {
+			return result, fmt.Errorf("restore: path \"%s\" must end with '/'", path)
+		}
+	}
+
+	err := checkEmpty(conf)
+	if err != nil {
+		return result, err
+	}
+	backupLog := filename.BackupLog(backupPath)
+	paths := append(append([]string{}, walPaths...), backupLog)
+	first, last, err := segmentRange(paths, dbname)
+	if err != nil {
+		return result, err
+	}
+
+	// Tables
+
+	_, err = os.Stat(filename.Manifest(backupPath, dbname))
+	if err != nil {
+		return result, fmt.Errorf("restore: no backup of %s at %s: %w", dbname, backupPath, err)
+	}
+	err = filename.CopyFile(filename.Manifest(backupPath, dbname), filename.Manifest(conf.Path, dbname))
+	if err != nil {
+		return result, err
+	}
+	m, err := manifest.Open(conf.Path, dbname)
+	if err != nil {
+		return result, err
+	}
+	lastSeqOnDisk := uint64(0)
+	lastTimestampOnDisk := int64(0)
+	for level := 1; level <= m.LastLevel(); level++ {
+		for _, t := range m.Tables(level) {
+			err = sstable.LinkTable(backupPath, dbname, t.Level, t.Run, conf.Path, dbname, t.Level, t.Run)
+			if err != nil {
+				m.Close()
+				return result, err
+			}
+			props, err := sstable.ReadProperties(conf.Path, dbname, t.Level, t.Run)
+			if err != nil {
+				m.Close()
+				return result, err
+			}
+			if t.MaxSeq > lastSeqOnDisk {
+				lastSeqOnDisk = t.MaxSeq
+			}
+			if props.MaxTimestamp > lastTimestampOnDisk {
+				lastTimestampOnDisk = props.MaxTimestamp
+			}
+			result.Tables++
+		}
+	}
+	err = m.Close()
+	if err != nil {
+		return result, err
+	}
+	if target.Seq != 0 && target.Seq < lastSeqOnDisk {
+		return result, fmt.Errorf("%w: its tables hold sequence numbers up to %d", ErrTargetBeforeBackup, lastSeqOnDisk)
+	}
+	if target.Timestamp != 0 && target.Timestamp < lastTimestampOnDisk {
+		return result, fmt.Errorf("%w: its tables hold records created up to %d", ErrTargetBeforeBackup, lastTimestampOnDisk)
+	}
+
+	// WAL
+
+	segmentSize, err := conf.WalSegmentSizeBytes()
+	if err != nil {
+		return result, err
+	}
+	err = wal.CreateSegment(conf.WalPath, dbname, last+1)
+	if err != nil {
+		return result, err
+	}
+	w, err := wal.New(conf.WalPath, dbname, segmentSize, conf.WalLwmIdx, conf.WalBufferCapacity,
+		conf.WalSyncMode, conf.WalSyncIntervalDuration())
+	if err != nil {
+		return result, err
+	}
+	r := wal.OpenReader(paths, dbname, wal.Position{Segment: first})
+	err = replay(r, w, target, lastSeqOnDisk, &result)
+	result.Discarded = r.Discarded()
+	r.Close()
+	closeErr := w.Close()
+	if err != nil {
+		return result, err
+	}
+	if closeErr != nil {
+		return result, closeErr
+	}
+
+	fmt.Println("[DBG]\t[Restore] Restored", result.Tables, "tables and", result.Records, "records, up to seq", result.LastSeq)
+	return result, nil
+}
+
+// checkEmpty returns an error if the directories in conf already hold the database.
+func checkEmpty(conf *coreconf.CoreConfig) error {
+	_, err := os.Stat(filename.Manifest(conf.Path, conf.DBName))
+	if err == nil {
+		return fmt.Errorf("restore: %s already holds %s", conf.Path, conf.DBName)
+	}
+	tablePaths, err := filename.GetTablePaths(conf.Path, conf.DBName)
+	if err != nil {
+		return err
+	}
+	if len(tablePaths) > 0 {
+		return fmt.Errorf("restore: %s already holds tables of %s", conf.Path, conf.DBName)
+	}
+	segmentPaths, err := filename.GetSegmentPaths(conf.WalPath, conf.DBName)
+	if err != nil {
+		return err
+	}
+	if len(segmentPaths) > 0 {
+		return fmt.Errorf("restore: %s already holds segments of %s", conf.WalPath, conf.DBName)
+	}
+	return nil
+}
+
+// segmentRange returns the IDs of the oldest segment in the backup (the last of the paths) and of
+// the newest segment in any of the paths. Returns an error if a segment in between is missing.
+func segmentRange(paths []string, dbname string) (int, int, error) {
+	backupLog := paths[len(paths)-1]
+	ids := map[int]bool{}
+	first := -1
+	for _, path := range paths {
+		segmentPaths, err := filename.GetSegmentPaths(path, dbname)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, segmentPath := range segmentPaths {
+			_, id, _, _ := filename.Query(filepath.Base(segmentPath))
+			ids[id] = true
+			if path == backupLog && (first == -1 || id < first) {
+				first = id
+			}
+		}
+	}
+	if first == -1 {
+		return 0, 0, fmt.Errorf("restore: no segments of %s at %s", dbname, backupLog)
+	}
+
+	sorted := []int{}
+	for id := range ids {
+		if id >= first {
+			sorted = append(sorted, id)
+		}
+	}
+	sort.Ints(sorted)
+	for i, id := range sorted {
+		if id != first+i {
+			return 0, 0, fmt.Errorf("restore: segment %d of %s is missing from %v", first+i, dbname, paths)
+		}
+	}
+	return first, sorted[len(sorted)-1], nil
+}
+
+// replay appends the records read by r into w, up to the first one past the target. A batch is
+// appended as a whole once its commit marker is read, if all of its records are within the target.
+func replay(r *wal.Reader, w *wal.WAL, target Target, lastSeqOnDisk uint64, result *Result) error {
+	batch := []record.Record{}
+	batchSize := 0
+	inBatch := false
+
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if rec.Status&record.RECORD_BATCH_BEGIN != 0 {
+			batch = batch[:0]
+			batchSize = int(binary.LittleEndian.Uint64(rec.Value))
+			inBatch = true
+			continue
+		}
+		if rec.Status&record.RECORD_BATCH_COMMIT != 0 {
+			if !inBatch || len(batch) != batchSize {
+				inBatch = false
+				continue
+			}
+			inBatch = false
+			for _, batchRec := range batch {
+				if !target.includes(batchRec) {
+					return stop(batchRec, lastSeqOnDisk)
+				}
+			}
+			err = w.AppendBatch(batch)
+			if err != nil {
+				return err
+			}
+			for _, batchRec := range batch {
+				result.add(batchRec)
+			}
+			continue
+		}
+		if inBatch {
+			batch = append(batch, rec)
+			continue
+		}
+
+		if !target.includes(rec) {
+			return stop(rec, lastSeqOnDisk)
+		}
+		err = w.BufferedAppend(rec)
+		if err != nil {
+			return err
+		}
+		result.add(rec)
+	}
+	return nil
+}
+
+// stop is called with the first record past the target. Returns ErrTargetBeforeBackup if the
+// record is already in the backup's tables, nil otherwise.
+func stop(rec record.Record, lastSeqOnDisk uint64) error {
+	if rec.Seq <= lastSeqOnDisk {
+		return fmt.Errorf("%w: its tables hold record %d, created at %d", ErrTargetBeforeBackup, rec.Seq, rec.Timestamp)
+	}
+	fmt.Println("[DBG]\t[Restore] Stopped at record", rec.Seq, "created at", rec.Timestamp)
+	return nil
+}
+
+// add counts a record written into the new WAL.
+func (result *Result) add(rec record.Record) {
+	result.Records++
+	result.LastSeq = rec.Seq
+	result.LastTimestamp = rec.Timestamp
+}
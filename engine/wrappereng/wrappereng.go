@@ -5,6 +5,7 @@ package wrappereng
 import (
 	"fmt"
 	"nakevaleng/core/record"
+	"nakevaleng/core/wal"
 	"nakevaleng/ds/cmsketch"
 	"nakevaleng/ds/hll"
 	"nakevaleng/engine/coreconf"
@@ -21,70 +22,166 @@ const (
 // WrapperEngine is a thin application layer wrapping around CoreEngine, with additional support for
 // easy reading and writing of CMS and HLL objects.
 type WrapperEngine struct {
-	core coreeng.CoreEngine
+	core *coreeng.CoreEngine
 }
 
-// New returns a new WrapperEngine object.
-func New(conf *coreconf.CoreConfig) WrapperEngine {
-	cen, _ := coreeng.New(conf)
+// New returns a new WrapperEngine object, as well as an error indicating whether or not it was
+// successful.
+func New(conf *coreconf.CoreConfig) (WrapperEngine, error) {
+	cen, err := coreeng.New(conf)
+	if err != nil {
+		return WrapperEngine{}, err
+	}
 
-	return WrapperEngine{*cen}
+	return WrapperEngine{cen}, nil
 }
 
 // PutTyped writes a new record in the system based on the passed key, val and typeInfo
 // parameters.
-func (wen WrapperEngine) PutTyped(user, key string, val []byte, typeInfo byte) bool {
+func (wen WrapperEngine) PutTyped(user, key string, val []byte, typeInfo byte) error {
 	return wen.core.Put([]byte(user), []byte(key), val, typeInfo)
 }
 
 // Put writes a new record in the system based on the passed key and val parameters.
-func (wen WrapperEngine) Put(user, key string, val []byte) bool {
+func (wen WrapperEngine) Put(user, key string, val []byte) error {
 	return wen.core.Put([]byte(user), []byte(key), val, TypeVoid)
 }
 
-// Get returns a record stored in the system based on the passed key, as well as
-// whether or not the record is present.
-func (wen WrapperEngine) Get(user, key string) (record.Record, bool) {
+// Get returns a record stored in the system based on the passed key. Returns
+// coreeng.ErrNotFound if the record isn't present.
+func (wen WrapperEngine) Get(user, key string) (record.Record, error) {
 	return wen.core.Get([]byte(user), []byte(key))
 }
 
-// Delete does logical deletion of the record with the passed key in the system
-// (if it exists). Returns whether or not the deletion was successful.
-func (wen WrapperEngine) Delete(user, key string) bool {
+// Delete does logical deletion of the record with the passed key in the system. Returns
+// coreeng.ErrNotFound if there is no such record.
+func (wen WrapperEngine) Delete(user, key string) error {
 	return wen.core.Delete([]byte(user), []byte(key))
 }
 
+// Write applies all operations in the batch atomically. Returns coreeng.ErrIllegalKey without
+// applying anything if any of the keys is illegal.
+func (wen WrapperEngine) Write(user string, wb *coreeng.WriteBatch) error {
+	return wen.core.Write([]byte(user), wb)
+}
+
+// Scan returns all records stored in the system whose keys fall in the range [start, end), in
+// ascending key order. An empty end means there is no upper bound.
+func (wen WrapperEngine) Scan(user, start, end string) ([]record.Record, error) {
+	it, err := wen.core.Scan([]byte(user), []byte(start), []byte(end))
+	if err != nil {
+		return nil, err
+	}
+
+	recs := []record.Record{}
+	for rec, last := it.Next(); !last; rec, last = it.Next() {
+		recs = append(recs, rec)
+	}
+	return recs, it.Err()
+}
+
+// ScanPrefix returns all records stored in the system whose keys begin with prefix, in ascending
+// key order.
+// SSTables whose key range can't hold the prefix are skipped without being read.
+func (wen WrapperEngine) ScanPrefix(user, prefix string) ([]record.Record, error) {
+	return wen.Scan(user, prefix, prefixEnd(prefix))
+}
+
+// prefixEnd returns the smallest key greater than every key beginning with prefix, or an empty
+// string if there is no such key (the prefix is made up of 0xFF bytes only).
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xFF {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
+
 // PutCMS writes a new record in the system whose value represents a CMS object.
-func (wen WrapperEngine) PutCMS(user, key string, cms cmsketch.CountMinSketch) bool {
+func (wen WrapperEngine) PutCMS(user, key string, cms cmsketch.CountMinSketch) error {
 	return wen.PutTyped(user, key, cms.EncodeToBytes(), TypeCountMinSketch)
 }
 
 // PutHLL writes a new record in the system whose value represents a HLL object.
-func (wen WrapperEngine) PutHLL(user, key string, hll hll.HLL) bool {
+func (wen WrapperEngine) PutHLL(user, key string, hll hll.HLL) error {
 	return wen.PutTyped(user, key, hll.EncodeToBytes(), TypeHyperLogLog)
 }
 
 // GetCMS returns a CountMinSketch object found in the system under the passed key.
-func (wen WrapperEngine) GetCMS(user, key string) *cmsketch.CountMinSketch {
-	rec, found := wen.Get(user, key)
-	if !found || rec.TypeInfo != TypeCountMinSketch {
-		return nil
+// Returns coreeng.ErrNotFound if the record isn't present or doesn't hold a CMS object, and an error
+// wrapping coreeng.ErrCorruption if its value can't be decoded into one.
+func (wen WrapperEngine) GetCMS(user, key string) (*cmsketch.CountMinSketch, error) {
+	rec, err := wen.Get(user, key)
+	if err != nil {
+		return nil, err
+	}
+	if rec.TypeInfo != TypeCountMinSketch {
+		return nil, coreeng.ErrNotFound
 	}
-	return cmsketch.DecodeFromBytes(rec.Value)
+	cms, err := cmsketch.DecodeFromBytes(rec.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad CMS under key %q: %v", coreeng.ErrCorruption, key, err)
+	}
+	return cms, nil
 }
 
 // GetHLL returns a HyperLogLog object found in the system under the passed key.
-func (wen WrapperEngine) GetHLL(user, key string) *hll.HLL {
-	rec, found := wen.Get(user, key)
-	if !found || rec.TypeInfo != TypeHyperLogLog {
-		return nil
+// Returns coreeng.ErrNotFound if the record isn't present or doesn't hold a HLL object, and an error
+// wrapping coreeng.ErrCorruption if its value can't be decoded into one.
+func (wen WrapperEngine) GetHLL(user, key string) (*hll.HLL, error) {
+	rec, err := wen.Get(user, key)
+	if err != nil {
+		return nil, err
+	}
+	if rec.TypeInfo != TypeHyperLogLog {
+		return nil, coreeng.ErrNotFound
+	}
+	h, err := hll.DecodeFromBytes(rec.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad HLL under key %q: %v", coreeng.ErrCorruption, key, err)
 	}
-	return hll.DecodeFromBytes(rec.Value)
+	return h, nil
+}
+
+// Ingest adds SSTables built outside of the engine to it, as they are. Each table is given by the
+// path to any one of its files. See CoreEngine.Ingest.
+func (wen WrapperEngine) Ingest(files []string) error {
+	return wen.core.Ingest(files)
+}
+
+// Backup copies the database into the directory at dir, to be restored later on. See
+// CoreEngine.Backup.
+func (wen WrapperEngine) Backup(dir string) error {
+	return wen.core.Backup(dir)
 }
 
 // FlushWALBuffer is a convenience function for flushing the WAL's buffer.
-func (wen WrapperEngine) FlushWALBuffer() {
-	wen.core.FlushWALBuffer()
+func (wen WrapperEngine) FlushWALBuffer() error {
+	return wen.core.FlushWALBuffer()
+}
+
+// WALBounds returns the positions of the start and the end of the WAL.
+func (wen WrapperEngine) WALBounds() (wal.Position, wal.Position) {
+	return wen.core.WALBounds()
+}
+
+// WALReader returns a Reader over the records in the WAL, starting from the given position. See
+// CoreEngine.WALReader.
+func (wen WrapperEngine) WALReader(from wal.Position, follow bool) (*wal.Reader, error) {
+	return wen.core.WALReader(from, follow)
+}
+
+// WaitIdle blocks until the engine's background flushes and compactions are done.
+func (wen WrapperEngine) WaitIdle() error {
+	return wen.core.WaitIdle()
+}
+
+// Close waits for the engine's background work to finish, and flushes the WAL's buffer.
+func (wen WrapperEngine) Close() error {
+	return wen.core.Close()
 }
 
 func main() {
@@ -93,7 +190,10 @@ func main() {
 		panic(err)
 	}
 
-	engine := New(conf)
+	engine, err := New(conf)
+	if err != nil {
+		panic(err)
+	}
 	test(engine)
 }
 
@@ -114,11 +214,14 @@ func test(engine WrapperEngine) {
 	fmt.Println(cms.Query([]byte{2, 5}))
 	fmt.Println("AFTER ENGINEERING")
 	engine.PutCMS(user, "cs", *cms)
-	rec, found := engine.Get(user, "cs")
-	if !found || rec.TypeInfo != TypeCountMinSketch {
+	rec, err := engine.Get(user, "cs")
+	if err != nil || rec.TypeInfo != TypeCountMinSketch {
 		panic(rec)
 	}
-	cms2 := cmsketch.DecodeFromBytes(rec.Value)
+	cms2, err := cmsketch.DecodeFromBytes(rec.Value)
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(cms2.K)
 	fmt.Println(cms2.M)
 	//cms2.Insert([]byte{1, 2})
@@ -140,11 +243,14 @@ func test(engine WrapperEngine) {
 	fmt.Println(hll1.Estimate())
 	fmt.Println("AFTER ENGINEERING")
 	engine.PutHLL(user, "hl", *hll1)
-	rec, found = engine.Get(user, "hl")
-	if !found || rec.TypeInfo != TypeHyperLogLog {
+	rec, err = engine.Get(user, "hl")
+	if err != nil || rec.TypeInfo != TypeHyperLogLog {
 		panic(rec)
 	}
-	hll2 := hll.DecodeFromBytes(rec.Value)
+	hll2, err := hll.DecodeFromBytes(rec.Value)
+	if err != nil {
+		panic(err)
+	}
 	fmt.Println(hll2.Estimate())
 	engine.FlushWALBuffer()
 }
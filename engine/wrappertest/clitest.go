@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"nakevaleng/ds/cmsketch"
 	hyperloglog "nakevaleng/ds/hll"
+	"nakevaleng/engine/coreeng"
 	"nakevaleng/engine/wrappereng"
 	"os"
 	"strconv"
@@ -69,12 +70,17 @@ func (cli *CLITest) Next() {
 		"put":  cli.put,
 		"get":  cli.get,
 		"del":  cli.del,
+		"scan": cli.scan,
+		"scnp": cli.scnp,
 		"hllc": cli.hllc,
 		"hll":  cli.hll,
 		"cmsc": cli.cmsc,
 		"cms":  cli.cms,
 		"cmsq": cli.cmsq,
 		"test": cli.test,
+		"conc": cli.conc,
+		"look": cli.look,
+		"ingt": cli.ingt,
 		"quit": cli.quit,
 	}
 
@@ -121,6 +127,26 @@ func (cli CLITest) cmdHasArgc(n int) bool {
 	return len(cli.args)-1 == n
 }
 
+// checkErr reports an error returned by the engine for the given key. Returns true if there was
+// no error.
+func (cli *CLITest) checkErr(key string, err error) bool {
+	if err == nil {
+		return true
+	}
+
+	if errors.Is(err, coreeng.ErrIllegalKey) {
+		cli.state = _BAD_KEY
+	} else if errors.Is(err, coreeng.ErrNotFound) {
+		fmt.Println(key, "not found")
+	} else if errors.Is(err, coreeng.ErrRateLimited) {
+		fmt.Println("Slow down,", err)
+	} else {
+		fmt.Println(err)
+		cli.state = _ERROR
+	}
+	return false
+}
+
 func (cli *CLITest) put() bool {
 	if !cli.cmdHasArgc(2) {
 		cli.state = _BAD_ARGC
@@ -129,14 +155,9 @@ func (cli *CLITest) put() bool {
 
 	key := cli.args[1]
 	val := []byte(cli.args[2])
-	legalKey := cli.eng.Put(cli.user, key, val)
-
-	if !legalKey {
-		cli.state = _BAD_KEY
-		return false
-	}
+	err := cli.eng.Put(cli.user, key, val)
 
-	return true
+	return cli.checkErr(key, err)
 }
 
 func (cli *CLITest) quit() bool {
@@ -146,8 +167,7 @@ func (cli *CLITest) quit() bool {
 	}
 
 	cli.running = false
-	cli.eng.FlushWALBuffer()
-	return true
+	return cli.checkErr("", cli.eng.Close())
 }
 
 func (cli *CLITest) get() bool {
@@ -157,10 +177,9 @@ func (cli *CLITest) get() bool {
 	}
 
 	key := cli.args[1]
-	rec, found := cli.eng.Get(cli.user, key)
+	rec, err := cli.eng.Get(cli.user, key)
 
-	if !found {
-		fmt.Println(key, "not found")
+	if !cli.checkErr(key, err) {
 		return false
 	} else {
 		fmt.Println(rec)
@@ -176,13 +195,55 @@ func (cli *CLITest) del() bool {
 	}
 
 	key := cli.args[1]
-	found := cli.eng.Delete(cli.user, key)
+	err := cli.eng.Delete(cli.user, key)
 
-	if !found {
-		fmt.Println(key, "not found")
+	return cli.checkErr(key, err)
+}
+
+func (cli *CLITest) scan() bool {
+	// scan start     is for everything from start onwards
+	// scan start end is for everything from start up to (but not including) end
+
+	var start, end string
+	if cli.cmdHasArgc(1) {
+		start = cli.args[1]
+	} else if cli.cmdHasArgc(2) {
+		start = cli.args[1]
+		end = cli.args[2]
+	} else {
+		cli.state = _BAD_ARGC
+		return false
+	}
+
+	recs, err := cli.eng.Scan(cli.user, start, end)
+	if !cli.checkErr(start, err) {
 		return false
 	}
 
+	for _, rec := range recs {
+		fmt.Println(rec)
+	}
+	fmt.Println(len(recs), "record(s) found")
+
+	return true
+}
+
+func (cli *CLITest) scnp() bool {
+	if !cli.cmdHasArgc(1) {
+		cli.state = _BAD_ARGC
+		return false
+	}
+
+	recs, err := cli.eng.ScanPrefix(cli.user, cli.args[1])
+	if !cli.checkErr(cli.args[1], err) {
+		return false
+	}
+
+	for _, rec := range recs {
+		fmt.Println(rec)
+	}
+	fmt.Println(len(recs), "record(s) found")
+
 	return true
 }
 
@@ -206,9 +267,7 @@ func (cli *CLITest) hllc() bool {
 		return false
 	}
 
-	cli.eng.PutHLL(cli.user, key, *hll)
-
-	return true
+	return cli.checkErr(key, cli.eng.PutHLL(cli.user, key, *hll))
 }
 
 func (cli *CLITest) hll() bool {
@@ -217,9 +276,8 @@ func (cli *CLITest) hll() bool {
 
 	if cli.cmdHasArgc(1) {
 		key := cli.args[1]
-		hll := cli.eng.GetHLL(cli.user, key)
-		if hll == nil {
-			fmt.Println(key, "not found.")
+		hll, err := cli.eng.GetHLL(cli.user, key)
+		if !cli.checkErr(key, err) {
 			return false
 		}
 		fmt.Println(key, ": est =", hll.Estimate())
@@ -227,14 +285,12 @@ func (cli *CLITest) hll() bool {
 	} else if cli.cmdHasArgc(2) {
 		key := cli.args[1]
 		val := []byte(cli.args[2])
-		hll := cli.eng.GetHLL(cli.user, key)
-		if hll == nil {
-			fmt.Println(key, "not found.")
+		hll, err := cli.eng.GetHLL(cli.user, key)
+		if !cli.checkErr(key, err) {
 			return false
 		}
 		hll.Add(val)
-		cli.eng.PutHLL(cli.user, key, *hll)
-		return true
+		return cli.checkErr(key, cli.eng.PutHLL(cli.user, key, *hll))
 	} else {
 		cli.state = _BAD_ARGC
 		return false
@@ -265,9 +321,7 @@ func (cli *CLITest) cmsc() bool {
 		return false
 	}
 
-	cli.eng.PutCMS(cli.user, key, *cms)
-
-	return true
+	return cli.checkErr(key, cli.eng.PutCMS(cli.user, key, *cms))
 }
 
 func (cli *CLITest) cms() bool {
@@ -278,14 +332,12 @@ func (cli *CLITest) cms() bool {
 
 	key := cli.args[1]
 	val := []byte(cli.args[2])
-	cms := cli.eng.GetCMS(cli.user, key)
-	if cms == nil {
-		fmt.Println(key, "not found.")
+	cms, err := cli.eng.GetCMS(cli.user, key)
+	if !cli.checkErr(key, err) {
 		return false
 	}
 	cms.Insert(val)
-	cli.eng.PutCMS(cli.user, key, *cms)
-	return true
+	return cli.checkErr(key, cli.eng.PutCMS(cli.user, key, *cms))
 }
 
 func (cli *CLITest) cmsq() bool {
@@ -296,9 +348,8 @@ func (cli *CLITest) cmsq() bool {
 
 	key := cli.args[1]
 	val := []byte(cli.args[2])
-	cms := cli.eng.GetCMS(cli.user, key)
-	if cms == nil {
-		fmt.Println(key, "not found.")
+	cms, err := cli.eng.GetCMS(cli.user, key)
+	if !cli.checkErr(key, err) {
 		return false
 	}
 	fmt.Println(key, ": est =", cms.Query(val))
@@ -322,13 +373,77 @@ func (cli *CLITest) test() bool {
 	return true
 }
 
+func (cli *CLITest) conc() bool {
+	if !cli.cmdHasArgc(2) {
+		cli.state = _BAD_ARGC
+		return false
+	}
+
+	workers, err := strconv.Atoi(cli.args[1])
+	if err != nil || workers <= 0 {
+		cli.state = _BAD_ARGV
+		return false
+	}
+	ops, err := strconv.Atoi(cli.args[2])
+	if err != nil || ops <= 0 {
+		cli.state = _BAD_ARGV
+		return false
+	}
+
+	return ConcurrencyTest(cli.eng, workers, ops) == 0
+}
+
+func (cli *CLITest) look() bool {
+	if cli.cmdHasArgc(0) {
+		return LookupBenchmark(1000000, 50000, []int{3, 16, 64, 256}) == 0
+	}
+	if len(cli.args) < 4 {
+		cli.state = _BAD_ARGC
+		return false
+	}
+
+	nums := make([]int, len(cli.args)-1)
+	for i, arg := range cli.args[1:] {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			cli.state = _BAD_ARGV
+			return false
+		}
+		nums[i] = n
+	}
+
+	return LookupBenchmark(nums[0], nums[1], nums[2:]) == 0
+}
+
+func (cli *CLITest) ingt() bool {
+	if !cli.cmdHasArgc(1) {
+		cli.state = _BAD_ARGC
+		return false
+	}
+
+	keys, err := strconv.Atoi(cli.args[1])
+	if err != nil || keys <= 0 {
+		cli.state = _BAD_ARGV
+		return false
+	}
+
+	return IngestRestartTest(keys) == 0
+}
+
 func (cli *CLITest) help() bool {
 	fmt.Println()
 	fmt.Println("help               -  view list of commands")
 	fmt.Println("test [fname]       -  run a csv test from specified filename (ignores current user)")
+	fmt.Println("conc [n] [ops]     -  run [ops] random operations from each of [n] goroutines at once (ignores current user)")
+	fmt.Println("look               -  time binary and linear lookups in an SSTable of 1M keys, for summary page sizes 3, 16, 64 and 256")
+	fmt.Println("look [n] [ops] [p] -  time [ops] lookups in an SSTable of [n] keys, for each of the given summary page sizes [p]")
+	fmt.Println("ingt [n]           -  ingest new values for [n] flushed keys, then check them before and after a restart")
 	fmt.Println("put  [key] [val]   -  insert record")
 	fmt.Println("get  [key]         -  find record by key")
 	fmt.Println("del  [key]         -  delete record by key")
+	fmt.Println("scan [start]       -  list records with keys from [start] onwards")
+	fmt.Println("scan [start] [end] -  list records with keys from [start] up to (but not including) [end]")
+	fmt.Println("scnp [prefix]      -  list records with keys beginning with [prefix]")
 	fmt.Println("hllc [key] [k]     -  create HLL object [key] with precision [k] (between 4 and 16)")
 	fmt.Println("hll  [key] [val]   -  put element [val] into HLL [key]")
 	fmt.Println("hll  [key]         -  get estimate for HLL [key]")
@@ -0,0 +1,147 @@
+package wrappertest
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"nakevaleng/engine/coreeng"
+	"nakevaleng/engine/wrappereng"
+	"sync"
+	"time"
+)
+
+// ConcurrencyTest hammers the WrapperEngine from the given number of goroutines, each of which
+// performs ops random operations. Every goroutine works as its own user on its own keys, and keeps
+// a model of what it wrote, so each Get and ScanPrefix can be checked against it. Keys are unique
+// to each run of the test, so leftovers from earlier runs don't interfere. All goroutines
+// also write to and read from a small set of shared keys, which are only checked for errors.
+// Run the program with -race to have the race detector watch over the whole engine.
+// Returns the number of mismatches and unexpected errors.
+func ConcurrencyTest(wen *wrappereng.WrapperEngine, workers, ops int) int {
+	var wg sync.WaitGroup
+	failures := make([]int, workers)
+	run := time.Now().UnixNano()
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			failures[w] = concurrencyWorker(wen, run, w, ops)
+		}(w)
+	}
+	wg.Wait()
+
+	total := 0
+	for _, f := range failures {
+		total += f
+	}
+	err := wen.WaitIdle()
+	if err != nil {
+		fmt.Println("Background work failed:", err)
+		total++
+	}
+	fmt.Println("Concurrency test done:", workers, "goroutines,", workers*ops, "operations,", total, "failure(s)")
+	return total
+}
+
+// concurrencyWorker is the body of a single ConcurrencyTest goroutine.
+func concurrencyWorker(wen *wrappereng.WrapperEngine, run int64, w, ops int) int {
+	user := fmt.Sprintf("USER%04d", w)
+	prefix := fmt.Sprintf("conc_%d_%04d_", run, w)
+	rnd := rand.New(rand.NewSource(int64(w)))
+	model := map[string]string{}
+	failures := 0
+
+	fail := func(format string, args ...interface{}) {
+		fmt.Printf("[%s] "+format+"\n", append([]interface{}{user}, args...)...)
+		failures++
+	}
+
+	// The token bucket isn't what's being tested here, so just wait for it to refill.
+
+	retry := func(op func() error) error {
+		for {
+			err := op()
+			if !errors.Is(err, coreeng.ErrRateLimited) {
+				return err
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	for i := 0; i < ops; i++ {
+		key := fmt.Sprintf("%s%03d", prefix, rnd.Intn(50))
+		shared := fmt.Sprintf("conc_shared_%d", rnd.Intn(5))
+		k := rnd.Intn(100)
+
+		if k < 40 {
+			val := fmt.Sprintf("val_%d_%d", w, i)
+			err := retry(func() error { return wen.Put(user, key, []byte(val)) })
+			if err != nil {
+				fail("put %s: %s", key, err)
+				continue
+			}
+			model[key] = val
+		} else if k < 50 {
+			err := retry(func() error { return wen.Delete(user, key) })
+			_, inModel := model[key]
+			if err == nil && !inModel {
+				fail("del %s: deleted a key that was never written", key)
+			} else if errors.Is(err, coreeng.ErrNotFound) && inModel {
+				fail("del %s: not found", key)
+			} else if err != nil && !errors.Is(err, coreeng.ErrNotFound) {
+				fail("del %s: %s", key, err)
+			}
+			delete(model, key)
+		} else if k < 80 {
+			var got string
+			err := retry(func() error {
+				rec, err := wen.Get(user, key)
+				got = string(rec.Value)
+				return err
+			})
+			want, inModel := model[key]
+			if errors.Is(err, coreeng.ErrNotFound) {
+				if inModel {
+					fail("get %s: not found, want %s", key, want)
+				}
+			} else if err != nil {
+				fail("get %s: %s", key, err)
+			} else if !inModel || got != want {
+				fail("get %s: got %s, want %s", key, got, want)
+			}
+		} else if k < 85 {
+			var n int
+			err := retry(func() error {
+				recs, err := wen.ScanPrefix(user, prefix)
+				for _, rec := range recs {
+					if want, ok := model[string(rec.Key)]; !ok || want != string(rec.Value) {
+						fail("scan %s: unexpected %s = %s", prefix, rec.Key, rec.Value)
+					}
+				}
+				n = len(recs)
+				return err
+			})
+			if err != nil {
+				fail("scan %s: %s", prefix, err)
+			} else if n != len(model) {
+				fail("scan %s: got %d records, want %d", prefix, n, len(model))
+			}
+		} else if k < 95 {
+			err := retry(func() error { return wen.Put(user, shared, []byte(user)) })
+			if err != nil {
+				fail("put %s: %s", shared, err)
+			}
+		} else {
+			err := retry(func() error {
+				_, err := wen.Get(user, shared)
+				return err
+			})
+			if err != nil && !errors.Is(err, coreeng.ErrNotFound) {
+				fail("get %s: %s", shared, err)
+			}
+		}
+	}
+
+	return failures
+}
@@ -0,0 +1,125 @@
+package wrappertest
+
+import (
+	"fmt"
+	"nakevaleng/core/record"
+	"nakevaleng/core/sstable"
+	"nakevaleng/engine/coreconf"
+	"nakevaleng/engine/wrappereng"
+	"nakevaleng/util/filename"
+	"os"
+)
+
+// IngestRestartTest checks that ingested records survive a restart. It opens an engine of its own
+// in a temporary directory, with the default configuration, writes the given number of keys and
+// waits for them to be flushed, so that the WAL segments kept after the flushes still hold them.
+// It then ingests an SSTable holding new values for all of the keys, overwrites the first few
+// once more (without filling up the Memtable), and checks all of the values before and after
+// closing and reopening the engine. The directories are removed afterwards. Returns the number of
+// wrong values and errors.
+func IngestRestartTest(keys int) int {
+	failures := 0
+	fail := func(format string, args ...interface{}) {
+		fmt.Printf(format+"\n", args...)
+		failures++
+	}
+
+	dir, err := os.MkdirTemp("", "nakevaleng-ingest")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	dir += "/"
+
+	conf := coreconf.GetDefault()
+	conf.Path = dir + "data/"
+	conf.WalPath = dir + "data/log/"
+	conf.TokenBucketTokens = 4 * keys // The token bucket isn't what's being tested here.
+	err = os.MkdirAll(conf.WalPath, 0777)
+	if err != nil {
+		panic(err)
+	}
+
+	key := func(i int) string {
+		return fmt.Sprintf("ingest%05d", i)
+	}
+	want := map[string]string{}
+
+	wen, err := wrappereng.New(&conf)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < keys; i++ {
+		want[key(i)] = "old"
+		err = wen.Put("INGEST", key(i), []byte("old"))
+		if err != nil {
+			fail("Put %s: %s", key(i), err)
+		}
+	}
+	err = wen.WaitIdle()
+	if err != nil {
+		fail("Flushing the old values: %s", err)
+	}
+
+	// The old values get sequence numbers up to keys, so the ingested ones are written with lower
+	// ones, which the table's global sequence number has to override.
+
+	w, err := sstable.NewWriter(dir, "ingest", conf.SummaryPageSize, 1, 1, conf.SSTableCodec, conf.SSTableLayout)
+	if err != nil {
+		panic(err)
+	}
+	for i := 0; i < keys; i++ {
+		want[key(i)] = "ingested"
+		rec := record.New([]byte(key(i)), []byte("ingested"))
+		rec.Seq = 1
+		err = w.Add(rec)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = w.Finish()
+	if err != nil {
+		panic(err)
+	}
+	err = wen.Ingest([]string{filename.Table(dir, "ingest", 1, 1, filename.TypeData)})
+	if err != nil {
+		fail("Ingest: %s", err)
+	}
+
+	for i := 0; i < keys && i < 3; i++ {
+		want[key(i)] = "new"
+		err = wen.Put("INGEST", key(i), []byte("new"))
+		if err != nil {
+			fail("Put %s: %s", key(i), err)
+		}
+	}
+
+	check := func(when string) {
+		for i := 0; i < keys; i++ {
+			rec, err := wen.Get("INGEST", key(i))
+			if err != nil {
+				fail("Get %s %s: %s", key(i), when, err)
+			} else if string(rec.Value) != want[key(i)] {
+				fail("Get %s %s: got %q, want %q", key(i), when, rec.Value, want[key(i)])
+			}
+		}
+	}
+
+	check("before the restart")
+	err = wen.Close()
+	if err != nil {
+		fail("Close: %s", err)
+	}
+	wen, err = wrappereng.New(&conf)
+	if err != nil {
+		panic(err)
+	}
+	check("after the restart")
+	err = wen.Close()
+	if err != nil {
+		fail("Close: %s", err)
+	}
+
+	fmt.Println("Ingest restart test done:", keys, "keys,", failures, "failure(s)")
+	return failures
+}
@@ -0,0 +1,116 @@
+package wrappertest
+
+import (
+	"fmt"
+	"math/rand"
+	"nakevaleng/core/record"
+	"nakevaleng/core/sstable"
+	"os"
+	"runtime"
+	"time"
+)
+
+// LookupBenchmark writes an SSTable with the given number of keys for each of the given Summary
+// page sizes, and times lookups in it: through an open Reader, which keeps the Summary table in
+// memory and reads a single page of the Index table, and through a Reader opened for every lookup.
+// Each is timed twice, with the Summary table and the Index page binary searched (Get) and with
+// both searched linearly (GetLinear), which is how lookups were done before. Half of the looked up
+// keys are in the table, the other half fall between its keys. The tables are written into a
+// temporary directory, which is removed afterwards. Returns the number of wrong lookup results.
+func LookupBenchmark(keys, lookups int, pageSizes []int) int {
+	failures := 0
+
+	for _, pageSize := range pageSizes {
+		dir, err := os.MkdirTemp("", "nakevaleng-lookup")
+		if err != nil {
+			panic(err)
+		}
+		dir += "/"
+
+		// Keys in the table are even, so odd ones are missing.
+
+		key := func(i int) []byte {
+			return []byte(fmt.Sprintf("lookup%09d", i))
+		}
+		i := 0
+		it := func() (record.Record, bool) {
+			if i == keys {
+				return record.NewEmpty(), true
+			}
+			rec := record.New(key(2*i), []byte("value"))
+			rec.Seq = uint64(i + 1)
+			i++
+			return rec, false
+		}
+
+		start := time.Now()
+		err = sstable.MakeTable(dir, "lookup", pageSize, 1, 1, sstable.CODEC_NONE, sstable.LAYOUT_MULTI, it)
+		if err != nil {
+			panic(err)
+		}
+		fmt.Println("Page size", pageSize, "- wrote", keys, "keys in", time.Since(start))
+
+		rnd := rand.New(rand.NewSource(int64(pageSize)))
+		sample := make([]int, lookups)
+		for n := range sample {
+			sample[n] = rnd.Intn(2 * keys)
+		}
+
+		type getFunc func(r *sstable.Reader, key []byte) (record.Record, bool, error)
+		lookup := func(r *sstable.Reader, get getFunc, n int) {
+			rec, found, err := get(r, key(n))
+			if err != nil || found != (n%2 == 0) || (found && string(rec.Key) != string(key(n))) {
+				failures++
+			}
+		}
+
+		for _, search := range []struct {
+			name string
+			get  getFunc
+		}{
+			{"binary", (*sstable.Reader).Get},
+			{"linear", (*sstable.Reader).GetLinear},
+		} {
+			r, err := sstable.OpenReader(dir, "lookup", 1, 1)
+			if err != nil {
+				panic(err)
+			}
+			timeLookups(search.name+", open Reader", sample, func(n int) { lookup(r, search.get, n) })
+			r.Close()
+
+			timeLookups(search.name+", Reader per lookup", sample[:lookups/10+1], func(n int) {
+				r, err := sstable.OpenReader(dir, "lookup", 1, 1)
+				if err != nil {
+					panic(err)
+				}
+				lookup(r, search.get, n)
+				r.Close()
+			})
+		}
+
+		err = os.RemoveAll(dir)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	fmt.Println("Lookup benchmark done:", failures, "failure(s)")
+	return failures
+}
+
+// timeLookups calls lookup for each of the samples and prints the time and allocations per call.
+func timeLookups(name string, sample []int, lookup func(n int)) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+
+	for _, n := range sample {
+		lookup(n)
+	}
+
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+	fmt.Printf("  %-28s %10d ns/op %8d allocs/op\n", name,
+		elapsed.Nanoseconds()/int64(len(sample)), (after.Mallocs-before.Mallocs)/uint64(len(sample)))
+}
@@ -30,7 +30,6 @@ func Test(wen *wrappereng.WrapperEngine, testPath string) {
 		panic(err)
 	}
 	var got record.Record
-	var found bool
 	for {
 		rec, err := csvReader.Read()
 		if rec == nil {
@@ -87,20 +86,27 @@ func Test(wen *wrappereng.WrapperEngine, testPath string) {
 		} else if rec[1] == "D" {
 			wen.Delete(rec[0], rec[2])
 		} else if rec[1] == "G" {
-			got, found = wen.Get(rec[0], rec[2])
-			if found {
+			got, err = wen.Get(rec[0], rec[2])
+			if err == nil {
 				if got.TypeInfo == wrappereng.TypeHyperLogLog {
-					fmt.Println(rec[2], "returned HLL with estimate at:", hll.DecodeFromBytes(got.Value).Estimate())
+					hl, err := hll.DecodeFromBytes(got.Value)
+					if err != nil {
+						panic(err)
+					}
+					fmt.Println(rec[2], "returned HLL with estimate at:", hl.Estimate())
 				} else if got.TypeInfo == wrappereng.TypeCountMinSketch {
-					fmt.Println(rec[2], "returned CMS with 3 presence estimate at:",
-						cmsketch.DecodeFromBytes(got.Value).Query([]byte("3")))
+					cms, err := cmsketch.DecodeFromBytes(got.Value)
+					if err != nil {
+						panic(err)
+					}
+					fmt.Println(rec[2], "returned CMS with 3 presence estimate at:", cms.Query([]byte("3")))
 				} else if got.TypeInfo == wrappereng.TypeVoid {
 					fmt.Println(rec[2], "returns:", got)
 				} else {
 					log.Panicln("UNEXPECTED TYPE: ", got)
 				}
 			} else {
-				fmt.Println(rec[2], "not found")
+				fmt.Println(rec[2], err)
 			}
 		}
 	}
@@ -211,6 +217,9 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	wen := wrappereng.New(conf)
+	wen, err := wrappereng.New(conf)
+	if err != nil {
+		panic(err)
+	}
 	Test(&wen, "tests/w0001.csv")
 }
@@ -11,7 +11,10 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	eng := wrappereng.New(conf)
+	eng, err := wrappereng.New(conf)
+	if err != nil {
+		panic(err)
+	}
 	testCLI(&eng)
 }
 
@@ -4,7 +4,9 @@ package filename
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
 	"strconv"
 	"strings"
 
@@ -13,8 +15,9 @@ import (
 
 // Possible extensions for filenames created by nakevaleng, without leading period.
 const (
-	extensionDb  = "db"
-	extensionLog = "log"
+	extensionDb       = "db"
+	extensionLog      = "log"
+	extensionManifest = "manifest"
 )
 
 // FileType is an enum for possible file types. Possible values are Type*.
@@ -27,6 +30,7 @@ const (
 	TypeIndex             // Index table
 	TypeSummary           // Index summary table
 	TypeMetadata          // Merkle tree
+	TypeTable             // Single-file SSTable, holding all of the above
 	TypeLog               // Log
 )
 
@@ -37,6 +41,7 @@ var fileTypeAsString = [...]string{
 	"index",
 	"summary",
 	"metadata",
+	"table",
 	"log",
 }
 
@@ -47,7 +52,7 @@ func (ftype FileType) String() string {
 
 // IsSSTable returns true if the file represents a table in an SSTable
 func (ftype FileType) IsSSTable() bool {
-	return ftype >= TypeData && ftype <= TypeMetadata
+	return ftype >= TypeData && ftype <= TypeTable
 }
 
 // Table creates a valid table filename (with relative path) used for SSTables.
@@ -66,7 +71,7 @@ func Table(relativePath, dbname string, level, run int, filetype FileType) strin
 
 // Log creates a valid WAL filename (with relative path).
 //	dbname  `Name of the database (or the program that's using nakevaleng).`
-//	logno   `Index of the log file in the WAL. Must be >= 0.`
+//	logno   `ID of the log file in the WAL. Must be >= 0.`
 func Log(relativePath, dbname string, logno int) string {
 	if relativePath[len(relativePath)-1:] != "/" {
 		panic("Table() :: relativePath must end with '/'")
@@ -84,110 +89,127 @@ func Log(relativePath, dbname string, logno int) string {
 //		level   `Level the table is on, used for compaction.`
 //		run     `Index of the SSTable of this table.`
 //	If the file is a log:
-//		level   `Index of the log file in the WAL.`
-//		run     `Index of the log file in the WAL.`
+//		level   `ID of the log file in the WAL.`
+//		run     `ID of the log file in the WAL.`
 //
 //		filetype`Which data does the table hold (see the FileType enum).`
 func Query(fname string) (dbname string, level, run int, filetype FileType) {
-	main := strings.Split(fname, ".") // main[0] = name, main[1] = extension
+	dbname = ""
+	level = -1
+	run = -1
+	filetype = TypeBad
+
+	fname = fname[strings.LastIndex(fname, "/")+1:] // trim path from file name
+	main := strings.Split(fname, ".")                 // main[0] = name, main[1] = extension
 
 	if len(main) != 2 {
-		dbname = ""
-		level = -1
-		run = -1
-		filetype = TypeBad
 		return
 	}
 
-	main[0] = main[0][strings.LastIndex(main[0], "/")+1:] // trim path from file name
-
-	strings := strings.Split(main[0], "-")
-
+	parts := strings.Split(main[0], "-")
 	extension := main[1]
 
-	if extension == extensionDb {
-		dbname = strings[0]
-		level, _ = strconv.Atoi(strings[1])
-		run, _ = strconv.Atoi(strings[2])
-		filetype = toFileType(strings[3])
-	} else if extension == extensionLog {
-		dbname = strings[0]
-		level, _ = strconv.Atoi(strings[1])
+	if extension == extensionDb && len(parts) == 4 {
+		dbname = parts[0]
+		level, _ = strconv.Atoi(parts[1])
+		run, _ = strconv.Atoi(parts[2])
+		filetype = toFileType(parts[3])
+	} else if extension == extensionLog && len(parts) == 2 {
+		dbname = parts[0]
+		level, _ = strconv.Atoi(parts[1])
 		run = level
 		filetype = TypeLog
-	} else {
+	}
+
+	if filetype == TypeBad {
 		dbname = ""
 		level = -1
 		run = -1
-		filetype = TypeBad
 	}
 
 	return
 }
 
+// Manifest creates the filename (with relative path) of the database's MANIFEST, which lists the
+// live tables.
+func Manifest(relativePath, dbname string) string {
+	if relativePath[len(relativePath)-1:] != "/" {
+		panic("Manifest() :: relativePath must end with '/'")
+	}
+
+	return relativePath + dbname + "." + extensionManifest
+}
+
+// Staging returns the directory (with relative path) where new tables are written before they're
+// moved into place at relativePath. Files in it are never seen by the GetLast* functions for
+// relativePath, so unfinished tables stay invisible to readers.
+func Staging(relativePath string) string {
+	if relativePath[len(relativePath)-1:] != "/" {
+		panic("Staging() :: relativePath must end with '/'")
+	}
+
+	return relativePath + "tmp/"
+}
+
+// BackupLog returns the directory (with relative path) where the WAL's segments go in a backup of
+// the database kept at relativePath.
+func BackupLog(relativePath string) string {
+	if relativePath[len(relativePath)-1:] != "/" {
+		panic("BackupLog() :: relativePath must end with '/'")
+	}
+
+	return relativePath + "log/"
+}
+
 // GetLastLevel returns the level of the greatest value at the specified path for the database name.
-func GetLastLevel(relativePath, dbname string) int {
-	files, err := ioutil.ReadDir(relativePath)
+// Returns -1 if there are no tables. Files belonging to other databases are ignored.
+func GetLastLevel(relativePath, dbname string) (int, error) {
+	filesStr, err := readDirSorted(relativePath)
 	if err != nil {
-		panic(err)
+		return -1, err
 	}
 
 	level := -1
 
-	filesStr := []string{}
-	for _, f := range files {
-		filesStr = append(filesStr, f.Name())
-	}
-	natsort.Sort(filesStr)
-
-	for i := len(files) - 1; i >= 0; i-- {
+	for i := len(filesStr) - 1; i >= 0; i-- {
 		file := filesStr[i]
 
 		dbgot, thisLevel, _, filetype := Query(file)
 
-		if !filetype.IsSSTable() {
+		if !filetype.IsSSTable() || dbgot != dbname {
 			continue
 		}
 
-		if dbgot != dbname {
-			panic("GetLastLevelAndRun() :: Bad database names (not matching)!")
-		}
-
 		if thisLevel > level {
 			level = thisLevel
 		}
 
 	}
 
-	return level
+	return level, nil
 }
 
 // GetLastRun returns the run at given level at the specified path for the given database name.
 // Returns a number from 0 onwards.
 // Returns -1 if the level does not exist (i.e. it's empty)
-func GetLastRun(relativepath, dbname string, level int) int {
+// Files belonging to other databases are ignored.
+func GetLastRun(relativepath, dbname string, level int) (int, error) {
 	if level <= 0 {
-		panic("Level must be >= 1")
+		return -1, fmt.Errorf("level must be >= 1, but %d was given", level)
 	}
 
-	files, err := ioutil.ReadDir(relativepath)
+	filesStr, err := readDirSorted(relativepath)
 	if err != nil {
-		panic(err)
+		return -1, err
 	}
 
 	run := -1
 
-	filesStr := []string{}
-	for _, f := range files {
-		filesStr = append(filesStr, f.Name())
-	}
-	natsort.Sort(filesStr)
-
-	for i := len(files) - 1; i >= 0; i-- {
+	for i := len(filesStr) - 1; i >= 0; i-- {
 		file := filesStr[i]
 		dbgot, thislevel, thisRun, filetype := Query(file)
 
-		if !filetype.IsSSTable() {
+		if !filetype.IsSSTable() || dbgot != dbname {
 			continue
 		}
 
@@ -195,93 +217,145 @@ func GetLastRun(relativepath, dbname string, level int) int {
 			continue
 		}
 
-		if dbgot != dbname {
-			panic("GetRun() :: Bad database names (not matching)!")
-		}
-
 		if thisRun > run {
 			run = thisRun
 		}
 	}
 
-	return run
+	return run, nil
 }
 
-// GetLastLog returns the index of the last log file at the specified path for the given database.
-func GetLastLog(relativePath string, dbname string) int {
-	files, err := ioutil.ReadDir(relativePath)
+// GetLastLog returns the ID of the last log file at the specified path for the given database.
+// Returns -1 if there are no log files. Files belonging to other databases are ignored.
+func GetLastLog(relativePath string, dbname string) (int, error) {
+	filesStr, err := readDirSorted(relativePath)
 	if err != nil {
-		panic(err)
+		return -1, err
 	}
 
 	logno := -1
 
-	filesStr := []string{}
-	for _, f := range files {
-		filesStr = append(filesStr, f.Name())
-	}
-	natsort.Sort(filesStr)
-
-	for i := len(files) - 1; i >= 0; i-- {
+	for i := len(filesStr) - 1; i >= 0; i-- {
 		file := filesStr[i]
 
-		dbgot := ""
-		filetype := TypeLog
 		dbgot, myLogNo, _, filetype := Query(file)
 
-		if filetype != TypeLog {
+		if filetype != TypeLog || dbgot != dbname {
 			continue
 		}
 
-		if dbgot != dbname {
-			panic("GetLastLog() :: Bad database names (not matching)!")
-		}
-
 		if myLogNo > logno {
 			logno = myLogNo
 		}
 	}
 
-	return logno
+	return logno, nil
 }
 
-// GetSegmentPaths returns a slice of all the log paths at the specified relative path for the given database.
-func GetSegmentPaths(relativePath string, dbname string) []string {
-	files, err := ioutil.ReadDir(relativePath)
+// GetSegmentPaths returns a slice of all the log paths at the specified relative path for the given database,
+// ordered by their IDs.
+// Files belonging to other databases are ignored.
+func GetSegmentPaths(relativePath string, dbname string) ([]string, error) {
+	filesStr, err := readDirSorted(relativePath)
 	if err != nil {
-		panic(err)
-	}
-
-	filesStr := []string{}
-	for _, f := range files {
-		filesStr = append(filesStr, f.Name())
+		return nil, err
 	}
-	natsort.Sort(filesStr)
 
 	segmentPaths := make([]string, 0)
-	for i := 0; i < len(files); i++ {
+	for i := 0; i < len(filesStr); i++ {
 		file := filesStr[i]
 
-		dbgot := ""
-		filetype := TypeLog
 		dbgot, myLogNo, _, filetype := Query(file)
 
-		if filetype != TypeLog {
+		if filetype != TypeLog || dbgot != dbname {
 			continue
 		}
 
-		if dbgot != dbname {
-			panic("GetLastLog() :: Bad database names (not matching)!")
-		}
-
 		path := Log(relativePath, dbgot, myLogNo)
 		segmentPaths = append(segmentPaths, path)
 	}
 
-	return segmentPaths
+	return segmentPaths, nil
+}
+
+// GetTablePaths returns a slice of the paths of all table files at the specified relative path for
+// the given database. Files belonging to other databases are ignored.
+func GetTablePaths(relativePath string, dbname string) ([]string, error) {
+	filesStr, err := readDirSorted(relativePath)
+	if err != nil {
+		return nil, err
+	}
+
+	tablePaths := make([]string, 0)
+	for _, file := range filesStr {
+		dbgot, level, run, filetype := Query(file)
+
+		if !filetype.IsSSTable() || dbgot != dbname {
+			continue
+		}
+
+		tablePaths = append(tablePaths, Table(relativePath, dbgot, level, run, filetype))
+	}
+
+	return tablePaths, nil
+}
+
+// SyncDir flushes the directory at the specified relative path to disk, so that files created in,
+// renamed into or removed from it stay that way after a crash.
+func SyncDir(relativePath string) error {
+	dir, err := os.Open(relativePath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// CopyFile copies the file at from into a new file at to, and syncs it. Fails if there already is
+// a file at to.
+func CopyFile(from, to string) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return CopyFrom(src, to)
+}
+
+// CopyFrom is like CopyFile, but copies whatever is left to read from src. Used to copy files that
+// are already open, which stay readable even if they're removed in the meantime.
+func CopyFrom(src io.Reader, to string) error {
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readDirSorted returns the names of all files in the directory, in natural order.
+func readDirSorted(relativePath string) ([]string, error) {
+	files, err := ioutil.ReadDir(relativePath)
+	if err != nil {
+		return nil, err
+	}
+
+	filesStr := []string{}
+	for _, f := range files {
+		filesStr = append(filesStr, f.Name())
+	}
+	natsort.Sort(filesStr)
+
+	return filesStr, nil
 }
 
-// ToFileType tries to convert a string into a FileType object. Will panic if no string is a match.
+// ToFileType tries to convert a string into a FileType object. Returns TypeBad if no string is a match.
 func toFileType(s string) FileType {
 	for i := 0; i < len(fileTypeAsString); i++ {
 		if fileTypeAsString[i] == s {
@@ -289,7 +363,7 @@ func toFileType(s string) FileType {
 		}
 	}
 
-	panic("Bad database filetype name!")
+	return TypeBad
 }
 
 // table creates a valid table filename from provided parameters, used for SSTables.
@@ -310,7 +384,7 @@ func table(dbname string, level, run int, filetype FileType) string {
 
 // log creates a valid WAL filename from the provided parameters.
 //	dbname  `Name of the database (or the program that's using nakevaleng).`
-//	logno   `Index of the log file on disk. Must be >= 0.`
+//	logno   `ID of the log file on disk. Must be >= 0.`
 func log(dbname string, logno int) string {
 	if logno < 0 {
 		panic("Level must be a positive integer!")